@@ -0,0 +1,3 @@
+module go-bookinfo/certs
+
+go 1.17
@@ -0,0 +1,227 @@
+// certs makes a local CA and certificates for the bookinfo services, to
+// try mutual TLS between them without a mesh:
+//
+//	certs -dir certs ca
+//	certs -dir certs issue productpage details reviews ratings
+//
+// Each service gets <name>.pem and <name>-key.pem, good for serving and
+// for calling the other services, with DNS names for the service, its
+// Kubernetes names and localhost, and the SPIFFE ID Istio would give it,
+// spiffe://<trust domain>/ns/<namespace>/sa/bookinfo-<name>. Then run a
+// service with
+//
+//	TLS_CERT_FILE=certs/reviews.pem TLS_KEY_FILE=certs/reviews-key.pem \
+//	TLS_CA_FILE=certs/ca.pem
+//
+// Issuing again replaces the certificates, which running services pick up
+// within seconds. The keys are not protected; do not use them for anything
+// but testing.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "certs", "directory of the CA and the certificates")
+	trustDomain := flag.String("trust-domain", "bookinfo.local", "trust domain of the SPIFFE IDs")
+	namespace := flag.String("namespace", "default", "Kubernetes namespace of the services")
+	validFor := flag.Duration("valid-for", 30*24*time.Hour, "lifetime of service certificates; the CA lasts ten times longer")
+	force := flag.Bool("force", false, "replace an existing CA")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: certs [flags] ca")
+		fmt.Fprintln(flag.CommandLine.Output(), "       certs [flags] issue <service>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "ca":
+		err = makeCA(*dir, *trustDomain, 10*(*validFor), *force)
+	case "issue":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		for _, name := range flag.Args()[1:] {
+			if err = issue(*dir, name, *trustDomain, *namespace, *validFor); err != nil {
+				break
+			}
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "certs: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// makeCA makes ca.pem and ca-key.pem in dir.
+func makeCA(dir, trustDomain string, validFor time.Duration, force bool) error {
+	certFile := filepath.Join(dir, "ca.pem")
+	if _, err := os.Stat(certFile); err == nil && !force {
+		return fmt.Errorf("%s exists, use -force to replace it", certFile)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newTemplate(validFor)
+	if err != nil {
+		return err
+	}
+	template.Subject = pkix.Name{Organization: []string{"bookinfo"}, CommonName: "bookinfo CA " + trustDomain}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(dir, "ca-key.pem"), key); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", certFile)
+	return nil
+}
+
+// issue makes <name>.pem and <name>-key.pem in dir, signed by the CA there.
+func issue(dir, name, trustDomain, namespace string, validFor time.Duration) error {
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newTemplate(validFor)
+	if err != nil {
+		return err
+	}
+	template.Subject = pkix.Name{Organization: []string{"bookinfo"}, CommonName: name}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	template.DNSNames = []string{
+		name,
+		name + "." + namespace,
+		name + "." + namespace + ".svc",
+		name + "." + namespace + ".svc.cluster.local",
+		"localhost",
+	}
+	template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	template.URIs = []*url.URL{spiffeID(trustDomain, namespace, name)}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	// The key goes first: a service reloading in between finds that it does
+	// not match the old certificate, and keeps the old pair until the next
+	// check.
+	if err := writeKey(filepath.Join(dir, name+"-key.pem"), key); err != nil {
+		return err
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s for %s\n", certFile, template.URIs[0])
+	return nil
+}
+
+// spiffeID is the identity Istio gives the workloads of a bookinfo service.
+func spiffeID(trustDomain, namespace, name string) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/ns/" + namespace + "/sa/bookinfo-" + name}
+}
+
+func newTemplate(validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v, run certs ca first", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("the CA files are not PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+// writePEM replaces a file by way of a temporary one, so that readers never
+// see it half written.
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".certs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := pem.Encode(tmp, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
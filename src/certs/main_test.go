@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	dir := t.TempDir()
+	if err := issue(dir, "reviews", "bookinfo.local", "default", time.Hour); err == nil {
+		t.Error("issued a certificate without a CA")
+	}
+	if err := makeCA(dir, "bookinfo.local", 10*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeCA(dir, "bookinfo.local", 10*time.Hour, false); err == nil {
+		t.Error("replaced the CA without -force")
+	}
+	if err := issue(dir, "reviews", "bookinfo.local", "bookinfo", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "reviews.pem"), filepath.Join(dir, "reviews-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	for _, name := range []string{"reviews", "reviews.bookinfo.svc.cluster.local", "localhost", "127.0.0.1"} {
+		for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+			if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+				t.Errorf("verify for %s: %v", name, err)
+			}
+		}
+	}
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "spiffe://bookinfo.local/ns/bookinfo/sa/bookinfo-reviews" {
+		t.Errorf("SPIFFE ID %v", cert.URIs)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "reviews-key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v, %v", info.Mode(), err)
+	}
+}
@@ -0,0 +1,578 @@
+// Package audit keeps a tamper evident log of what the users of a service
+// did.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+	"go-bookinfo.local/common/mtls"
+)
+
+// Sign ins and outs, writes and admin changes are recorded in an audit log
+// in AUDIT_LOG_DIR: audit.log, one JSON entry per line. Every entry holds
+// the hash of the one before it, so changing, adding or removing an entry
+// breaks the chain from there on, which Verify finds. Once audit.log would
+// grow past AUDIT_LOG_MAX_SIZE bytes (default 10 MiB) it is renamed to
+// audit-<time>.log and a new file carries the chain on; AUDIT_LOG_KEEP
+// limits how many of those are kept (default 0, all of them).
+//
+// Every service keeps a log of its own, and the entries name the service
+// and carry the x-request-id, so that the entries of one request can be
+// put together across services. Without AUDIT_LOG_DIR the entries only go
+// to the service log.
+//
+// A write cut short by a crash leaves a torn line at the end of audit.log.
+// Opening the log then carries on in a new file, leaving the torn line
+// where it is for Verify to report.
+
+// Entry is one recorded action. Actions are named like "review.create";
+// Target names what was acted on, like "review/3". Source is the address
+// the request came from; ForwardedFor holds the X-Forwarded-For header,
+// which the client may have made up.
+type Entry struct {
+	Seq          uint64            `json:"seq"`
+	Time         time.Time         `json:"time"`
+	Service      string            `json:"service"`
+	Actor        string            `json:"actor"`
+	Action       string            `json:"action"`
+	Target       string            `json:"target,omitempty"`
+	Outcome      string            `json:"outcome"`
+	Source       string            `json:"source,omitempty"`
+	ForwardedFor string            `json:"unverifiedForwardedFor,omitempty"`
+	RequestId    string            `json:"requestId,omitempty"`
+	Details      map[string]string `json:"details,omitempty"`
+	Prev         string            `json:"prev"`
+	Hash         string            `json:"hash"`
+}
+
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+const (
+	currentFile    = "audit.log"
+	rotatedPattern = "audit-*.log"
+	timeFormat     = "20060102T150405.000000000Z"
+)
+
+type Log struct {
+	dir     string
+	service string
+	maxSize int64
+	keep    int
+	now     func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	seq  uint64
+	last string
+}
+
+// NewFromEnv opens the audit log in AUDIT_LOG_DIR for a service. It returns
+// nil when the variable is not set, and exits when the log cannot be
+// opened, as running without the audit log it was asked for would go
+// unnoticed.
+func NewFromEnv(service string) *Log {
+	dir, ok := os.LookupEnv("AUDIT_LOG_DIR")
+	if !ok || dir == "" {
+		return nil
+	}
+	maxSize := int64(10 << 20)
+	if value, ok := os.LookupEnv("AUDIT_LOG_MAX_SIZE"); ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			log.Fatalf("audit: invalid AUDIT_LOG_MAX_SIZE %q", value)
+		}
+		maxSize = size
+	}
+	keep := 0
+	if value, ok := os.LookupEnv("AUDIT_LOG_KEEP"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Fatalf("audit: invalid AUDIT_LOG_KEEP %q", value)
+		}
+		keep = n
+	}
+	a, err := Open(dir, service, maxSize, keep)
+	if err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+	log.Printf("audit: logging to %s from entry %d", dir, a.seq+1)
+	return a
+}
+
+// Open opens the audit log in dir, carrying on the chain of the entries
+// already there.
+func Open(dir, service string, maxSize int64, keep int) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	a := &Log{dir: dir, service: service, maxSize: maxSize, keep: keep, now: time.Now}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastEntry(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq, a.last = last.Seq, last.Hash
+			break
+		}
+	}
+	// Appending to a file that does not end in a newline would glue the
+	// next entry to what is there.
+	if torn, err := endsTorn(filepath.Join(a.dir, currentFile)); err != nil {
+		return nil, err
+	} else if torn {
+		log.Printf("audit: %s ends in a torn line, starting a new file", currentFile)
+		if err := a.rename(); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// endsTorn tells whether a file ends in a line without a newline.
+func endsTorn(path string) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+func (a *Log) open() error {
+	f, err := os.OpenFile(filepath.Join(a.dir, currentFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// files lists the log files, oldest first.
+func (a *Log) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.dir, rotatedPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	current := filepath.Join(a.dir, currentFile)
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	}
+	return files, nil
+}
+
+// logFile is a log file opened for reading, up to the size it had then.
+type logFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// snapshot opens the log files, so that they can be read without holding
+// the lock while entries are added and files rotated, along with the
+// sequence number and hash of the last entry written. The caller closes
+// the files.
+func (a *Log) snapshot() ([]logFile, uint64, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	paths, err := a.files()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var files []logFile
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			closeAll(files)
+			return nil, 0, "", err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeAll(files)
+			return nil, 0, "", err
+		}
+		files = append(files, logFile{name: filepath.Base(path), file: f, size: info.Size()})
+	}
+	return files, a.seq, a.last, nil
+}
+
+func closeAll(files []logFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+func lastEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last *Entry
+	_, err = scanFile(filepath.Base(path), f, func(line int, entry *Entry) error {
+		last = entry
+		return nil
+	})
+	return last, err
+}
+
+// scanFile calls fn for the entries of a file. A last line that has no
+// newline and is not an entry was torn by a crash while being written; its
+// number is returned rather than an error.
+func scanFile(name string, r io.Reader, fn func(line int, entry *Entry) error) (int, error) {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		eof := err == io.EOF
+		if data = bytes.TrimSuffix(data, []byte("\n")); len(data) > 0 {
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				if eof {
+					return line, nil
+				}
+				return 0, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			if err := fn(line, &entry); err != nil {
+				return 0, err
+			}
+		}
+		if eof {
+			return 0, nil
+		}
+	}
+}
+
+// hash is the SHA-256 of an entry without its hash, which includes the
+// hash of the entry before.
+func hash(entry Entry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Record appends an entry about a request, filling in the time, the
+// service, the address the request came from and the request id. The
+// addresses named in X-Forwarded-For are kept apart, as the client may have
+// made them up. An empty actor is the
+// verified identity of the request: the subject of its token, else the
+// SPIFFE ID of the calling service, else anonymous. The end-user header,
+// which anyone can set, is only kept in the details when it names someone
+// else. An empty outcome is recorded as success. Failing to write is
+// logged rather than returned, as what it records has happened anyway.
+func (a *Log) Record(c *gin.Context, entry Entry) {
+	if entry.Actor == "" && c != nil {
+		if claims := auth.ClaimsOf(c); claims != nil {
+			entry.Actor = claims.Subject
+		} else {
+			entry.Actor = mtls.PeerPrincipal(c)
+		}
+	}
+	if entry.Actor == "" {
+		entry.Actor = "anonymous"
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = Success
+	}
+	if c != nil {
+		entry.Source = c.RemoteIP()
+		entry.ForwardedFor = c.GetHeader("X-Forwarded-For")
+		entry.RequestId = c.GetHeader("x-request-id")
+		if endUser := c.GetHeader("end-user"); endUser != "" && endUser != entry.Actor {
+			details := map[string]string{"unverifiedEndUser": endUser}
+			for key, value := range entry.Details {
+				details[key] = value
+			}
+			entry.Details = details
+		}
+	}
+	if a == nil {
+		log.Printf("audit: %s %s %s %s", entry.Actor, entry.Action, entry.Target, entry.Outcome)
+		return
+	}
+	if err := a.append(entry); err != nil {
+		log.Printf("audit: %s %s %s %s not recorded: %v", entry.Actor, entry.Action, entry.Target, entry.Outcome, err)
+	}
+}
+
+func (a *Log) append(entry Entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.Seq = a.seq + 1
+	entry.Time = a.now().UTC()
+	entry.Service = a.service
+	entry.Prev = a.last
+	entry.Hash = hash(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := a.file.Write(line); err != nil {
+		// Take back what part of the line made it, so the next entry
+		// starts on a line of its own.
+		a.file.Truncate(a.size)
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.seq, a.last, a.size = entry.Seq, entry.Hash, a.size+int64(len(line))
+	return nil
+}
+
+// rotate renames the current file after the time and starts a new one,
+// dropping the oldest files beyond keep. The caller holds the lock.
+func (a *Log) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if err := a.rename(); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if a.keep > 0 {
+		files, err := filepath.Glob(filepath.Join(a.dir, rotatedPattern))
+		if err != nil {
+			return err
+		}
+		sort.Strings(files)
+		for len(files) > a.keep {
+			if err := os.Remove(files[0]); err != nil {
+				return err
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// rename renames the current file after the time.
+func (a *Log) rename() error {
+	rotated := filepath.Join(a.dir, "audit-"+a.now().UTC().Format(timeFormat)+".log")
+	return os.Rename(filepath.Join(a.dir, currentFile), rotated)
+}
+
+// Filter selects entries. Zero fields select everything; Action also
+// matches the actions below it, so "review" matches "review.create".
+type Filter struct {
+	Since   time.Time
+	Until   time.Time
+	Actor   string
+	Action  string
+	Outcome string
+	// Limit is the number of entries to return, the latest matching ones.
+	Limit int
+}
+
+func (f *Filter) matches(entry *Entry) bool {
+	return (f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until)) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Action == "" || entry.Action == f.Action || strings.HasPrefix(entry.Action, f.Action+".")) &&
+		(f.Outcome == "" || entry.Outcome == f.Outcome)
+}
+
+// Query returns the latest entries matching a filter, oldest first.
+func (a *Log) Query(filter Filter) ([]Entry, error) {
+	files, _, _, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(files)
+	entries := []Entry{}
+	for _, f := range files {
+		// Rotated files are named after the time they were rotated, and
+		// hold nothing later.
+		if rotated, err := time.Parse(timeFormat, strings.TrimSuffix(strings.TrimPrefix(f.name, "audit-"), ".log")); err == nil && rotated.Before(filter.Since) {
+			continue
+		}
+		_, err := scanFile(f.name, io.LimitReader(f.file, f.size), func(line int, entry *Entry) error {
+			if filter.matches(entry) {
+				entries = append(entries, *entry)
+				if filter.Limit > 0 && len(entries) > filter.Limit {
+					entries = entries[1:]
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Verification is the outcome of checking the chain of the log. The first
+// entry kept is taken on trust, as the ones before it may have been
+// rotated away. Torn lists the torn lines found at the ends of files; they
+// hold no entry and do not break the chain.
+type Verification struct {
+	Verified bool     `json:"verified"`
+	Entries  int      `json:"entries"`
+	FirstSeq uint64   `json:"firstSeq,omitempty"`
+	LastSeq  uint64   `json:"lastSeq,omitempty"`
+	Torn     []string `json:"torn,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Verify checks that every entry hashes to its hash and follows the one
+// before it, and that the log ends with the last entry written.
+func (a *Log) Verify() Verification {
+	var v Verification
+	files, seq, last, err := a.snapshot()
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	defer closeAll(files)
+	var prev *Entry
+	for _, f := range files {
+		torn, err := scanFile(f.name, io.LimitReader(f.file, f.size), func(line int, entry *Entry) error {
+			where := fmt.Sprintf("%s:%d", f.name, line)
+			if hash(*entry) != entry.Hash {
+				return fmt.Errorf("%s: entry %d does not match its hash", where, entry.Seq)
+			}
+			if prev == nil {
+				v.FirstSeq = entry.Seq
+			} else if entry.Seq != prev.Seq+1 || entry.Prev != prev.Hash {
+				return fmt.Errorf("%s: entry %d does not follow entry %d", where, entry.Seq, prev.Seq)
+			}
+			prev = entry
+			v.Entries++
+			return nil
+		})
+		if err != nil {
+			v.Error = err.Error()
+			return v
+		}
+		if torn > 0 {
+			v.Torn = append(v.Torn, fmt.Sprintf("%s:%d", f.name, torn))
+		}
+	}
+	ends := ""
+	if prev != nil {
+		ends, v.LastSeq = prev.Hash, prev.Seq
+	}
+	if ends != last {
+		v.Error = fmt.Sprintf("the log ends before entry %d, the last one written", seq)
+		return v
+	}
+	v.Verified = true
+	return v
+}
+
+// RegisterRoutes exposes the audit log under path for admins: path itself
+// lists entries, filtered by the since and until times (RFC 3339), actor,
+// action, outcome and limit (default 100) parameters, and path/verify
+// checks the chain.
+func (a *Log) RegisterRoutes(r *gin.Engine, path string, admin gin.HandlerFunc) {
+	r.GET(path, admin, func(c *gin.Context) {
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the audit log is not enabled"})
+			return
+		}
+		filter := Filter{
+			Actor:   c.Query("actor"),
+			Action:  c.Query("action"),
+			Outcome: c.Query("outcome"),
+			Limit:   100,
+		}
+		var err error
+		for _, param := range []struct {
+			name string
+			t    *time.Time
+		}{{"since", &filter.Since}, {"until", &filter.Until}} {
+			if value := c.Query(param.name); value != "" {
+				if *param.t, err = time.Parse(time.RFC3339, value); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": param.name + " must be an RFC 3339 time"})
+					return
+				}
+			}
+		}
+		if value := c.Query("limit"); value != "" {
+			if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > 1000 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+				return
+			}
+		}
+		entries, err := a.Query(filter)
+		if err != nil {
+			log.Printf("audit: query: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not read the audit log"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"entries": entries})
+	})
+	r.GET(path+"/verify", admin, func(c *gin.Context) {
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the audit log is not enabled"})
+			return
+		}
+		v := a.Verify()
+		if !v.Verified {
+			log.Printf("audit: verify: %s", v.Error)
+			c.JSON(http.StatusConflict, v)
+			return
+		}
+		c.JSON(http.StatusOK, v)
+	})
+}
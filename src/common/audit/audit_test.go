@@ -0,0 +1,245 @@
+package audit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, "reviews", 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+	for i, action := range []string{"review.create", "review.edit", "review.vote", "review.create", "admin.denied", "review.delete"} {
+		entry := Entry{Actor: "alice", Action: action, Target: "review/1"}
+		if i%2 == 1 {
+			entry.Actor = "bob"
+		}
+		if action == "admin.denied" {
+			entry.Outcome = Failure
+		}
+		a.Record(nil, entry)
+		now = now.Add(time.Minute)
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, rotatedPattern))
+	if len(rotated) == 0 || len(rotated) > 2 {
+		t.Errorf("rotated files: %v", rotated)
+	}
+	if v := a.Verify(); !v.Verified || v.LastSeq != 6 {
+		t.Errorf("verify: %+v", v)
+	}
+
+	// The chain carries on after a restart. Two entries fit in a file, so
+	// the first two are dropped when the third file is rotated.
+	a.file.Close()
+	if a, err = Open(dir, "reviews", 600, 2); err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+	a.Record(nil, Entry{Action: "review.create"})
+	if v := a.Verify(); !v.Verified || v.FirstSeq != 3 || v.LastSeq != 7 {
+		t.Errorf("verify after reopening: %+v", v)
+	}
+
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		filter Filter
+		seqs   []uint64
+	}{
+		{"actor", Filter{Actor: "bob"}, []uint64{4, 6}},
+		{"action", Filter{Action: "review.create"}, []uint64{4, 7}},
+		{"action prefix", Filter{Action: "review", Limit: 2}, []uint64{6, 7}},
+		{"outcome", Filter{Outcome: Failure}, []uint64{5}},
+		{"anonymous", Filter{Actor: "anonymous"}, []uint64{7}},
+		{"time", Filter{Since: start.Add(4 * time.Minute), Until: start.Add(6 * time.Minute)}, []uint64{5, 6}},
+	}
+	for _, tt := range tests {
+		entries, err := a.Query(tt.filter)
+		var seqs []uint64
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		if err != nil || len(seqs) != len(tt.seqs) || len(seqs) > 0 && (seqs[0] != tt.seqs[0] || seqs[len(seqs)-1] != tt.seqs[len(tt.seqs)-1]) {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, seqs, err, tt.seqs)
+		}
+	}
+}
+
+func TestAuditLogVerifyFindsTampering(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, "reviews", 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, actor := range []string{"alice", "bob", "carol"} {
+		a.Record(nil, Entry{Actor: actor, Action: "review.create"})
+	}
+	path := filepath.Join(dir, currentFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"changed", strings.Replace(string(data), `"actor":"bob"`, `"actor":"eve"`, 1)},
+		{"removed", lines[0] + lines[2]},
+		{"truncated", lines[0] + lines[1]},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if v := a.Verify(); v.Verified || v.Error == "" {
+			t.Errorf("%s: %+v", tt.name, v)
+		}
+	}
+}
+
+func TestAuditLogTornLine(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, "reviews", 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+	a.Record(nil, Entry{Actor: "alice", Action: "review.create"})
+	a.Record(nil, Entry{Actor: "bob", Action: "review.create"})
+	a.file.Close()
+
+	// A crash cuts the second entry short.
+	path := filepath.Join(dir, currentFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-20], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening carries on the chain from the last whole entry, in a new
+	// file, and Verify points at the torn line.
+	if a, err = Open(dir, "reviews", 1<<20, 0); err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now.Add(time.Minute) }
+	a.Record(nil, Entry{Actor: "carol", Action: "review.create"})
+	rotated, _ := filepath.Glob(filepath.Join(dir, rotatedPattern))
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files: %v", rotated)
+	}
+	v := a.Verify()
+	if v.Error != "" || v.Entries != 2 || v.LastSeq != 2 || len(v.Torn) != 1 || v.Torn[0] != filepath.Base(rotated[0])+":2" {
+		t.Errorf("verify: %+v", v)
+	}
+	entries, err := a.Query(Filter{})
+	if err != nil || len(entries) != 2 || entries[1].Actor != "carol" {
+		t.Errorf("query: %+v, %v", entries, err)
+	}
+}
+
+func TestAuditLogRecordsVerifiedRequest(t *testing.T) {
+	a, err := Open(t.TempDir(), "ratings", 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &x509.Certificate{URIs: []*url.URL{{Scheme: "spiffe", Host: "bookinfo.local", Path: "/ns/default/sa/bookinfo-reviews"}}}
+	tests := []struct {
+		name     string
+		claims   *auth.Claims
+		peer     bool
+		actor    string
+		endUser  string
+		declared string
+	}{
+		{"token", &auth.Claims{Subject: "alice"}, true, "alice", "alice", ""},
+		{"token and other header", &auth.Claims{Subject: "alice"}, false, "alice", "mallory", "mallory"},
+		{"peer", nil, true, "bookinfo.local/ns/default/sa/bookinfo-reviews", "alice", "alice"},
+		{"nothing verified", nil, false, "anonymous", "mallory", "mallory"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/ratings/1", nil)
+		c.Request.RemoteAddr = "192.0.2.7:41000"
+		c.Request.Header.Set("X-Forwarded-For", "203.0.113.9")
+		c.Request.Header.Set("end-user", tt.endUser)
+		if tt.claims != nil {
+			c.Set("jwtClaims", tt.claims)
+		}
+		if tt.peer {
+			c.Request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{peer}}}
+		}
+		a.Record(c, Entry{Action: "rating.write", Details: map[string]string{"reviewer1": "5"}})
+		entries, err := a.Query(Filter{Limit: 1})
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s: %v, %v", tt.name, entries, err)
+		}
+		entry := entries[0]
+		if entry.Actor != tt.actor || entry.Details["unverifiedEndUser"] != tt.declared || entry.Details["reviewer1"] != "5" {
+			t.Errorf("%s: got %+v", tt.name, entry)
+		}
+		if entry.Source != "192.0.2.7" || entry.ForwardedFor != "203.0.113.9" {
+			t.Errorf("%s: source %q, forwarded for %q", tt.name, entry.Source, entry.ForwardedFor)
+		}
+	}
+}
+
+func TestAuditRoutes(t *testing.T) {
+	a, err := Open(t.TempDir(), "reviews", 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(nil, Entry{Actor: "alice", Action: "review.create"})
+	a.Record(nil, Entry{Actor: "bob", Action: "review.delete"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	a.RegisterRoutes(r, "/reviews/audit", func(c *gin.Context) {})
+	tests := []struct {
+		path   string
+		status int
+		count  int
+	}{
+		{"/reviews/audit", http.StatusOK, 2},
+		{"/reviews/audit?actor=bob", http.StatusOK, 1},
+		{"/reviews/audit?since=2000-01-01T00:00:00Z&limit=1", http.StatusOK, 1},
+		{"/reviews/audit?since=yesterday", http.StatusBadRequest, 0},
+		{"/reviews/audit?limit=0", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		var body struct {
+			Entries []Entry `json:"entries"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != tt.status || len(body.Entries) != tt.count {
+			t.Errorf("%s: got %d with %d entries", tt.path, w.Code, len(body.Entries))
+		}
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reviews/audit/verify", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"verified":true`) {
+		t.Errorf("verify: %d %s", w.Code, w.Body.String())
+	}
+}
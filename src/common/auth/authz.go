@@ -0,0 +1,468 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+// Authorization policies are read from a YAML file modeled after Istio's
+// AuthorizationPolicy, for example:
+//
+//	policies:
+//	- name: only-admins-rate
+//	  action: DENY
+//	  rules:
+//	  - to:
+//	    - operation:
+//	        methods: ["POST"]
+//	        paths: ["/ratings/*"]
+//	    when:
+//	    - key: request.auth.claims[roles]
+//	      notValues: ["admin"]
+//
+// A policy matches a request when one of its rules does, and a rule when
+// one of its sources, one of its operations and all of its conditions do.
+// Rules leave out what they do not care about. As in Istio, a request is
+// denied when a DENY policy matches; otherwise it is allowed when there
+// are no ALLOW policies or one of them matches. AUDIT policies only log
+// the requests they match.
+
+type PolicySet struct {
+	Policies []Policy `yaml:"policies"`
+}
+
+type Policy struct {
+	Name string `yaml:"name"`
+	// Action is ALLOW, the default, DENY or AUDIT.
+	Action string       `yaml:"action"`
+	Rules  []PolicyRule `yaml:"rules"`
+}
+
+type PolicyRule struct {
+	From []struct {
+		Source PolicySource `yaml:"source"`
+	} `yaml:"from"`
+	To []struct {
+		Operation PolicyOperation `yaml:"operation"`
+	} `yaml:"to"`
+	When []PolicyCondition `yaml:"when"`
+}
+
+// PolicySource matches who sends a request: the calling service, the
+// SPIFFE ID of its client certificate over mutual TLS, the user and the
+// issuer/subject of the JWT. Only verified identities are matched: the
+// calling service is the one the client certificate was issued to, and
+// without mutual TLS or a verified token those fields match nothing.
+type PolicySource struct {
+	Services             []string `yaml:"services"`
+	NotServices          []string `yaml:"notServices"`
+	Principals           []string `yaml:"principals"`
+	NotPrincipals        []string `yaml:"notPrincipals"`
+	Users                []string `yaml:"users"`
+	NotUsers             []string `yaml:"notUsers"`
+	RequestPrincipals    []string `yaml:"requestPrincipals"`
+	NotRequestPrincipals []string `yaml:"notRequestPrincipals"`
+}
+
+type PolicyOperation struct {
+	Methods    []string `yaml:"methods"`
+	NotMethods []string `yaml:"notMethods"`
+	Paths      []string `yaml:"paths"`
+	NotPaths   []string `yaml:"notPaths"`
+}
+
+// PolicyCondition matches one attribute of a request against a list of
+// values. The keys are source.service, source.principal,
+// request.auth.principal, request.auth.audiences, request.auth.claims[name]
+// and request.headers[name]. Headers are whatever the client sent.
+type PolicyCondition struct {
+	Key       string   `yaml:"key"`
+	Values    []string `yaml:"values"`
+	NotValues []string `yaml:"notValues"`
+}
+
+// Authorizer decides on requests by a set of policies.
+type Authorizer struct {
+	policies []Policy
+}
+
+// NewAuthorizerFromEnv loads the policies in AUTHZ_POLICY_FILE. It returns
+// nil, allowing every request, when the variable is not set, and exits when
+// the file is invalid, as running with half a policy would be worse than
+// not running.
+func NewAuthorizerFromEnv() *Authorizer {
+	path, ok := os.LookupEnv("AUTHZ_POLICY_FILE")
+	if !ok || path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("authz: %v", err)
+	}
+	a, err := NewAuthorizer(data)
+	if err != nil {
+		log.Fatalf("authz: %s: %v", path, err)
+	}
+	log.Printf("authz: loaded %d policies from %s", len(a.policies), path)
+	return a
+}
+
+// NewAuthorizer parses and checks a policy file. Unknown fields are errors,
+// so that a misspelt field does not silently widen a rule.
+func NewAuthorizer(data []byte) (*Authorizer, error) {
+	var set PolicySet
+	if err := yaml.UnmarshalStrict(data, &set); err != nil {
+		return nil, err
+	}
+	for i := range set.Policies {
+		p := &set.Policies[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("policy-%d", i)
+		}
+		switch p.Action {
+		case "":
+			p.Action = "ALLOW"
+		case "ALLOW", "DENY", "AUDIT":
+		default:
+			return nil, fmt.Errorf("policy %s: unknown action %q", p.Name, p.Action)
+		}
+		for _, rule := range p.Rules {
+			for _, to := range rule.To {
+				for _, path := range append(to.Operation.Paths, to.Operation.NotPaths...) {
+					if err := CheckPathPattern(path); err != nil {
+						return nil, fmt.Errorf("policy %s: %v", p.Name, err)
+					}
+				}
+			}
+			for _, condition := range rule.When {
+				if !knownConditionKey(condition.Key) {
+					return nil, fmt.Errorf("policy %s: unknown condition key %q", p.Name, condition.Key)
+				}
+				if condition.Values == nil && condition.NotValues == nil {
+					return nil, fmt.Errorf("policy %s: condition %s has no values", p.Name, condition.Key)
+				}
+			}
+		}
+	}
+	return &Authorizer{policies: set.Policies}, nil
+}
+
+func knownConditionKey(key string) bool {
+	switch key {
+	case "source.service", "source.principal", "request.auth.principal", "request.auth.audiences":
+		return true
+	}
+	for _, prefix := range []string{"request.auth.claims[", "request.headers["} {
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, "]") && len(key) > len(prefix)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authzRequest holds the attributes of a request that policies look at.
+type authzRequest struct {
+	method  string
+	path    string
+	service string
+	peer    string
+	user    string
+	claims  *Claims
+	header  http.Header
+}
+
+func authzRequestOf(c *gin.Context, peer string) *authzRequest {
+	r := &authzRequest{
+		method:  c.Request.Method,
+		path:    c.Request.URL.Path,
+		service: serviceOf(peer),
+		peer:    peer,
+		claims:  ClaimsOf(c),
+		header:  c.Request.Header,
+	}
+	if r.claims != nil {
+		r.user = r.claims.Subject
+	}
+	return r
+}
+
+// serviceOf names the bookinfo service a SPIFFE ID without "spiffe://"
+// belongs to: the service account without its "bookinfo-" prefix, as the
+// certs tool issues them. It is "" for other IDs.
+func serviceOf(peer string) string {
+	i := strings.Index(peer, "/sa/bookinfo-")
+	if i < 0 {
+		return ""
+	}
+	return peer[i+len("/sa/bookinfo-"):]
+}
+
+// principal is the issuer/subject of the JWT, "" without one.
+func (r *authzRequest) principal() string {
+	if r.claims == nil {
+		return ""
+	}
+	return r.claims.Issuer + "/" + r.claims.Subject
+}
+
+// authzDecision is the outcome of evaluating the policies for a request.
+type authzDecision struct {
+	Allowed bool
+	// Policy is the policy that decided, "" when no policy matched.
+	Policy string
+	// Audited lists the AUDIT policies that matched.
+	Audited []string
+}
+
+// Decide evaluates the policies for a request.
+func (a *Authorizer) Decide(r *authzRequest) authzDecision {
+	var d authzDecision
+	var allow, deny string
+	hasAllow := false
+	for _, p := range a.policies {
+		switch p.Action {
+		case "AUDIT":
+			if p.matches(r) {
+				d.Audited = append(d.Audited, p.Name)
+			}
+		case "DENY":
+			if deny == "" && p.matches(r) {
+				deny = p.Name
+			}
+		case "ALLOW":
+			hasAllow = true
+			if allow == "" && p.matches(r) {
+				allow = p.Name
+			}
+		}
+	}
+	switch {
+	case deny != "":
+		d.Policy = deny
+	case allow != "":
+		d.Allowed, d.Policy = true, allow
+	default:
+		d.Allowed = !hasAllow
+	}
+	return d
+}
+
+// Middleware rejects the requests the policies deny with 403 and logs the
+// decisions that policies took. peer returns the SPIFFE ID of the verified
+// client certificate of a request, without "spiffe://".
+func (a *Authorizer) Middleware(peer func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a == nil {
+			c.Next()
+			return
+		}
+		r := authzRequestOf(c, peer(c))
+		d := a.Decide(r)
+		if len(d.Audited) > 0 {
+			log.Printf("authz: AUDIT %s policy=%s", r, strings.Join(d.Audited, ","))
+		}
+		if !d.Allowed {
+			policy := d.Policy
+			if policy == "" {
+				policy = "(no ALLOW policy matched)"
+			}
+			log.Printf("authz: DENY %s policy=%s", r, policy)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "RBAC: access denied"})
+			return
+		}
+		if d.Policy != "" {
+			log.Printf("authz: ALLOW %s policy=%s", r, d.Policy)
+		}
+		c.Next()
+	}
+}
+
+func (r *authzRequest) String() string {
+	return fmt.Sprintf("%s %s service=%q peer=%q user=%q principal=%q", r.method, r.path, r.service, r.peer, r.user, r.principal())
+}
+
+func (p *Policy) matches(r *authzRequest) bool {
+	for _, rule := range p.Rules {
+		if rule.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *PolicyRule) matches(r *authzRequest) bool {
+	if len(rule.From) > 0 {
+		matched := false
+		for _, from := range rule.From {
+			if from.Source.matches(r) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.To) > 0 {
+		matched := false
+		for _, to := range rule.To {
+			if to.Operation.matches(r) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, condition := range rule.When {
+		if !condition.matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *PolicySource) matches(r *authzRequest) bool {
+	return MatchField(s.Services, s.NotServices, []string{r.service}, MatchValue) &&
+		MatchField(s.Principals, s.NotPrincipals, []string{r.peer}, MatchValue) &&
+		MatchField(s.Users, s.NotUsers, []string{r.user}, MatchValue) &&
+		MatchField(s.RequestPrincipals, s.NotRequestPrincipals, []string{r.principal()}, MatchValue)
+}
+
+func (o *PolicyOperation) matches(r *authzRequest) bool {
+	return MatchField(o.Methods, o.NotMethods, []string{r.method}, MatchValue) &&
+		MatchField(o.Paths, o.NotPaths, []string{r.path}, MatchPath)
+}
+
+func (condition *PolicyCondition) matches(r *authzRequest) bool {
+	return MatchField(condition.Values, condition.NotValues, r.attribute(condition.Key), MatchValue)
+}
+
+// attribute returns the values of a condition key, several for list claims
+// such as roles.
+func (r *authzRequest) attribute(key string) []string {
+	switch {
+	case key == "source.service":
+		return []string{r.service}
+	case key == "source.principal":
+		return []string{r.peer}
+	case key == "request.auth.principal":
+		return []string{r.principal()}
+	case key == "request.auth.audiences":
+		if r.claims == nil {
+			return nil
+		}
+		return r.claims.Audience
+	case strings.HasPrefix(key, "request.headers["):
+		return r.header.Values(key[len("request.headers[") : len(key)-1])
+	case strings.HasPrefix(key, "request.auth.claims["):
+		if r.claims == nil {
+			return nil
+		}
+		return claimValues(r.claims.all[key[len("request.auth.claims["):len(key)-1]])
+	}
+	return nil
+}
+
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, claimValues(item)...)
+		}
+		return values
+	}
+	return []string{fmt.Sprint(claim)}
+}
+
+// MatchField reports whether some of the values match one of the patterns,
+// when there are patterns, and none matches one of the notPatterns.
+func MatchField(patterns, notPatterns, values []string, match func(pattern, value string) bool) bool {
+	matchesSome := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			for _, value := range values {
+				if match(pattern, value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(patterns) > 0 && !matchesSome(patterns) {
+		return false
+	}
+	return !matchesSome(notPatterns)
+}
+
+// MatchValue matches exact values, prefixes ("abc*"), suffixes ("*abc")
+// and, with "*", any value that is present.
+func MatchValue(pattern, value string) bool {
+	switch {
+	case pattern == "*":
+		return value != ""
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(value, pattern[:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(value, pattern[1:])
+	}
+	return pattern == value
+}
+
+// MatchPath matches paths like MatchValue, and also templates where {*}
+// stands for one path segment and a final {**} for the rest of the path,
+// as in "/reviews/{*}/{*}/vote".
+func MatchPath(pattern, path string) bool {
+	if !strings.Contains(pattern, "{*") {
+		return MatchValue(pattern, path)
+	}
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	for i, segment := range patternSegments {
+		if segment == "{**}" {
+			return len(pathSegments) > i && strings.Join(pathSegments[i:], "") != ""
+		}
+		if i >= len(pathSegments) {
+			return false
+		}
+		if segment == "{*}" {
+			if pathSegments[i] == "" {
+				return false
+			}
+		} else if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return len(patternSegments) == len(pathSegments)
+}
+
+// CheckPathPattern rejects path templates MatchPath cannot match.
+func CheckPathPattern(pattern string) error {
+	if !strings.Contains(pattern, "{*") {
+		return nil
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.Contains(segment, "{") && segment != "{*}" && segment != "{**}" {
+			return fmt.Errorf("path %q: templates must be whole segments", pattern)
+		}
+		if segment == "{**}" && i != len(segments)-1 {
+			return fmt.Errorf("path %q: {**} must be the last segment", pattern)
+		}
+	}
+	if strings.Contains(pattern, "*") && strings.Count(pattern, "*") != strings.Count(pattern, "{*}")+2*strings.Count(pattern, "{**}") {
+		return fmt.Errorf("path %q: templates cannot be combined with * wildcards", pattern)
+	}
+	return nil
+}
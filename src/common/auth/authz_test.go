@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testPolicies = `
+policies:
+- name: only-admins-rate
+  action: DENY
+  rules:
+  - to:
+    - operation:
+        methods: ["POST"]
+        paths: ["/ratings/*"]
+    when:
+    - key: request.auth.claims[roles]
+      notValues: ["admin"]
+- name: frontend
+  rules:
+  - from:
+    - source:
+        services: ["productpage", "reviews"]
+  - from:
+    - source:
+        principals: ["bookinfo.local/ns/default/sa/bookinfo-*"]
+  - from:
+    - source:
+        requestPrincipals: ["*"]
+    to:
+    - operation:
+        paths: ["/ratings/{*}/history"]
+- name: votes
+  action: AUDIT
+  rules:
+  - to:
+    - operation:
+        paths: ["/reviews/{*}/{*}/vote"]
+        notMethods: ["GET"]
+`
+
+func TestAuthorizerDecide(t *testing.T) {
+	a, err := NewAuthorizer([]byte(testPolicies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &Claims{Issuer: "productpage", Subject: "jason", all: map[string]interface{}{"roles": []interface{}{"reader", "admin"}}}
+	reader := &Claims{Issuer: "productpage", Subject: "alice", all: map[string]interface{}{"roles": []interface{}{"reader"}}}
+	tests := []struct {
+		name    string
+		request authzRequest
+		want    authzDecision
+	}{
+		{"service", authzRequest{method: "GET", path: "/ratings/1", service: "reviews"},
+			authzDecision{Allowed: true, Policy: "frontend"}},
+		{"unknown service", authzRequest{method: "GET", path: "/ratings/1", service: "ratings"},
+			authzDecision{}},
+		{"peer", authzRequest{method: "GET", path: "/ratings/1", peer: "bookinfo.local/ns/default/sa/bookinfo-reviews"},
+			authzDecision{Allowed: true, Policy: "frontend"}},
+		{"unknown peer", authzRequest{method: "GET", path: "/ratings/1", peer: "bookinfo.local/ns/default/sa/sleep"},
+			authzDecision{}},
+		{"admin rates", authzRequest{method: "POST", path: "/ratings/1", service: "reviews", claims: admin},
+			authzDecision{Allowed: true, Policy: "frontend"}},
+		{"reader rates", authzRequest{method: "POST", path: "/ratings/1", service: "reviews", claims: reader},
+			authzDecision{Policy: "only-admins-rate"}},
+		{"anonymous rates", authzRequest{method: "POST", path: "/ratings/1", service: "reviews"},
+			authzDecision{Policy: "only-admins-rate"}},
+		{"principal", authzRequest{method: "GET", path: "/ratings/1/history", claims: reader},
+			authzDecision{Allowed: true, Policy: "frontend"}},
+		{"principal elsewhere", authzRequest{method: "GET", path: "/ratings/1", claims: reader},
+			authzDecision{}},
+		{"audited", authzRequest{method: "PUT", path: "/reviews/1/2/vote", service: "productpage"},
+			authzDecision{Allowed: true, Policy: "frontend", Audited: []string{"votes"}}},
+	}
+	for _, tt := range tests {
+		if got := a.Decide(&tt.request); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Decide = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizerDefaults(t *testing.T) {
+	r := &authzRequest{method: "GET", path: "/details/0"}
+	a, err := NewAuthorizer([]byte("policies:\n- name: audit-all\n  action: AUDIT\n  rules:\n  - {}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := a.Decide(r); !d.Allowed || len(d.Audited) != 1 {
+		t.Errorf("without ALLOW policies: %+v", d)
+	}
+	a, err = NewAuthorizer([]byte("policies:\n- name: allow-nothing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := a.Decide(r); d.Allowed {
+		t.Errorf("an ALLOW policy without rules allowed %+v", d)
+	}
+}
+
+func TestNewAuthorizerRejects(t *testing.T) {
+	for _, policies := range []string{
+		"policies:\n- action: PERMIT\n",
+		"policies:\n- rules:\n  - to:\n    - operation:\n        path: [\"/\"]\n",
+		"policies:\n- rules:\n  - when:\n    - key: request.auth.claim[roles]\n      values: [admin]\n",
+		"policies:\n- rules:\n  - when:\n    - key: source.service\n",
+		"policies:\n- rules:\n  - to:\n    - operation:\n        paths: [\"/reviews/{**}/vote\"]\n",
+		"policies:\n- rules:\n  - to:\n    - operation:\n        paths: [\"/reviews/{*}*\"]\n",
+	} {
+		if _, err := NewAuthorizer([]byte(policies)); err == nil {
+			t.Errorf("accepted %q", policies)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/reviews/0", "/reviews/0", true},
+		{"/reviews/*", "/reviews/0/summary", true},
+		{"*/summary", "/reviews/0/summary", true},
+		{"*", "/", true},
+		{"/reviews/{*}", "/reviews/0", true},
+		{"/reviews/{*}", "/reviews/0/summary", false},
+		{"/reviews/{*}", "/reviews/", false},
+		{"/reviews/{*}/{*}/vote", "/reviews/0/3/vote", true},
+		{"/reviews/{**}", "/reviews/0/3/vote", true},
+		{"/reviews/{**}", "/reviews/", false},
+		{"/reviews/{*}/summary", "/ratings/0/summary", false},
+	}
+	for _, tt := range tests {
+		if got := MatchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("MatchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServiceOf(t *testing.T) {
+	for peer, want := range map[string]string{
+		"cluster.local/ns/default/sa/bookinfo-reviews": "reviews",
+		"cluster.local/ns/default/sa/sleep":            "",
+		"":                                             "",
+	} {
+		if got := serviceOf(peer); got != want {
+			t.Errorf("serviceOf(%q) = %q, want %q", peer, got, want)
+		}
+	}
+}
+
+func TestAuthorizerMiddleware(t *testing.T) {
+	a, err := NewAuthorizer([]byte(testPolicies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(a.Middleware(func(c *gin.Context) string { return c.GetHeader("test-peer") }))
+	r.GET("/ratings/:productId", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"verified peer", "test-peer", "cluster.local/ns/default/sa/bookinfo-productpage", http.StatusOK},
+		{"declared service", "x-source-service", "productpage", http.StatusForbidden},
+		{"anonymous", "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ratings/0", nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	var nilAuthorizer *Authorizer
+	r = gin.New()
+	r.Use(nilAuthorizer.Middleware(nil))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("without policies: got %d", w.Code)
+	}
+}
@@ -0,0 +1,392 @@
+// Package auth verifies the JWTs productpage issues for signed in users and
+// authorizes requests by policies modeled after Istio's.
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Claims are the claims of a verified JWT, as issued by productpage.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	Roles     []string `json:"roles"`
+
+	// all holds every claim, for authorization policies on other claims.
+	all map[string]interface{}
+}
+
+// audience is the aud claim, which may be a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// JWK is a public key of a JSON Web Key Set, RSA or EC P-256.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+const (
+	// jwksMaxAge is how long fetched keys are used before fetching again.
+	jwksMaxAge = 5 * time.Minute
+	// jwksMinRefresh limits how often a token with an unknown key id can
+	// make the verifier fetch the keys.
+	jwksMinRefresh = 10 * time.Second
+	// jwtLeeway allows for clock skew when checking exp, nbf and iat.
+	jwtLeeway = time.Minute
+)
+
+// JWTVerifier checks tokens against the keys published at a JWKS URL, in
+// the spirit of an Istio RequestAuthentication: requests without a token
+// pass, requests with an invalid one are rejected. Whether a request needs
+// a token at all is left to the handlers.
+type JWTVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+	now      func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+// Keys under which Middleware stores what it verified in the gin context.
+const (
+	claimsKey   = "jwtClaims"
+	verifierKey = "jwtVerifier"
+)
+
+// NewJWTVerifierFromEnv configures a verifier from JWT_JWKS_URL, and
+// optionally JWT_ISSUER and JWT_AUDIENCE which tokens must then match. It
+// returns nil, verifying nothing, when JWT_JWKS_URL is not set. The keys
+// are fetched through transport.
+func NewJWTVerifierFromEnv(transport http.RoundTripper) *JWTVerifier {
+	jwksURL, ok := os.LookupEnv("JWT_JWKS_URL")
+	if !ok || jwksURL == "" {
+		return nil
+	}
+	return NewJWTVerifier(jwksURL, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"), transport)
+}
+
+func NewJWTVerifier(jwksURL, issuer, audience string, transport http.RoundTripper) *JWTVerifier {
+	return &JWTVerifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: 5 * time.Second, Transport: transport},
+		now:      time.Now,
+	}
+}
+
+// Middleware verifies the bearer token of every request and makes its
+// claims available through ClaimsOf. Bearer values that are not shaped
+// like a JWT, such as the admin token, are left alone. A token whose subject
+// is not the user named by the end-user header is rejected.
+func (v *JWTVerifier) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v == nil {
+			c.Next()
+			return
+		}
+		c.Set(verifierKey, true)
+		token, ok := bearerJWT(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		claims, err := v.Verify(token)
+		if err != nil {
+			log.Printf("jwt: rejected token: %v", err)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if user := c.GetHeader("end-user"); user != "" && user != claims.Subject {
+			log.Printf("jwt: end-user %q does not match token subject %q", user, claims.Subject)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "end-user does not match the token"})
+			return
+		}
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// ClaimsOf returns the claims of the verified token of a request, or nil.
+func ClaimsOf(c *gin.Context) *Claims {
+	claims, _ := c.Get(claimsKey)
+	verified, _ := claims.(*Claims)
+	return verified
+}
+
+// RequestUser returns the user a request acts for: the subject of its
+// verified token. Only when no verifier is configured does it fall back to
+// the end-user header, which anyone can set; with a verifier, a request
+// without a token has no user.
+func RequestUser(c *gin.Context) string {
+	if claims := ClaimsOf(c); claims != nil {
+		return claims.Subject
+	}
+	if Verified(c) {
+		return ""
+	}
+	return c.GetHeader("end-user")
+}
+
+// Verified reports whether the tokens of a request are verified, that is
+// whether a verifier is configured.
+func Verified(c *gin.Context) bool {
+	return c.GetBool(verifierKey)
+}
+
+// HasRole reports whether the token grants a role. It is false for nil
+// claims, so that it can be called on ClaimsOf directly.
+func (claims *Claims) HasRole(role string) bool {
+	if claims == nil {
+		return false
+	}
+	for _, r := range claims.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerJWT(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature and the time, issuer and audience claims of
+// a compact JWT and returns its claims.
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+	payload, err := VerifySignature(token, v.key)
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	if err := json.Unmarshal(payload, &claims.all); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	now := v.now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if claims.IssuedAt != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, errors.New("token issued in the future")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.audience != "" && !claims.Audience.contains(v.audience) {
+		return nil, errors.New("token is not meant for this service")
+	}
+	return &claims, nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifySignature checks the signature of a compact JWT with the key that
+// keyFor returns for the key id of its header, and returns its decoded
+// claims. Checking the claims is left to the caller.
+func VerifySignature(token string, keyFor func(kid string) (crypto.PublicKey, error)) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(data, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	key, err := keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	return payload, nil
+}
+
+// verifySignature checks an RS256 or ES256 signature. The algorithm has to
+// match the type of the key, so a token cannot pick a weaker check.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %q does not match an RSA key", alg)
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			return fmt.Errorf("algorithm %q does not match an EC key", alg)
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key")
+	}
+	return nil
+}
+
+// key returns the key with the given id, fetching the key set when it is
+// unknown or the cached set has expired. Failed fetches are retried at most
+// every jwksMinRefresh, meanwhile the keys known so far stay in use.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	key, ok := v.keys[kid]
+	if (!ok || now.Sub(v.fetched) > jwksMaxAge) && now.Sub(v.attempted) >= jwksMinRefresh {
+		v.attempted = now
+		keys, err := v.fetch()
+		if err != nil {
+			log.Printf("jwt: %v", err)
+		} else {
+			v.keys, v.fetched = keys, now
+			key, ok = keys[kid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (v *JWTVerifier) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch keys: %s returned status %d", v.jwksURL, resp.StatusCode)
+	}
+	var set JWKS
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("fetch keys: %v", err)
+	}
+	return ParseJWKS(set)
+}
+
+// ParseJWKS decodes the RSA and EC P-256 keys of a key set by key id,
+// skipping keys of other types.
+func ParseJWKS(set JWKS) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) > 4 {
+				return nil, fmt.Errorf("key %q: invalid exponent", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %q: invalid coordinates", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("key %q: point is not on the curve", k.Kid)
+			}
+			keys[k.Kid] = pub
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signTestJWT signs claims the way productpage does.
+func signTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "ES256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		alg = "RS256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestJWKS(t *testing.T) (*ecdsa.PrivateKey, *rsa.PrivateKey, *httptest.Server) {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	set := JWKS{Keys: []JWK{
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X), Y: b64(ecKey.Y)},
+		{Kty: "RSA", Kid: "rsa", N: b64(rsaKey.N), E: b64(big.NewInt(int64(rsaKey.E)))},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(server.Close)
+	return ecKey, rsaKey, server
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ecKey, rsaKey, server := newTestJWKS(t)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := NewJWTVerifier(server.URL, "productpage", "bookinfo", nil)
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "productpage", "sub": "jason", "aud": "bookinfo",
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "roles": []string{"reader"},
+		}
+		for k, value := range changes {
+			c[k] = value
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", signTestJWT(t, ecKey, "ec", claims(nil)), true},
+		{"RS256", signTestJWT(t, rsaKey, "rsa", claims(nil)), true},
+		{"audience list", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"aud": []string{"other", "bookinfo"}})), true},
+		{"expired", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"no expiry", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"exp": 0})), false},
+		{"not yet valid", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"wrong issuer", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"iss": "elsewhere"})), false},
+		{"wrong audience", signTestJWT(t, ecKey, "ec", claims(map[string]interface{}{"aud": "other"})), false},
+		{"unknown key", signTestJWT(t, ecKey, "nope", claims(nil)), false},
+		{"wrong key", signTestJWT(t, otherKey, "ec", claims(nil)), false},
+		{"key type mismatch", signTestJWT(t, ecKey, "rsa", claims(nil)), false},
+		{"garbage", "a.b.c", false},
+	}
+	for _, tt := range tests {
+		got, err := v.Verify(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Verify error = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got.Subject != "jason" || !got.HasRole("reader") || got.HasRole("admin")) {
+			t.Errorf("%s: claims = %+v", tt.name, got)
+		}
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	ecKey, _, server := newTestJWKS(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(NewJWTVerifier(server.URL, "", "", nil).Middleware())
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, RequestUser(c))
+	})
+
+	valid := signTestJWT(t, ecKey, "ec", map[string]interface{}{"sub": "jason", "exp": time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		authorization string
+		endUser       string
+		status        int
+		body          string
+	}{
+		{"", "", http.StatusOK, ""},
+		{"", "eve", http.StatusOK, ""},
+		{"Bearer admin-token", "eve", http.StatusOK, ""},
+		{"Bearer " + valid, "", http.StatusOK, "jason"},
+		{"Bearer " + valid, "jason", http.StatusOK, "jason"},
+		{"Bearer " + valid, "eve", http.StatusForbidden, ""},
+		{"Bearer " + valid + "x", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.endUser != "" {
+			req.Header.Set("end-user", tt.endUser)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || (tt.status == http.StatusOK && w.Body.String() != tt.body) {
+			t.Errorf("Authorization %.20q, end-user %q: got %d %q, want %d %q", tt.authorization, tt.endUser, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+
+	if (*Claims)(nil).HasRole("admin") {
+		t.Error("nil claims have a role")
+	}
+
+	// Without a verifier the end-user header is all there is.
+	var nilVerifier *JWTVerifier
+	r = gin.New()
+	r.Use(nilVerifier.Middleware())
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, RequestUser(c)) })
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer a.b.c")
+	req.Header.Set("end-user", "eve")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "eve" {
+		t.Errorf("without a verifier: got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,290 @@
+// Package markdown renders the Markdown used in reviews and product
+// descriptions and sanitizes the HTML it produces.
+package markdown
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Render turns a small, safe subset of Markdown into HTML: paragraphs,
+// headings, block quotes, lists, fenced code, horizontal rules, emphasis,
+// strike-through, code spans and links. Inline HTML is allowed the way
+// Markdown allows it, the result is always passed through SanitizeHTML.
+func Render(src string) string {
+	// NUL marks the placeholders of renderInline, so it may not come from the
+	// source. CommonMark replaces it the same way.
+	src = strings.ReplaceAll(src, "\x00", "\uFFFD")
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	renderBlocks(&b, lines)
+	return SanitizeHTML(b.String())
+}
+
+var (
+	headingPattern      = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	rulePattern         = regexp.MustCompile(`^(?:-{3,}|\*{3,}|_{3,})\s*$`)
+	bulletPattern       = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	orderedPattern      = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+	quotePattern        = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	fencePattern        = regexp.MustCompile("^\\s{0,3}(```|~~~)")
+	markdownLinkPattern = regexp.MustCompile(`\[([^\]]+)\]\(\s*([^)\s]+)(?:\s+"([^"]*)")?\s*\)`)
+	codeSpanPattern     = regexp.MustCompile("`([^`]+)`")
+	strongPattern       = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|(^|\W)__(\S(?:.*?\S)?)__(\W|$)`)
+	emphasisPattern     = regexp.MustCompile(`\*(\S(?:[^*]*?\S)?)\*|(^|\W)_(\S(?:[^_]*?\S)?)_(\W|$)`)
+	strikePattern       = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+	placeholderPattern  = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			b.WriteString("<p>")
+			for i, line := range paragraph {
+				if i > 0 {
+					// Two trailing spaces are a hard line break.
+					if strings.HasSuffix(paragraph[i-1], "  ") {
+						b.WriteString("<br>")
+					}
+					b.WriteString("\n")
+				}
+				b.WriteString(renderInline(strings.TrimSpace(line)))
+			}
+			b.WriteString("</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case fencePattern.MatchString(line):
+			flush()
+			fence := fencePattern.FindStringSubmatch(line)[1]
+			b.WriteString("<pre><code>")
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				b.WriteString(html.EscapeString(lines[i]))
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+		case headingPattern.MatchString(line):
+			flush()
+			m := headingPattern.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+		case rulePattern.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+		case quotePattern.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && quotePattern.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quotePattern.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+		case bulletPattern.MatchString(line), orderedPattern.MatchString(line):
+			flush()
+			item, tag := bulletPattern, "ul"
+			if !bulletPattern.MatchString(line) {
+				item, tag = orderedPattern, "ol"
+			}
+			fmt.Fprintf(b, "<%s>\n", tag)
+			for ; i < len(lines) && item.MatchString(lines[i]); i++ {
+				text := item.FindStringSubmatch(lines[i])[1]
+				// Indented lines continue the item.
+				for i+1 < len(lines) && strings.HasPrefix(lines[i+1], "  ") && strings.TrimSpace(lines[i+1]) != "" &&
+					!item.MatchString(lines[i+1]) {
+					i++
+					text += " " + strings.TrimSpace(lines[i])
+				}
+				fmt.Fprintf(b, "<li>%s</li>\n", renderInline(text))
+			}
+			i--
+			fmt.Fprintf(b, "</%s>\n", tag)
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+}
+
+// renderInline formats the spans of a single block. Code spans and links are
+// rendered first and swapped for placeholders so that emphasis markers inside
+// them are left alone.
+func renderInline(text string) string {
+	var held []string
+	hold := func(s string) string {
+		held = append(held, s)
+		return fmt.Sprintf("\x00%d\x00", len(held)-1)
+	}
+
+	text = codeSpanPattern.ReplaceAllStringFunc(text, func(m string) string {
+		return hold("<code>" + html.EscapeString(codeSpanPattern.FindStringSubmatch(m)[1]) + "</code>")
+	})
+	text = markdownLinkPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := markdownLinkPattern.FindStringSubmatch(m)
+		link := `<a href="` + html.EscapeString(parts[2]) + `"`
+		if parts[3] != "" {
+			link += ` title="` + html.EscapeString(parts[3]) + `"`
+		}
+		return hold(link + ">" + renderEmphasis(parts[1]) + "</a>")
+	})
+	text = renderEmphasis(text)
+
+	// A held span only holds spans held before it, so expanding it with
+	// the earlier ones alone always ends.
+	var expand func(text string, limit int) string
+	expand = func(text string, limit int) string {
+		return placeholderPattern.ReplaceAllStringFunc(text, func(m string) string {
+			n, err := strconv.Atoi(placeholderPattern.FindStringSubmatch(m)[1])
+			if err != nil || n >= limit {
+				return m
+			}
+			return expand(held[n], n)
+		})
+	}
+	return expand(text, len(held))
+}
+
+func renderEmphasis(text string) string {
+	text = replaceSpan(text, strongPattern, "strong")
+	text = replaceSpan(text, emphasisPattern, "em")
+	return replaceSpan(text, strikePattern, "del")
+}
+
+// replaceSpan wraps the matches of pattern in tag. The underscore forms of
+// emphasis capture the characters around them, so they only match at word
+// boundaries and never inside snake_case words.
+func replaceSpan(text string, pattern *regexp.Regexp, tag string) string {
+	return pattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := pattern.FindStringSubmatch(m)
+		if parts[1] != "" {
+			return "<" + tag + ">" + parts[1] + "</" + tag + ">"
+		}
+		return parts[2] + "<" + tag + ">" + parts[3] + "</" + tag + ">" + parts[4]
+	})
+}
+
+// Tags that survive sanitizing. None of them takes attributes except links.
+var allowedTags = map[string]bool{
+	"a": true, "b": true, "blockquote": true, "br": true, "code": true,
+	"del": true, "em": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "hr": true, "i": true, "li": true, "mark": true,
+	"ol": true, "p": true, "pre": true, "s": true, "strong": true, "ul": true,
+}
+
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// Tags whose content is removed along with the tag itself.
+var droppedTags = map[string]bool{
+	"applet": true, "embed": true, "frame": true, "frameset": true,
+	"head": true, "iframe": true, "math": true, "noembed": true,
+	"noframes": true, "noscript": true, "object": true, "script": true,
+	"select": true, "style": true, "svg": true, "template": true,
+	"textarea": true, "title": true, "xmp": true,
+}
+
+var allowedSchemes = map[string]bool{"": true, "http": true, "https": true, "mailto": true}
+
+// SanitizeHTML keeps only allowlisted tags and link attributes. Every other
+// tag is removed but its text kept, except for script-like tags which are
+// removed with their content. Event handlers, styles and non-http links
+// cannot pass, and unclosed tags are closed.
+func SanitizeHTML(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	var open []string
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				b.WriteString("</" + open[i] + ">")
+			}
+			return b.String()
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if droppedTags[t.Data] {
+				if tt == html.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 || !allowedTags[t.Data] {
+				continue
+			}
+			b.WriteString("<" + t.Data + sanitizeAttributes(t) + ">")
+			if !voidTags[t.Data] {
+				open = append(open, t.Data)
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			if droppedTags[t.Data] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == t.Data {
+					for j := len(open) - 1; j >= i; j-- {
+						b.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+}
+
+func sanitizeAttributes(t html.Token) string {
+	if t.Data != "a" {
+		return ""
+	}
+	var attrs string
+	for _, a := range t.Attr {
+		switch a.Key {
+		case "href":
+			if safeURL(a.Val) {
+				attrs += ` href="` + html.EscapeString(strings.TrimSpace(a.Val)) + `" rel="nofollow noopener"`
+			}
+		case "title":
+			attrs += ` title="` + html.EscapeString(a.Val) + `"`
+		}
+	}
+	return attrs
+}
+
+// safeURL accepts relative links and http, https and mailto URLs.
+func safeURL(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	for _, c := range raw {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return allowedSchemes[strings.ToLower(u.Scheme)]
+}
@@ -0,0 +1,101 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"Hello *world*", "<p>Hello <em>world</em></p>\n"},
+		{"**bold** and __also bold__", "<p><strong>bold</strong> and <strong>also bold</strong></p>\n"},
+		{"snake_case_name stays", "<p>snake_case_name stays</p>\n"},
+		{"use `a < b` here", "<p>use <code>a &lt; b</code> here</p>\n"},
+		{"# Title", "<h1>Title</h1>\n"},
+		{"- one\n- two", "<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n"},
+		{"1. one\n2. two", "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+		{"> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"```\n<b>x</b>\n```", "<pre><code>&lt;b&gt;x&lt;/b&gt;\n</code></pre>\n"},
+		{"[Wiki](https://en.wikipedia.org/wiki/The_Comedy_of_Errors)",
+			`<p><a href="https://en.wikipedia.org/wiki/The_Comedy_of_Errors" rel="nofollow noopener">Wiki</a></p>` + "\n"},
+		{"Tom & Jerry", "<p>Tom &amp; Jerry</p>\n"},
+		{"<b>inline</b> html", "<p><b>inline</b> html</p>\n"},
+		{"[`code` link](https://example.com)", `<p><a href="https://example.com" rel="nofollow noopener"><code>code</code> link</a></p>` + "\n"},
+		{"\x005\x00", "<p>\uFFFD5\uFFFD</p>\n"},
+		{"`\x000\x00`", "<p><code>\uFFFD0\uFFFD</code></p>\n"},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.src); got != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// Render replaces NUL, but renderInline must not trust its placeholders
+// either: one out of range used to panic, one pointing at itself to loop.
+func TestRenderInlineStrayPlaceholders(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"\x005\x00", "\x005\x00"},
+		{"`\x000\x00`", "<code>\x000\x00</code>"},
+	}
+	for _, tt := range tests {
+		if got := renderInline(tt.text); got != tt.want {
+			t.Errorf("renderInline(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeStripsInjection(t *testing.T) {
+	attacks := []string{
+		`<script>alert(1)</script>`,
+		`<SCRIPT SRC=//evil.example/x.js></SCRIPT>`,
+		`<img src=x onerror=alert(1)>`,
+		`<a href="javascript:alert(1)">click</a>`,
+		`<a href="JaVaScRiPt:alert(1)">click</a>`,
+		`<a href="java&#x09;script:alert(1)">click</a>`,
+		`<a href=" javascript:alert(1)">click</a>`,
+		`<a href="data:text/html;base64,PHNjcmlwdD4=">click</a>`,
+		`<b onmouseover="alert(1)">hover</b>`,
+		`<p style="background:url(javascript:alert(1))">text</p>`,
+		`<svg><script>alert(1)</script></svg>`,
+		`<iframe src="https://evil.example"></iframe>`,
+		`<style>body{display:none}</style>`,
+		`<<script>script>alert(1)<</script>/script>`,
+		`[click](javascript:alert(1))`,
+		`[click](vbscript:msgbox)`,
+		`<!-- <script>alert(1)</script> -->`,
+	}
+	for _, attack := range attacks {
+		got := strings.ToLower(Render(attack))
+		for _, bad := range []string{"<script", "javascript:", "vbscript:", "data:", "onerror", "onmouseover", "style", "<img", "<iframe", "<svg"} {
+			if strings.Contains(got, bad) {
+				t.Errorf("Render(%q) = %q, contains %q", attack, got, bad)
+			}
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`<b>bold`, `<b>bold</b>`},
+		{`<em><b>x</em>`, `<em><b>x</b></em>`},
+		{`</p>stray`, `stray`},
+		{`<div class="x">kept text</div>`, `kept text`},
+		{`<a href="/productpage?id=1&amp;x=2" onclick="x()">rel</a>`, `<a href="/productpage?id=1&amp;x=2" rel="nofollow noopener">rel</a>`},
+		{`<a href="mailto:a@example.com" title="mail">m</a>`, `<a href="mailto:a@example.com" rel="nofollow noopener" title="mail">m</a>`},
+	}
+	for _, tt := range tests {
+		if got := SanitizeHTML(tt.src); got != tt.want {
+			t.Errorf("SanitizeHTML(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
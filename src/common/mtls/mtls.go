@@ -0,0 +1,360 @@
+// Package mtls secures the calls between the services with mutual TLS and
+// SPIFFE IDs, as Istio does.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The services talk TLS to each other when TLS_CERT_FILE and TLS_KEY_FILE
+// are set: the server listens for HTTPS only, and calls to the other
+// services go to https:// URLs, presenting the same certificate. With
+// TLS_CA_FILE both ends verify the other against that CA instead of the
+// system roots, which makes it mutual TLS, and the peer certificate must
+// carry a SPIFFE ID (spiffe://<trust domain>/ns/<namespace>/sa/<account>,
+// as Istio names workloads) in TLS_TRUST_DOMAIN, default bookinfo.local.
+// Servers must moreover carry the ID of the service they are called as,
+// bookinfo-<service> in the namespace of the caller's own certificate, so
+// that one service cannot stand in for another.
+//
+// TLS_ALLOWED_PEERS narrows down, by comma separated SPIFFE IDs with an
+// optional trailing "*", the clients a server accepts. TLS_CLIENT_AUTH is
+// require, the default with a CA, optional or none; productpage, which
+// browsers call without a certificate, wants optional.
+//
+// The files are checked for changes every few seconds, so a rotated
+// certificate or CA is picked up without a restart. The certs tool makes a
+// CA and certificates to try this with.
+
+// tlsReloadInterval is how often the files are checked for changes.
+const tlsReloadInterval = 5 * time.Second
+
+type MeshTLS struct {
+	certFile     string
+	keyFile      string
+	caFile       string
+	trustDomain  string
+	allowedPeers []string
+	clientAuth   tls.ClientAuthType
+	namespace    string
+	now          func() time.Time
+
+	transportsMu sync.Mutex
+	transports   map[string]*http.Transport
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	stamp   string
+	checked time.Time
+}
+
+// NewFromEnv configures TLS from the TLS_* variables. It returns nil when
+// TLS_CERT_FILE and TLS_KEY_FILE are not set, and exits when the
+// configuration or the files are invalid.
+func NewFromEnv() *MeshTLS {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	trustDomain := "bookinfo.local"
+	if value, ok := os.LookupEnv("TLS_TRUST_DOMAIN"); ok {
+		trustDomain = value
+	}
+	var allowedPeers []string
+	for _, peer := range strings.Split(os.Getenv("TLS_ALLOWED_PEERS"), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			allowedPeers = append(allowedPeers, peer)
+		}
+	}
+	m, err := New(certFile, keyFile, os.Getenv("TLS_CA_FILE"), trustDomain, allowedPeers, os.Getenv("TLS_CLIENT_AUTH"))
+	if err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+	if m.caFile == "" {
+		log.Printf("tls: serving %s over TLS", spiffeID(m.cert.Leaf))
+	} else {
+		log.Printf("tls: serving %s over mutual TLS with the CA in %s", spiffeID(m.cert.Leaf), m.caFile)
+	}
+	return m
+}
+
+func New(certFile, keyFile, caFile, trustDomain string, allowedPeers []string, clientAuth string) (*MeshTLS, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key file are needed")
+	}
+	m := &MeshTLS{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		caFile:       caFile,
+		trustDomain:  trustDomain,
+		allowedPeers: allowedPeers,
+		now:          time.Now,
+		transports:   make(map[string]*http.Transport),
+	}
+	switch clientAuth {
+	case "":
+		if caFile != "" {
+			m.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	case "require", "optional":
+		if caFile == "" {
+			return nil, fmt.Errorf("client authentication %q needs a CA file", clientAuth)
+		}
+		m.clientAuth = tls.RequireAndVerifyClientCert
+		if clientAuth == "optional" {
+			m.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown client authentication %q, expected require, optional or none", clientAuth)
+	}
+	for _, peer := range allowedPeers {
+		if !strings.HasPrefix(peer, "spiffe://") {
+			return nil, fmt.Errorf("allowed peer %q is not a SPIFFE ID", peer)
+		}
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.namespace = namespaceOf(spiffeID(m.cert.Leaf))
+	return m, nil
+}
+
+// namespaceOf returns the namespace in a SPIFFE ID, "default" without one.
+func namespaceOf(id string) string {
+	parts := strings.Split(strings.TrimPrefix(id, "spiffe://"), "/")
+	for i := 1; i+1 < len(parts); i += 2 {
+		if parts[i] == "ns" && parts[i+1] != "" {
+			return parts[i+1]
+		}
+	}
+	return "default"
+}
+
+// load reads the certificate, key and CA files. The caller holds the lock,
+// or has the only reference.
+func (m *MeshTLS) load() error {
+	stamp := m.fileStamp()
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	var roots *x509.CertPool
+	if m.caFile != "" {
+		data, err := os.ReadFile(m.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificates found", m.caFile)
+		}
+	}
+	m.cert, m.roots, m.stamp = &cert, roots, stamp
+	return nil
+}
+
+// fileStamp sums up the modification times and sizes of the files.
+func (m *MeshTLS) fileStamp() string {
+	var stamp strings.Builder
+	for _, path := range []string{m.certFile, m.keyFile, m.caFile} {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&stamp, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return stamp.String()
+}
+
+// current returns the certificate and the CA, reading the files again when
+// they changed. Files caught halfway through being replaced fail to load,
+// and the previous certificate is used until the next check.
+func (m *MeshTLS) current() (*tls.Certificate, *x509.CertPool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.checked) < tlsReloadInterval {
+		return m.cert, m.roots
+	}
+	m.checked = now
+	if m.fileStamp() == m.stamp {
+		return m.cert, m.roots
+	}
+	if err := m.load(); err != nil {
+		log.Printf("tls: reload: %v", err)
+		return m.cert, m.roots
+	}
+	log.Printf("tls: reloaded the certificate of %s, valid until %s", spiffeID(m.cert.Leaf), m.cert.Leaf.NotAfter.Format(time.RFC3339))
+	return m.cert, m.roots
+}
+
+func (m *MeshTLS) serverConfig() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := m.current()
+		return cert, nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		// Each handshake gets the CA as it is at the time.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, roots := m.current()
+			return &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				GetCertificate:   getCertificate,
+				ClientAuth:       m.clientAuth,
+				ClientCAs:        roots,
+				VerifyConnection: m.verifyClient,
+			}, nil
+		},
+	}
+}
+
+// clientConfig is the configuration for calls to a service.
+func (m *MeshTLS) clientConfig(service string) *tls.Config {
+	expected := fmt.Sprintf("spiffe://%s/ns/%s/sa/bookinfo-%s", m.trustDomain, m.namespace, service)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The server certificate is verified by verifyServer instead,
+		// against the CA as it is at the time.
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := m.current()
+			return cert, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return m.verifyServer(state, expected)
+		},
+	}
+}
+
+// verifyClient checks the SPIFFE ID of a client that presented a
+// certificate, which Go has verified against the CA by now.
+func (m *MeshTLS) verifyClient(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	if err := m.checkPeer(state.VerifiedChains[0][0], m.allowedPeers); err != nil {
+		log.Printf("tls: rejected client: %v", err)
+		return err
+	}
+	return nil
+}
+
+// verifyServer verifies the certificate of a server and, with a CA, that
+// its SPIFFE ID is the expected one.
+func (m *MeshTLS) verifyServer(state tls.ConnectionState, expected string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: the server sent no certificate")
+	}
+	_, roots := m.current()
+	opts := x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+		return err
+	}
+	if roots == nil {
+		return nil
+	}
+	return m.checkPeer(state.PeerCertificates[0], []string{expected})
+}
+
+// checkPeer checks that the SPIFFE ID of a peer is in the trust domain and,
+// when there is a list, allowed.
+func (m *MeshTLS) checkPeer(cert *x509.Certificate, allowed []string) error {
+	id := spiffeID(cert)
+	if id == "" {
+		return errors.New("tls: the peer certificate has no SPIFFE ID")
+	}
+	if domain := strings.SplitN(strings.TrimPrefix(id, "spiffe://"), "/", 2)[0]; domain != m.trustDomain {
+		return fmt.Errorf("tls: peer %s is not in the trust domain %s", id, m.trustDomain)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		if pattern == id || strings.HasSuffix(pattern, "*") && strings.HasPrefix(id, pattern[:len(pattern)-1]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tls: peer %s is not allowed", id)
+}
+
+// spiffeID returns the SPIFFE ID of a certificate, "" without one.
+func spiffeID(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// PeerPrincipal returns the SPIFFE ID of the verified client certificate
+// of a request without "spiffe://", like source.principal in Istio, or ""
+// without one.
+func PeerPrincipal(c *gin.Context) string {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(spiffeID(state.VerifiedChains[0][0]), "spiffe://")
+}
+
+// Scheme is the scheme of the URLs of the other services.
+func (m *MeshTLS) Scheme() string {
+	if m == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// Transport returns the transport for calls to a service, such as
+// "reviews", which only accepts servers with that service's SPIFFE ID.
+func (m *MeshTLS) Transport(service string) http.RoundTripper {
+	if m == nil {
+		return http.DefaultTransport
+	}
+	m.transportsMu.Lock()
+	defer m.transportsMu.Unlock()
+	t, ok := m.transports[service]
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = m.clientConfig(service)
+		m.transports[service] = t
+	}
+	return t
+}
+
+// Run serves a router on addr, over TLS when it is configured.
+func (m *MeshTLS) Run(r *gin.Engine, addr string) error {
+	if m == nil {
+		return r.Run(addr)
+	}
+	log.Printf("tls: listening on %s", addr)
+	server := &http.Server{Addr: addr, Handler: r, TLSConfig: m.serverConfig()}
+	return server.ListenAndServeTLS("", "")
+}
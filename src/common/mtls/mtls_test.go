@@ -0,0 +1,206 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	writeTestPEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for localhost with a SPIFFE ID, returning the
+// certificate and key files.
+func (ca *testCA) issue(t *testing.T, name, id string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, _ := url.Parse(id)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		URIs:         []*url.URL{spiffe},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	writeTestPEM(t, certFile, "CERTIFICATE", der)
+	return certFile, keyFile
+}
+
+func writeTestPEM(t *testing.T, path, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMeshTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	certFile, keyFile := ca.issue(t, "ratings", "spiffe://bookinfo.local/ns/default/sa/bookinfo-ratings", 10)
+	server, err := New(certFile, keyFile, caFile, "bookinfo.local", []string{"spiffe://bookinfo.local/ns/default/sa/bookinfo-reviews*"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	server.now = func() time.Time { return now }
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, PeerPrincipal(c)) })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&http.Server{Handler: r}).Serve(tls.NewListener(listener, server.serverConfig()))
+	defer listener.Close()
+	serverURL := "https://" + listener.Addr().String() + "/"
+
+	client := func(name, id string) *MeshTLS {
+		certFile, keyFile := ca.issue(t, name, id, 20)
+		m, err := New(certFile, keyFile, caFile, "bookinfo.local", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	get := func(transport http.RoundTripper) (*http.Response, string, error) {
+		resp, err := (&http.Client{Transport: transport}).Get(serverURL)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	reviews := client("reviews", "spiffe://bookinfo.local/ns/default/sa/bookinfo-reviews")
+	if _, body, err := get(reviews.Transport("ratings")); err != nil || body != "bookinfo.local/ns/default/sa/bookinfo-reviews" {
+		t.Errorf("allowed peer: %q, %v", body, err)
+	}
+	if _, _, err := get(client("sleep", "spiffe://bookinfo.local/ns/default/sa/sleep").Transport("ratings")); err == nil {
+		t.Error("a peer that is not allowed got through")
+	}
+	if _, _, err := get(client("other", "spiffe://example.org/ns/default/sa/bookinfo-reviews").Transport("ratings")); err == nil {
+		t.Error("a peer from another trust domain got through")
+	}
+	anonymous := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: reviews.roots}}
+	if _, _, err := get(anonymous); err == nil {
+		t.Error("a client without a certificate got through")
+	}
+
+	// Clients check that servers are the service they meant to call.
+	if _, _, err := get(reviews.Transport("details")); err == nil {
+		t.Error("the client accepted ratings when calling details")
+	}
+
+	// Clients check the trust domain of servers too.
+	ca.issue(t, "ratings", "spiffe://example.org/ns/default/sa/bookinfo-ratings", 11)
+	now = now.Add(tlsReloadInterval)
+	reviews.transports["ratings"].CloseIdleConnections()
+	if _, _, err := get(reviews.Transport("ratings")); err == nil {
+		t.Error("the client accepted a server from another trust domain")
+	}
+
+	// A new certificate on disk is used from the next check on.
+	ca.issue(t, "ratings", "spiffe://bookinfo.local/ns/default/sa/bookinfo-ratings", 12)
+	if _, _, err := get(reviews.Transport("ratings")); err == nil {
+		t.Error("reloaded before the next check")
+	}
+	now = now.Add(tlsReloadInterval)
+	resp, _, err := get(reviews.Transport("ratings"))
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 12 {
+		t.Errorf("not reloaded: %v", err)
+	}
+}
+
+func TestNewMeshTLSRejects(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	certFile, keyFile := ca.issue(t, "ratings", "spiffe://bookinfo.local/ns/default/sa/bookinfo-ratings", 10)
+	tests := []struct {
+		name       string
+		caFile     string
+		peers      []string
+		clientAuth string
+	}{
+		{"optional without a CA", "", nil, "optional"},
+		{"unknown client auth", caFile, nil, "sometimes"},
+		{"peer without spiffe://", caFile, []string{"bookinfo.local/ns/default/sa/bookinfo-reviews"}, ""},
+		{"missing CA", filepath.Join(ca.dir, "missing.pem"), nil, ""},
+		{"CA without certificates", keyFile, nil, ""},
+	}
+	for _, tt := range tests {
+		if _, err := New(certFile, keyFile, tt.caFile, "bookinfo.local", tt.peers, tt.clientAuth); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	if _, err := New(certFile, keyFile, "", "bookinfo.local", nil, ""); err != nil {
+		t.Errorf("TLS without a CA: %v", err)
+	}
+}
+
+func TestNamespaceOf(t *testing.T) {
+	for id, want := range map[string]string{
+		"spiffe://bookinfo.local/ns/staging/sa/bookinfo-reviews": "staging",
+		"spiffe://bookinfo.local/sa/bookinfo-reviews":            "default",
+		"": "default",
+	} {
+		if got := namespaceOf(id); got != want {
+			t.Errorf("namespaceOf(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+// Package outbox delivers the domain events of a service to webhooks.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a domain event as delivered to webhooks.
+type Event struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Source string          `json:"source"`
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Delivery is an event on its way to one webhook.
+type Delivery struct {
+	Event       Event     `json:"event"`
+	URL         string    `json:"url"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Outbox holds the events recorded with each write until they have been
+// delivered. Events are recorded by the store under the same lock as the
+// write itself, so an event exists if and only if the write happened. A
+// dispatcher delivers them in the background; a delivery that keeps failing
+// ends up in the dead-letter list, from where it can be redriven. The pending
+// list is kept in memory and bounded: when a webhook is down for long, the
+// oldest deliveries are moved to the dead-letter list to make room.
+type Outbox struct {
+	source      string
+	targets     []string
+	secret      []byte
+	maxAttempts int
+	maxPending  int
+	backoff     time.Duration
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []*Delivery
+	dead    []*Delivery
+	wake    chan struct{}
+}
+
+// maxDeadLetters bounds the dead-letter list, the oldest entries are dropped.
+const maxDeadLetters = 1000
+
+// DefaultMaxPending is the number of deliveries an outbox holds when
+// WEBHOOK_MAX_PENDING is not set.
+const DefaultMaxPending = 10000
+
+// NewFromEnv configures an outbox from WEBHOOK_URLS (comma separated),
+// WEBHOOK_SECRET, WEBHOOK_MAX_ATTEMPTS (default 8), WEBHOOK_BACKOFF_MS
+// (first retry delay, doubled on every attempt, default 1000) and
+// WEBHOOK_MAX_PENDING (default DefaultMaxPending).
+func NewFromEnv(source string) *Outbox {
+	var targets []string
+	for _, target := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	maxAttempts := 8
+	if value, ok := os.LookupEnv("WEBHOOK_MAX_ATTEMPTS"); ok {
+		maxAttempts, _ = strconv.Atoi(value)
+	}
+	backoff := time.Second
+	if value, ok := os.LookupEnv("WEBHOOK_BACKOFF_MS"); ok {
+		ms, _ := strconv.Atoi(value)
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	o := New(source, targets, os.Getenv("WEBHOOK_SECRET"), maxAttempts, backoff)
+	if value, ok := os.LookupEnv("WEBHOOK_MAX_PENDING"); ok {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			o.maxPending = n
+		}
+	}
+	return o
+}
+
+func New(source string, targets []string, secret string, maxAttempts int, backoff time.Duration) *Outbox {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	return &Outbox{
+		source:      source,
+		targets:     targets,
+		secret:      []byte(secret),
+		maxAttempts: maxAttempts,
+		maxPending:  DefaultMaxPending,
+		backoff:     backoff,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Record adds an event for every configured webhook. It never blocks on the
+// network, so it is safe to call while holding the lock of the write.
+func (o *Outbox) Record(eventType string, data interface{}) {
+	if o == nil || len(o.targets) == 0 {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("outbox: encode %s: %v", eventType, err)
+		return
+	}
+	event := Event{Id: newEventId(), Type: eventType, Source: o.source, Time: time.Now().UTC(), Data: payload}
+
+	o.mu.Lock()
+	for _, target := range o.targets {
+		o.pending = append(o.pending, &Delivery{Event: event, URL: target, NextAttempt: event.Time})
+	}
+	if overflow := len(o.pending) - o.maxPending; overflow > 0 {
+		for _, d := range o.pending[:overflow] {
+			d.LastError = "outbox full"
+			o.bury(d)
+		}
+		o.pending = append([]*Delivery(nil), o.pending[overflow:]...)
+		log.Printf("outbox: %d pending deliveries, moved the %d oldest to the dead letters", o.maxPending, overflow)
+	}
+	o.mu.Unlock()
+	o.notify()
+}
+
+// Targets returns the number of webhooks events are delivered to.
+func (o *Outbox) Targets() int {
+	if o == nil {
+		return 0
+	}
+	return len(o.targets)
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func newEventId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Run delivers events until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+		next := o.dispatch(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// dispatch attempts every delivery that is due and returns how long to wait
+// before the next one is.
+func (o *Outbox) dispatch(ctx context.Context) time.Duration {
+	now := time.Now()
+	o.mu.Lock()
+	var due []*Delivery
+	for _, d := range o.pending {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, d := range due {
+		err := o.deliver(ctx, d)
+		o.mu.Lock()
+		d.Attempts++
+		switch {
+		case !contains(o.pending, d):
+			// Moved to the dead letters by Record while being delivered.
+			if err == nil {
+				remove(&o.dead, d)
+			}
+		case err == nil:
+			remove(&o.pending, d)
+		case d.Attempts >= o.maxAttempts:
+			d.LastError = err.Error()
+			remove(&o.pending, d)
+			o.bury(d)
+			log.Printf("outbox: giving up on %s %s to %s after %d attempts: %v", d.Event.Type, d.Event.Id, d.URL, d.Attempts, err)
+		default:
+			d.LastError = err.Error()
+			d.NextAttempt = time.Now().Add(o.backoff << (d.Attempts - 1))
+		}
+		o.mu.Unlock()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	next := time.Minute
+	for _, d := range o.pending {
+		if wait := time.Until(d.NextAttempt); wait < next {
+			next = wait
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func contains(list []*Delivery, d *Delivery) bool {
+	for _, p := range list {
+		if p == d {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops a delivery from a list. The caller holds the lock.
+func remove(list *[]*Delivery, d *Delivery) {
+	for i, p := range *list {
+		if p == d {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			return
+		}
+	}
+}
+
+// bury adds a delivery to the dead letters. The caller holds the lock.
+func (o *Outbox) bury(d *Delivery) {
+	o.dead = append(o.dead, d)
+	if len(o.dead) > maxDeadLetters {
+		o.dead = o.dead[len(o.dead)-maxDeadLetters:]
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, d *Delivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Id", d.Event.Id)
+	request.Header.Set("X-Webhook-Event", d.Event.Type)
+	if len(o.secret) > 0 {
+		request.Header.Set("X-Webhook-Signature", Sign(o.secret, time.Now(), body))
+	}
+
+	resp, err := o.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", d.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign computes the X-Webhook-Signature header: the time of signing
+// and an HMAC-SHA256 over "<unix time>.<body>", as "t=<unix time>,v1=<hex>".
+// Receivers recompute the HMAC and reject old timestamps to stop replays.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Pending returns the deliveries not made yet.
+func (o *Outbox) Pending() []Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return copyDeliveries(o.pending)
+}
+
+// DeadLetters returns the deliveries that were given up on.
+func (o *Outbox) DeadLetters() []Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return copyDeliveries(o.dead)
+}
+
+// Redrive moves all dead letters back to the pending list with their attempt
+// counts reset, and returns how many there were.
+func (o *Outbox) Redrive() int {
+	o.mu.Lock()
+	n := len(o.dead)
+	now := time.Now()
+	for _, d := range o.dead {
+		d.Attempts, d.NextAttempt = 0, now
+		o.pending = append(o.pending, d)
+	}
+	o.dead = nil
+	o.mu.Unlock()
+	o.notify()
+	return n
+}
+
+func copyDeliveries(list []*Delivery) []Delivery {
+	out := make([]Delivery, len(list))
+	for i, d := range list {
+		out[i] = *d
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package outbox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutboxRetriesAndSigns(t *testing.T) {
+	var calls int32
+	received := make(chan *http.Request, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sig := r.Header.Get("X-Webhook-Signature")
+		unix, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+		if want := Sign([]byte("s3cret"), time.Unix(unix, 0), body); sig != want {
+			t.Errorf("signature %q, want %q", sig, want)
+		}
+		received <- r
+	}))
+	defer target.Close()
+
+	o := New("reviews", []string{target.URL}, "s3cret", 5, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	o.Record("review.created", map[string]interface{}{"id": 3, "text": "Lovely."})
+	select {
+	case r := <-received:
+		if r.Header.Get("X-Webhook-Event") != "review.created" || r.Header.Get("X-Webhook-Id") == "" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if pending := o.Pending(); len(pending) != 0 {
+		t.Errorf("delivered event still pending: %+v", pending)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	var healthy int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	o := New("reviews", []string{target.URL}, "", 2, time.Millisecond)
+	o.Record("review.deleted", map[string]int{"id": 1})
+	for i := 0; i < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+		o.dispatch(context.Background())
+	}
+	dead := o.DeadLetters()
+	if len(dead) != 1 || dead[0].Attempts != 2 || len(o.Pending()) != 0 {
+		t.Fatalf("dead letters %+v, pending %+v", dead, o.Pending())
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	if n := o.Redrive(); n != 1 {
+		t.Errorf("redrove %d, want 1", n)
+	}
+	o.dispatch(context.Background())
+	if len(o.DeadLetters()) != 0 || len(o.Pending()) != 0 {
+		t.Errorf("redriven delivery not delivered: %+v %+v", o.DeadLetters(), o.Pending())
+	}
+}
+
+func TestOutboxBoundsPending(t *testing.T) {
+	o := New("reviews", []string{"http://a.example", "http://b.example"}, "", 2, time.Minute)
+	o.maxPending = 5
+	for id := 1; id <= 4; id++ {
+		o.Record("review.created", map[string]int{"id": id})
+	}
+	pending, dead := o.Pending(), o.DeadLetters()
+	if len(pending) != 5 || len(dead) != 3 {
+		t.Fatalf("%d pending and %d dead letters, want 5 and 3", len(pending), len(dead))
+	}
+	if string(dead[0].Event.Data) != `{"id":1}` || dead[0].LastError != "outbox full" {
+		t.Errorf("oldest delivery not moved to the dead letters: %+v", dead[0])
+	}
+	if string(pending[4].Event.Data) != `{"id":4}` {
+		t.Errorf("newest delivery not pending: %+v", pending[4])
+	}
+}
@@ -0,0 +1,289 @@
+// Package ratelimit limits the requests of every client locally, like the
+// local rate limit of an Envoy sidecar.
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// Rate limits are read from a YAML file, for example:
+//
+//	limits:
+//	- name: reviews-per-user
+//	  methods: ["GET"]
+//	  paths: ["/reviews/*"]
+//	  key: user
+//	  requests: 60
+//	  per: 1m
+//	  burst: 10
+//
+// Every client, as told apart by the key, has a token bucket per limit that
+// holds up to burst tokens (default: requests) and refills at requests per
+// period. A request takes a token from the bucket of the first limit that
+// matches its method and path, and is answered with 429 when there is none.
+// The keys are user (the verified user, else the client IP), ip, apiKey
+// (the id of an authenticated API key, else the client IP) and global, one
+// bucket for all clients. Headers a client sets itself, like end-user or
+// X-API-Key, are never used as keys: anyone could change them on every
+// request to get a new bucket. For the same reason the client IP is the
+// address of the connection, not one named in X-Forwarded-For.
+
+type Config struct {
+	Limits []Limit `yaml:"limits"`
+}
+
+type Limit struct {
+	Name     string   `yaml:"name"`
+	Methods  []string `yaml:"methods"`
+	Paths    []string `yaml:"paths"`
+	NotPaths []string `yaml:"notPaths"`
+	Key      string   `yaml:"key"`
+	Requests float64  `yaml:"requests"`
+	Per      string   `yaml:"per"`
+	Burst    int      `yaml:"burst"`
+
+	rate    float64 // tokens per second
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	allowed uint64
+	limited uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter applies a list of limits.
+type Limiter struct {
+	limits []*Limit
+	now    func() time.Time
+}
+
+// Identity is who sent a request, as far as it was verified. Its fields are
+// "" when unknown.
+type Identity struct {
+	// User is the subject of a verified token or the signed in user.
+	User string
+	// APIKey is the id of the API key the request was authenticated with.
+	APIKey string
+}
+
+// TokenIdentity identifies the sender of a request by its verified JWT, for
+// the services behind auth.JWTVerifier's middleware.
+func TokenIdentity(c *gin.Context) Identity {
+	if claims := auth.ClaimsOf(c); claims != nil {
+		return Identity{User: claims.Subject}
+	}
+	return Identity{}
+}
+
+// NewFromEnv loads the limits in RATE_LIMIT_FILE. It returns nil when the
+// variable is not set, and exits when the file is invalid.
+func NewFromEnv() *Limiter {
+	path, ok := os.LookupEnv("RATE_LIMIT_FILE")
+	if !ok || path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("rate limit: %v", err)
+	}
+	l, err := New(data)
+	if err != nil {
+		log.Fatalf("rate limit: %s: %v", path, err)
+	}
+	log.Printf("rate limit: loaded %d limits from %s", len(l.limits), path)
+	return l
+}
+
+func New(data []byte) (*Limiter, error) {
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	l := &Limiter{now: time.Now}
+	for i := range config.Limits {
+		limit := &config.Limits[i]
+		if limit.Name == "" {
+			limit.Name = fmt.Sprintf("limit-%d", i)
+		}
+		switch limit.Key {
+		case "":
+			limit.Key = "ip"
+		case "user", "ip", "apiKey", "global":
+		default:
+			return nil, fmt.Errorf("limit %s: unknown key %q", limit.Name, limit.Key)
+		}
+		per := time.Second
+		if limit.Per != "" {
+			var err error
+			if per, err = time.ParseDuration(limit.Per); err != nil || per <= 0 {
+				return nil, fmt.Errorf("limit %s: invalid period %q", limit.Name, limit.Per)
+			}
+		}
+		if limit.Requests <= 0 {
+			return nil, fmt.Errorf("limit %s: requests must be positive", limit.Name)
+		}
+		limit.rate = limit.Requests / per.Seconds()
+		if limit.Burst == 0 {
+			limit.Burst = int(math.Ceil(limit.Requests))
+		}
+		if limit.Burst < 1 {
+			return nil, fmt.Errorf("limit %s: burst must be positive", limit.Name)
+		}
+		for _, path := range append(limit.Paths, limit.NotPaths...) {
+			if err := auth.CheckPathPattern(path); err != nil {
+				return nil, fmt.Errorf("limit %s: %v", limit.Name, err)
+			}
+		}
+		limit.buckets = make(map[string]*tokenBucket)
+		l.limits = append(l.limits, limit)
+	}
+	return l, nil
+}
+
+func (limit *Limit) matches(method, path string) bool {
+	return auth.MatchField(limit.Methods, nil, []string{method}, auth.MatchValue) &&
+		auth.MatchField(limit.Paths, limit.NotPaths, []string{path}, auth.MatchPath)
+}
+
+// key returns the bucket key of a request sent by id.
+func (limit *Limit) key(c *gin.Context, id Identity) string {
+	switch limit.Key {
+	case "global":
+		return ""
+	case "user":
+		if id.User != "" {
+			return "user:" + id.User
+		}
+	case "apiKey":
+		if id.APIKey != "" {
+			return "apiKey:" + id.APIKey
+		}
+	}
+	// ClientIP would believe X-Forwarded-For.
+	return "ip:" + c.RemoteIP()
+}
+
+// decision is the outcome of taking a token.
+type decision struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next token, when none is left.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// take takes a token from the bucket of a key.
+func (limit *Limit) take(key string, now time.Time) decision {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	limit.sweep(now)
+	burst := float64(limit.Burst)
+	b, ok := limit.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		limit.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+
+	var d decision
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+		limit.allowed++
+	} else {
+		d.RetryAfter = limit.duration(1 - b.tokens)
+		limit.limited++
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = limit.duration(burst - b.tokens)
+	return d
+}
+
+func (limit *Limit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / limit.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have filled up again, at most once a minute,
+// so that clients which went away do not pile up.
+func (limit *Limit) sweep(now time.Time) {
+	if now.Sub(limit.swept) < time.Minute {
+		return
+	}
+	limit.swept = now
+	full := limit.duration(float64(limit.Burst))
+	for key, b := range limit.buckets {
+		if now.Sub(b.last) >= full {
+			delete(limit.buckets, key)
+		}
+	}
+}
+
+// Middleware answers requests over their limit with 429. All responses to
+// limited routes carry the X-RateLimit headers Envoy sends, so local and
+// mesh rate limiting can be compared side by side. identify tells who sent
+// a request; it must only return identities that were verified, so the
+// middleware goes after the ones that verify them.
+func (l *Limiter) Middleware(identify func(*gin.Context) Identity) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			c.Next()
+			return
+		}
+		for _, limit := range l.limits {
+			if !limit.matches(c.Request.Method, c.Request.URL.Path) {
+				continue
+			}
+			d := limit.take(limit.key(c, identify(c)), l.now())
+			c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+			c.Header("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.Reset.Seconds()))))
+			if !d.Allowed {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+				log.Printf("rate limit: %s limited %s %s", limit.Name, c.Request.Method, c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+				return
+			}
+			break
+		}
+		c.Next()
+	}
+}
+
+// Metrics writes the counters of the limits in the Prometheus text format.
+func (l *Limiter) Metrics(c *gin.Context) {
+	var b strings.Builder
+	b.WriteString("# HELP ratelimit_requests_total Requests checked against a rate limit, by outcome.\n")
+	b.WriteString("# TYPE ratelimit_requests_total counter\n")
+	var buckets []string
+	if l != nil {
+		for _, limit := range l.limits {
+			limit.mu.Lock()
+			fmt.Fprintf(&b, "ratelimit_requests_total{limit=%q,outcome=\"allowed\"} %d\n", limit.Name, limit.allowed)
+			fmt.Fprintf(&b, "ratelimit_requests_total{limit=%q,outcome=\"limited\"} %d\n", limit.Name, limit.limited)
+			buckets = append(buckets, fmt.Sprintf("ratelimit_buckets{limit=%q} %d\n", limit.Name, len(limit.buckets)))
+			limit.mu.Unlock()
+		}
+	}
+	b.WriteString("# HELP ratelimit_buckets Clients with a token bucket.\n")
+	b.WriteString("# TYPE ratelimit_buckets gauge\n")
+	b.WriteString(strings.Join(buckets, ""))
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
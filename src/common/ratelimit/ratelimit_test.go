@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenBucket(t *testing.T) {
+	l, err := New([]byte("limits:\n- requests: 1\n  burst: 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := l.limits[0]
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		if d := limit.take("a", now); !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("request %d: %+v", i, d)
+		}
+	}
+	if d := limit.take("a", now); d.Allowed || d.RetryAfter != time.Second || d.Reset != 3*time.Second {
+		t.Errorf("over the burst: %+v", d)
+	}
+	if d := limit.take("b", now); !d.Allowed {
+		t.Errorf("another key shares the bucket: %+v", d)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if d := limit.take("a", now); d.Allowed || d.RetryAfter != 500*time.Millisecond {
+		t.Errorf("half a token later: %+v", d)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if d := limit.take("a", now); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("a token later: %+v", d)
+	}
+
+	// Buckets that filled up again are dropped.
+	now = now.Add(time.Hour)
+	limit.take("c", now)
+	if len(limit.buckets) != 1 {
+		t.Errorf("%d buckets left after a sweep", len(limit.buckets))
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	l, err := New([]byte(`
+limits:
+- name: summary
+  paths: ["/reviews/{*}/summary"]
+  key: global
+  requests: 100
+- name: reviews-per-user
+  methods: ["GET"]
+  paths: ["/reviews/*"]
+  key: user
+  requests: 2
+  per: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(l.Middleware(func(c *gin.Context) Identity { return Identity{User: c.GetHeader("test-user")} }))
+	r.GET("/metrics", l.Metrics)
+	r.GET("/reviews/:productId", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/reviews/:productId/summary", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("test-user", user)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := get("/reviews/0", "jason"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Fatalf("request %d: got %d %v", i, w.Code, w.Header())
+		}
+	}
+	w := get("/reviews/0", "jason")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("over the limit: got %d %v", w.Code, w.Header())
+	}
+	if w := get("/reviews/0", "alice"); w.Code != http.StatusOK {
+		t.Errorf("another user: got %d", w.Code)
+	}
+	if w := get("/reviews/0/summary", "jason"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "100" {
+		t.Errorf("the first matching limit applies: got %d %v", w.Code, w.Header())
+	}
+	if w := get("/metrics", ""); w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("unlimited route has rate limit headers: %v", w.Header())
+	}
+
+	metrics := get("/metrics", "").Body.String()
+	for _, line := range []string{
+		`ratelimit_requests_total{limit="reviews-per-user",outcome="allowed"} 3`,
+		`ratelimit_requests_total{limit="reviews-per-user",outcome="limited"} 1`,
+		`ratelimit_requests_total{limit="summary",outcome="allowed"} 1`,
+		`ratelimit_buckets{limit="reviews-per-user"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	for _, config := range []string{
+		"limits:\n- requests: 0\n",
+		"limits:\n- requests: 1\n  per: soon\n",
+		"limits:\n- requests: 1\n  key: session\n",
+		"limits:\n- requests: 1\n  burst: -1\n",
+		"limits:\n- requests: 1\n  path: [\"/\"]\n",
+	} {
+		if _, err := New([]byte(config)); err == nil {
+			t.Errorf("accepted %q", config)
+		}
+	}
+}
+
+func TestLimiterIgnoresDeclaredIdentities(t *testing.T) {
+	l, err := New([]byte(`
+limits:
+- name: per-key
+  paths: ["/api/*"]
+  key: apiKey
+  requests: 1
+  per: 1m
+- name: per-user
+  key: user
+  requests: 1
+  per: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(l.Middleware(TokenIdentity))
+	r.GET("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, path := range []string{"/api/products", "/reviews/0"} {
+		// Only the first request finds a token; the headers do not make
+		// the others new clients.
+		for i, header := range []string{"end-user", "X-API-Key", "X-Forwarded-For", "X-Real-IP"} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			value := "client-" + strconv.Itoa(i)
+			if strings.HasSuffix(header, "-For") || strings.HasSuffix(header, "-IP") {
+				value = "10.0.0." + strconv.Itoa(i)
+			}
+			req.Header.Set(header, value)
+			r.ServeHTTP(w, req)
+			want := http.StatusTooManyRequests
+			if i == 0 {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("%s with a new %s: got %d, want %d", path, header, w.Code, want)
+			}
+		}
+	}
+	for _, limit := range l.limits {
+		if len(limit.buckets) != 1 {
+			t.Errorf("%s has %d buckets, want the one of the client IP", limit.Name, len(limit.buckets))
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var adminToken string
+
+var history *History
+
+func init() {
+	adminToken = os.Getenv("DETAILS_ADMIN_TOKEN")
+}
+
+// registerAdminRoutes adds the write API for the catalog. Every change is
+// guarded by optimistic concurrency: updates must send the current ETag in
+// If-Match and are rejected with 412 when the record changed in between.
+// The history of a book names who made each change, so only admins may read
+// it as well.
+func registerAdminRoutes(r *gin.Engine) {
+	r.POST("/details/:productId", requireAdmin, createBook)
+	r.PUT("/details/:productId", requireAdmin, replaceBook)
+	r.PATCH("/details/:productId", requireAdmin, patchBook)
+	r.GET("/details/:productId/history", requireAdmin, bookHistory)
+	r.POST("/details/reload", requireAdmin, reloadCatalog)
+	auditLog.RegisterRoutes(r, "/details/audit", requireAdmin)
+}
+
+func reloadCatalog(c *gin.Context) {
+	if err := catalog.Reload(); err != nil {
+		log.Printf("reload catalog: %v", err)
+		auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "catalog.reload", Outcome: audit.Failure})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not reload catalog"})
+		return
+	}
+	auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "catalog.reload"})
+	c.JSON(http.StatusOK, gin.H{"status": "catalog reloaded", "books": len(catalog.List())})
+}
+
+// requireAdmin accepts requests carrying `Authorization: Bearer <token>` with
+// the token configured in DETAILS_ADMIN_TOKEN, or a JWT granting the admin
+// role. Without either the write API is disabled.
+func requireAdmin(c *gin.Context) {
+	if auth.ClaimsOf(c).HasRole("admin") {
+		c.Next()
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		auditLog.Record(c, audit.Entry{Action: "admin.denied", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin credentials required"})
+		return
+	}
+	c.Next()
+}
+
+// actor names who made a change, for the history: the subject of a
+// verified token, else the holder of the admin token. The end-user header
+// is never trusted here.
+func actor(c *gin.Context) string {
+	if claims := auth.ClaimsOf(c); claims != nil {
+		return claims.Subject
+	}
+	return "admin"
+}
+
+func productIdParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("productId"))
+	if err != nil || id < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide numeric product ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+func createBook(c *gin.Context) {
+	id, ok := productIdParam(c)
+	if !ok {
+		return
+	}
+	var book BookInfo
+	if err := c.ShouldBindJSON(&book); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book.Id = id
+	writeBook(c, "create", BookInfo{}, book, "")
+}
+
+func replaceBook(c *gin.Context) {
+	id, ok := productIdParam(c)
+	if !ok {
+		return
+	}
+	current, etag, ok := preconditions(c, id)
+	if !ok {
+		return
+	}
+	var book BookInfo
+	if err := c.ShouldBindJSON(&book); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book.Id = id
+	writeBook(c, "replace", current, book, etag)
+}
+
+// patchBook applies a JSON merge patch (RFC 7386) to the current record.
+func patchBook(c *gin.Context) {
+	id, ok := productIdParam(c)
+	if !ok {
+		return
+	}
+	current, etag, ok := preconditions(c, id)
+	if !ok {
+		return
+	}
+	var patch map[string]interface{}
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields := bookFields(current)
+	for field, value := range patch {
+		if value == nil {
+			delete(fields, field)
+		} else {
+			fields[field] = value
+		}
+	}
+	var book BookInfo
+	data, _ := json.Marshal(fields)
+	if err := json.Unmarshal(data, &book); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book.Id = id
+	writeBook(c, "patch", current, book, etag)
+}
+
+// preconditions loads the record an update applies to and checks If-Match
+// against it. It writes the error response itself and reports whether the
+// update may go ahead.
+func preconditions(c *gin.Context, id int) (BookInfo, string, bool) {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+		return BookInfo{}, "", false
+	}
+	current, ok := catalog.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrBookNotFound.Error()})
+		return BookInfo{}, "", false
+	}
+	etag := Etag(current)
+	if ifMatch != "*" && ifMatch != etag {
+		c.Header("ETag", etag)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": ErrEtagMismatch.Error()})
+		return BookInfo{}, "", false
+	}
+	return current, etag, true
+}
+
+func writeBook(c *gin.Context, action string, before, book BookInfo, etag string) {
+	if err := validateBook(book); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	entry := audit.Entry{Actor: actor(c), Action: "book." + action, Target: fmt.Sprintf("product/%d", book.Id)}
+	if err := catalog.CompareAndPut(book, etag); err != nil {
+		entry.Outcome, entry.Details = audit.Failure, map[string]string{"error": err.Error()}
+		auditLog.Record(c, entry)
+		switch {
+		case errors.Is(err, ErrBookExists):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrBookNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrEtagMismatch):
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		default:
+			log.Printf("save catalog: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save catalog"})
+		}
+		return
+	}
+
+	newEtag := Etag(book)
+	record := HistoryRecord{
+		ProductId: book.Id,
+		Action:    action,
+		Who:       actor(c),
+		When:      time.Now().UTC(),
+		Etag:      newEtag,
+		Diff:      diffBooks(before, book),
+	}
+	if err := history.Append(record); err != nil {
+		log.Printf("append history: %v", err)
+	}
+	fields := make([]string, len(record.Diff))
+	for i, change := range record.Diff {
+		fields[i] = change.Field
+	}
+	entry.Details = map[string]string{"etag": newEtag, "fields": strings.Join(fields, ",")}
+	auditLog.Record(c, entry)
+
+	c.Header("ETag", newEtag)
+	if action == "create" {
+		c.JSON(http.StatusCreated, book)
+	} else {
+		c.JSON(http.StatusOK, book)
+	}
+}
+
+func bookHistory(c *gin.Context) {
+	id, ok := productIdParam(c)
+	if !ok {
+		return
+	}
+	records, err := history.For(id)
+	if err != nil {
+		log.Printf("read history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not read history"})
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminWrites(t *testing.T) {
+	dir := t.TempDir()
+	defer func(c *Catalog, h *History, token string) { catalog, history, adminToken = c, h, token }(catalog, history, adminToken)
+	var err error
+	if catalog, err = LoadCatalog(filepath.Join(dir, "catalog.json")); err != nil {
+		t.Fatal(err)
+	}
+	history = NewHistory(filepath.Join(dir, "history.jsonl"))
+	adminToken = "secret"
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerAdminRoutes(r)
+	etag := ""
+	do := func(method, path, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		// The end-user header is not verified, so changes are made by the
+		// holder of the admin token.
+		req.Header.Set("end-user", "alice")
+		if ifMatch == "current" {
+			ifMatch = etag
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code < 300 {
+			etag = w.Header().Get("ETag")
+		}
+		return w
+	}
+
+	book := `{"title":"Hamlet","author":"William Shakespeare","year":"1603","pageCount":150,"ISBN-10":"0486424618"}`
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"create", http.MethodPost, "/details/5", "", book, http.StatusCreated},
+		{"create again", http.MethodPost, "/details/5", "", book, http.StatusConflict},
+		{"create invalid", http.MethodPost, "/details/6", "", `{"author":"Nobody"}`, http.StatusUnprocessableEntity},
+		{"replace without If-Match", http.MethodPut, "/details/5", "", book, http.StatusPreconditionRequired},
+		{"replace with a stale ETag", http.MethodPut, "/details/5", `"0000"`, book, http.StatusPreconditionFailed},
+		{"replace", http.MethodPut, "/details/5", "current", strings.Replace(book, "150", "160", 1), http.StatusOK},
+		{"patch", http.MethodPatch, "/details/5", "current", `{"publisher":"Dover","year":null}`, http.StatusOK},
+		{"patch a missing book", http.MethodPatch, "/details/9", "*", `{"publisher":"Dover"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := do(tt.method, tt.path, tt.ifMatch, tt.body); w.Code != tt.status {
+			t.Errorf("%s: got %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.status)
+		}
+	}
+
+	got, _ := catalog.Get(5)
+	if got.Pages != 160 || got.Publisher != "Dover" || got.Year != "" || etag != Etag(got) {
+		t.Errorf("book 5 is %+v with ETag %s", got, etag)
+	}
+	if saved, _ := LoadCatalog(catalog.path); len(saved.List()) != 1 {
+		t.Errorf("saved catalog: %+v", saved.List())
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/details/5/history", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("history without credentials: got %d", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/details/5/history", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var records []HistoryRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, record := range records {
+		actions = append(actions, record.Action)
+	}
+	if strings.Join(actions, ",") != "create,replace,patch" || records[2].Who != "admin" || records[2].Etag != etag {
+		t.Errorf("history: %+v", records)
+	}
+	if diff := records[2].Diff; len(diff) != 2 || diff[0].Field != "publisher" || diff[1].Field != "year" {
+		t.Errorf("patch diff: %+v", diff)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/details/7", strings.NewReader(book))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without admin credentials: got %d", w.Code)
+	}
+}
+
+func TestCompareAndPutKeepsMemoryOnFailedSave(t *testing.T) {
+	c, err := LoadCatalog(filepath.Join(t.TempDir(), "missing", "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := BookInfo{Id: 1, Title: "Hamlet", Author: "William Shakespeare", Isbn10: "0486424618"}
+	if err := c.CompareAndPut(book, ""); err == nil {
+		t.Fatal("saved into a missing directory")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Error("the book is in memory although the save failed")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Catalog is the details book store. It is kept in memory and persisted as a
+// JSON array of BookInfo records so it can be edited by hand or filled by the
+// import subcommand.
+type Catalog struct {
+	mu     sync.RWMutex
+	saveMu sync.Mutex
+	path   string
+	books  map[int]BookInfo
+
+	listeners []func()
+}
+
+var (
+	ErrBookExists   = errors.New("book already exists")
+	ErrBookNotFound = errors.New("book not found")
+	ErrEtagMismatch = errors.New("etag does not match the current version")
+)
+
+var catalogFile string
+
+func init() {
+	value, ok := os.LookupEnv("CATALOG_FILE")
+	if !ok {
+		catalogFile = "catalog.json"
+	} else {
+		catalogFile = value
+	}
+}
+
+// LoadCatalog reads the catalog at path. A missing file yields an empty
+// catalog, which is saved on the first write.
+func LoadCatalog(path string) (*Catalog, error) {
+	catalog := &Catalog{path: path, books: make(map[int]BookInfo)}
+	if err := catalog.Reload(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Reload replaces the in-memory records with the content of the catalog file.
+func (c *Catalog) Reload() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	data, err := ioutil.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []BookInfo
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	books := make(map[int]BookInfo, len(list))
+	for _, book := range list {
+		books[book.Id] = book
+	}
+	c.mu.Lock()
+	c.books = books
+	c.mu.Unlock()
+	c.changed()
+	return nil
+}
+
+// OnChange registers fn to be called after every change to the catalog,
+// including reloads from disk.
+func (c *Catalog) OnChange(fn func()) {
+	c.mu.Lock()
+	c.listeners = append(c.listeners, fn)
+	c.mu.Unlock()
+}
+
+func (c *Catalog) changed() {
+	c.mu.RLock()
+	listeners := c.listeners
+	c.mu.RUnlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+func (c *Catalog) Get(id int) (BookInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	book, ok := c.books[id]
+	return book, ok
+}
+
+func (c *Catalog) Put(book BookInfo) {
+	c.mu.Lock()
+	c.books[book.Id] = book
+	c.mu.Unlock()
+	c.changed()
+}
+
+// CompareAndPut stores book and saves the catalog, but only if the current
+// version of the record has the given etag. An empty etag means the book must
+// not exist yet. The record changes in memory only once the catalog is on
+// disk, so a failed save leaves both as they were.
+func (c *Catalog) CompareAndPut(book BookInfo, etag string) error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.RLock()
+	current, ok := c.books[book.Id]
+	c.mu.RUnlock()
+	switch {
+	case etag == "" && ok:
+		return ErrBookExists
+	case etag != "" && !ok:
+		return ErrBookNotFound
+	case etag != "" && Etag(current) != etag:
+		return ErrEtagMismatch
+	}
+	list := c.List()
+	i := sort.Search(len(list), func(i int) bool { return list[i].Id >= book.Id })
+	if ok {
+		list[i] = book
+	} else {
+		list = append(list[:i], append([]BookInfo{book}, list[i:]...)...)
+	}
+	if err := c.write(list); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.books[book.Id] = book
+	c.mu.Unlock()
+	c.changed()
+	return nil
+}
+
+// Etag is a strong entity tag derived from the content of the record, so any
+// change to a book yields a new version.
+func Etag(book BookInfo) string {
+	data, _ := json.Marshal(book)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// List returns all books ordered by id.
+func (c *Catalog) List() []BookInfo {
+	c.mu.RLock()
+	list := make([]BookInfo, 0, len(c.books))
+	for _, book := range c.books {
+		list = append(list, book)
+	}
+	c.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// NextId returns an id that is not used by any book yet.
+func (c *Catalog) NextId() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	next := 0
+	for id := range c.books {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// Save writes the catalog back to disk.
+func (c *Catalog) Save() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	return c.write(c.List())
+}
+
+// write replaces the catalog file with list atomically, so a crash never
+// leaves a half written catalog behind. The caller holds saveMu.
+func (c *Catalog) write(list []BookInfo) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxCoverSize bounds the requested width and height so a single request can
+// not make details allocate an arbitrarily large image.
+const maxCoverSize = 2048
+
+// coverSizes are the widths and heights covers are rendered at. A requested
+// size is rounded up to the next one, so that only a few renditions of each
+// cover are ever cached, however many sizes are asked for.
+var coverSizes = []int{60, 120, 240, 480, 960, 1920}
+
+// coverSize rounds a requested width or height up to one of coverSizes. Zero
+// stays zero.
+func coverSize(n int) int {
+	if n == 0 {
+		return 0
+	}
+	for _, size := range coverSizes {
+		if n <= size {
+			return size
+		}
+	}
+	return coverSizes[len(coverSizes)-1]
+}
+
+var coversDir string
+var coverCacheDir string
+
+func init() {
+	value, ok := os.LookupEnv("COVERS_DIR")
+	if !ok {
+		coversDir = "covers"
+	} else {
+		coversDir = value
+	}
+	value, ok = os.LookupEnv("COVER_CACHE_DIR")
+	if !ok {
+		coverCacheDir = filepath.Join(os.TempDir(), "details-covers")
+	} else {
+		coverCacheDir = value
+	}
+}
+
+// CoverStore serves cover images kept as <productId>.jpg, .png or .gif in a
+// directory. Resized renditions are cached on disk, keyed by the size, the
+// output format and the modification time of the original.
+type CoverStore struct {
+	dir      string
+	cacheDir string
+}
+
+func NewCoverStore(dir, cacheDir string) *CoverStore {
+	return &CoverStore{dir: dir, cacheDir: cacheDir}
+}
+
+var errNoCover = errors.New("no cover image for this book")
+
+// original returns the path and file info of the cover of a product.
+func (s *CoverStore) original(id int) (string, os.FileInfo, error) {
+	for _, ext := range []string{".jpg", ".jpeg", ".png", ".gif"} {
+		path := filepath.Join(s.dir, strconv.Itoa(id)+ext)
+		if info, err := os.Stat(path); err == nil {
+			return path, info, nil
+		}
+	}
+	return "", nil, errNoCover
+}
+
+func (s *CoverStore) Has(id int) bool {
+	_, _, err := s.original(id)
+	return err == nil
+}
+
+// Key names the rendition of the cover of a product at a size and format,
+// which changes with the original. It is known without rendering, so that a
+// client holding the rendition can be answered right away.
+func (s *CoverStore) Key(id, width, height int, format string) (string, error) {
+	_, info, err := s.original(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d_%dx%d_%d.%s", id, width, height, info.ModTime().UnixNano(), format), nil
+}
+
+// Rendition returns the cover of a product scaled to fit in width x height
+// and encoded as format ("jpeg" or "png"). A zero width or height keeps the
+// aspect ratio of the original, both zero keeps its size. Width and height
+// are expected to be rounded by coverSize already.
+func (s *CoverStore) Rendition(id, width, height int, format string) ([]byte, string, error) {
+	path, _, err := s.original(id)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := s.Key(id, width, height, format)
+	if err != nil {
+		return nil, "", err
+	}
+	cached := filepath.Join(s.cacheDir, key)
+	if data, err := ioutil.ReadFile(cached); err == nil {
+		return data, key, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	dst := resize(src, width, height)
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, dst)
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := os.MkdirAll(s.cacheDir, 0755); err != nil {
+		log.Printf("cover cache: %v", err)
+	} else if err := writeFileAtomic(cached, buf.Bytes()); err != nil {
+		log.Printf("cover cache: %v", err)
+	}
+	return buf.Bytes(), key, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resize scales src to fit in width x height, keeping its aspect ratio. It
+// averages the covered source pixels when shrinking and interpolates
+// bilinearly when enlarging.
+func resize(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+	switch {
+	case width == 0 && height == 0:
+		width, height = sw, sh
+	case width == 0:
+		width = max1(sw * height / sh)
+	case height == 0:
+		height = max1(sh * width / sw)
+	default:
+		// fit inside the box
+		if sw*height > sh*width {
+			height = max1(sh * width / sw)
+		} else {
+			width = max1(sw * height / sh)
+		}
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	if width == sw && height == sh {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xScale := float64(sw) / float64(width)
+	yScale := float64(sh) / float64(height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			if xScale > 1 || yScale > 1 {
+				c = boxSample(rgba, int(float64(x)*xScale), int(float64(y)*yScale),
+					int(float64(x+1)*xScale), int(float64(y+1)*yScale))
+			} else {
+				c = bilinearSample(rgba, (float64(x)+0.5)*xScale-0.5, (float64(y)+0.5)*yScale-0.5)
+			}
+			dst.SetRGBA(x, y, c)
+		}
+	}
+	return dst
+}
+
+func boxSample(img *image.RGBA, x0, y0, x1, y1 int) color.RGBA {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	var r, g, b, a, n uint32
+	for y := y0; y < y1 && y < img.Rect.Max.Y; y++ {
+		for x := x0; x < x1 && x < img.Rect.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			r, g, b, a = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B), a+uint32(c.A)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)}
+}
+
+func bilinearSample(img *image.RGBA, fx, fy float64) color.RGBA {
+	maxX, maxY := img.Rect.Max.X-1, img.Rect.Max.Y-1
+	clamp := func(v, hi int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > hi {
+			return hi
+		}
+		return v
+	}
+	x0, y0 := int(fx), int(fy)
+	if fx < 0 {
+		x0 = -1
+	}
+	if fy < 0 {
+		y0 = -1
+	}
+	dx, dy := fx-float64(x0), fy-float64(y0)
+	c00 := img.RGBAAt(clamp(x0, maxX), clamp(y0, maxY))
+	c10 := img.RGBAAt(clamp(x0+1, maxX), clamp(y0, maxY))
+	c01 := img.RGBAAt(clamp(x0, maxX), clamp(y0+1, maxY))
+	c11 := img.RGBAAt(clamp(x0+1, maxX), clamp(y0+1, maxY))
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-dx) + float64(b)*dx
+		bottom := float64(c)*(1-dx) + float64(d)*dx
+		return uint8(top*(1-dy) + bottom*dy + 0.5)
+	}
+	return color.RGBA{
+		R: mix(c00.R, c10.R, c01.R, c11.R),
+		G: mix(c00.G, c10.G, c01.G, c11.G),
+		B: mix(c00.B, c10.B, c01.B, c11.B),
+		A: mix(c00.A, c10.A, c01.A, c11.A),
+	}
+}
+
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+var covers *CoverStore
+
+// coverFormat picks the output encoding: an explicit format parameter wins,
+// otherwise PNG is served to clients that ask for it and JPEG to everyone
+// else, which every browser that accepts WebP also accepts.
+func coverFormat(c *gin.Context) (string, bool) {
+	switch format := strings.ToLower(c.Query("format")); format {
+	case "jpeg", "jpg":
+		return "jpeg", true
+	case "png":
+		return "png", true
+	case "":
+		accept := c.GetHeader("Accept")
+		if strings.Contains(accept, "image/png") && !strings.Contains(accept, "image/jpeg") {
+			return "png", true
+		}
+		return "jpeg", true
+	default:
+		return "", false
+	}
+}
+
+func serveCover(c *gin.Context) {
+	id, ok := productIdParam(c)
+	if !ok {
+		return
+	}
+	size := func(name string) (int, bool) {
+		value := c.Query(name)
+		if value == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxCoverSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be between 0 and %d", name, maxCoverSize)})
+			return 0, false
+		}
+		return coverSize(n), true
+	}
+	width, ok := size("w")
+	if !ok {
+		return
+	}
+	height, ok := size("h")
+	if !ok {
+		return
+	}
+	format, ok := coverFormat(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jpeg or png"})
+		return
+	}
+
+	key, err := covers.Key(id, width, height, format)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	etag := `"` + key + `"`
+	if c.GetHeader("If-None-Match") == etag {
+		setCoverHeaders(c, etag)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	data, _, err := covers.Rendition(id, width, height, format)
+	if err != nil {
+		log.Printf("cover %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not render cover"})
+		return
+	}
+	setCoverHeaders(c, etag)
+	c.Data(http.StatusOK, "image/"+format, data)
+}
+
+func setCoverHeaders(c *gin.Context, etag string) {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Header("Vary", "Accept")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCoverSize(t *testing.T) {
+	for n, want := range map[int]int{0: 0, 1: 60, 60: 60, 61: 120, 240: 240, 300: 480, 2048: 1920} {
+		if got := coverSize(n); got != want {
+			t.Errorf("coverSize(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestServeCover(t *testing.T) {
+	dir, cacheDir := t.TempDir(), t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		img.Set(x, x/2, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "3.png"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *CoverStore) { covers = saved }(covers)
+	covers = NewCoverStore(dir, cacheDir)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/details/:productId/cover", serveCover)
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cached := func() int {
+		files, _ := os.ReadDir(cacheDir)
+		return len(files)
+	}
+
+	w := get("/details/3/cover?w=100&format=png", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	rendered, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := rendered.Bounds().Size(); size.X != 120 || size.Y != 60 {
+		t.Errorf("w=100 rendered at %v, want 120x60", size)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Sizes that round to the same one share the rendition.
+	if w := get("/details/3/cover?w=110&format=png", ""); w.Header().Get("ETag") != etag || cached() != 1 {
+		t.Errorf("w=110: ETag %s, %d cached renditions", w.Header().Get("ETag"), cached())
+	}
+	if w := get("/details/3/cover?w=120&format=png", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d", w.Code)
+	}
+
+	// A client that holds a rendition is answered without rendering it again.
+	key, _ := covers.Key(3, 240, 0, "jpeg")
+	if w := get("/details/3/cover?w=200&format=jpeg", `"`+key+`"`); w.Code != http.StatusNotModified || cached() != 1 {
+		t.Errorf("If-None-Match before rendering: got %d, %d cached renditions", w.Code, cached())
+	}
+
+	for path, status := range map[string]int{
+		"/details/3/cover?w=5000":     http.StatusBadRequest,
+		"/details/3/cover?format=gif": http.StatusBadRequest,
+		"/details/4/cover":            http.StatusNotFound,
+	} {
+		if w := get(path, ""); w.Code != status {
+			t.Errorf("%s: got %d, want %d", path, w.Code, status)
+		}
+	}
+}
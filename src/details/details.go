@@ -5,10 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+	"go-bookinfo.local/common/mtls"
+	"go-bookinfo.local/common/ratelimit"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -16,8 +23,27 @@ var (
 	addr = flag.String("addr", "localhost:9080", "the address to connect to")
 )
 
+// meshTLS is nil, leaving the services on plain HTTP, unless TLS_CERT_FILE
+// and TLS_KEY_FILE are set.
+var meshTLS = mtls.NewFromEnv()
+
+// jwtVerifier is nil, verifying nothing, unless JWT_JWKS_URL is set.
+var jwtVerifier = auth.NewJWTVerifierFromEnv(meshTLS.Transport("productpage"))
+
+// authorizer is nil, allowing every request, unless AUTHZ_POLICY_FILE is
+// set.
+var authorizer = auth.NewAuthorizerFromEnv()
+
+// rateLimiter is nil, limiting nothing, unless RATE_LIMIT_FILE is set.
+var rateLimiter = ratelimit.NewFromEnv()
+
+// auditLog is nil, leaving the entries to the service log, unless
+// AUDIT_LOG_DIR is set.
+var auditLog *audit.Log
+
 type BookInfo struct {
 	Id        int    `json:"id"`
+	Title     string `json:"title,omitempty"`
 	Author    string `json:"author"`
 	Year      string `json:"year"`
 	Type      string `json:"type"`
@@ -28,12 +54,28 @@ type BookInfo struct {
 	Isbn13    string `json:"ISBN-13"`
 }
 
+// bookResponse is a BookInfo as served by GET /details/:productId, with the
+// URL of the cover image when the book has one.
+type bookResponse struct {
+	BookInfo
+	Cover string `json:"cover,omitempty"`
+}
+
+func newBookResponse(book BookInfo) bookResponse {
+	response := bookResponse{BookInfo: book}
+	if covers.Has(book.Id) {
+		response.Cover = fmt.Sprintf("/details/%d/cover", book.Id)
+	}
+	return response
+}
+
 type IndustryIdentifiers struct {
 	Type       string `json:"type"`
 	Identifier string `json:"identifier"`
 }
 
 type VolumeInfo struct {
+	Title               string                `json:"title"`
 	Language            string                `json:"language"`
 	PrintType           string                `json:"printType"`
 	IndustryIdentifiers []IndustryIdentifiers `json:"industryIdentifiers"`
@@ -54,8 +96,34 @@ type BookVolumes struct {
 	Kind       string  `json:"kind"`
 }
 
+var catalog *Catalog
+
+var searchIndex = NewSearchIndex()
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
+	var err error
+	catalog, err = LoadCatalog(catalogFile)
+	if err != nil {
+		log.Fatalf("load catalog %s: %v", catalogFile, err)
+	}
+	catalog.OnChange(func() {
+		searchIndex.Rebuild(catalog.List())
+	})
+	searchIndex.Rebuild(catalog.List())
+	reloadOnSignal(catalog)
+	history = NewHistory(historyFile)
+	auditLog = audit.NewFromEnv("details")
+	covers = NewCoverStore(coversDir, coverCacheDir)
+
 	r := gin.Default()
+	r.Use(jwtVerifier.Middleware())
+	r.Use(rateLimiter.Middleware(ratelimit.TokenIdentity))
+	r.Use(authorizer.Middleware(mtls.PeerPrincipal))
+	r.GET("/metrics", rateLimiter.Metrics)
 	r.GET("/health", func(c *gin.Context) {
 		fmt.Println("health check")
 		c.JSON(http.StatusOK, gin.H{
@@ -65,6 +133,7 @@ func main() {
 	type Data struct {
 		ID int `uri:"productId"`
 	}
+	r.GET("/details/search", searchBooks)
 	r.GET("/details/:productId", func(c *gin.Context) {
 		var data Data
 		if err := c.ShouldBindUri(&data); err != nil {
@@ -72,6 +141,16 @@ func main() {
 			return
 		}
 		id := data.ID
+		if book, ok := catalog.Get(id); ok {
+			etag := Etag(book)
+			c.Header("ETag", etag)
+			if c.GetHeader("If-None-Match") == etag {
+				c.Status(http.StatusNotModified)
+				return
+			}
+			c.JSON(http.StatusOK, newBookResponse(book))
+			return
+		}
 		headers := getForwardHeaders(c.Request)
 
 		details, err := getBookDetails(id, headers)
@@ -89,24 +168,59 @@ func main() {
 			})
 			return
 		} else {
-			c.JSON(http.StatusOK, bookInfo)
+			c.JSON(http.StatusOK, newBookResponse(bookInfo))
 		}
 	})
+	r.GET("/details/:productId/cover", serveCover)
+	registerAdminRoutes(r)
 	http.TimeoutHandler(r, time.Second*5, "request time out")
 	log.Printf("args len: %v %s", len(os.Args), os.Args[0])
 	if len(os.Args) > 1 {
 		// load from Dockerfile
-		if err := r.Run(fmt.Sprintf("0.0.0.0:%s", os.Args[1])); err != nil {
+		if err := meshTLS.Run(r, fmt.Sprintf("0.0.0.0:%s", os.Args[1])); err != nil {
 			log.Fatal(err)
 		}
 	} else {
 		// for test
-		if err := r.Run(fmt.Sprintf("0.0.0.0:%s", "9081")); err != nil {
+		if err := meshTLS.Run(r, fmt.Sprintf("0.0.0.0:%s", "9081")); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
+func searchBooks(c *gin.Context) {
+	query := c.Query("q")
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide a search query"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be numeric"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":   query,
+		"results": searchIndex.Search(query, limit),
+	})
+}
+
+// reloadOnSignal re-reads the catalog file on SIGHUP, so the catalog can be
+// replaced on disk (for example by `details import`) without a restart.
+func reloadOnSignal(catalog *Catalog) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := catalog.Reload(); err != nil {
+				log.Printf("reload catalog: %v", err)
+			} else {
+				log.Printf("catalog reloaded from %s", catalogFile)
+			}
+		}
+	}()
+}
+
 func getBookDetails(id int, headers map[string][]string) (string, error) {
 	if os.Getenv("ENABLE_EXTERNAL_BOOK_SERVICE") == "false" {
 		isbn := "0486424618"
@@ -172,6 +286,7 @@ func fetchDetailsFromExternalService(isbn string, id int, headers map[string][]s
 	isbn13 := getIsbn(book, "ISBN_13")
 
 	var bookInfo = BookInfo{id,
+		book.Title,
 		book.Authors[0],
 		book.PublishedDate,
 		bookType,
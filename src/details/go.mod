@@ -2,7 +2,10 @@ module go-bookinfo/details
 
 go 1.17
 
-require github.com/gin-gonic/gin v1.8.2
+require (
+	github.com/gin-gonic/gin v1.8.2
+	go-bookinfo.local/common v0.0.0
+)
 
 require (
 	github.com/gin-contrib/sse v0.1.0 // indirect
@@ -24,3 +27,5 @@ require (
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace go-bookinfo.local/common => ../common
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is the audit trail entry written for every change made
+// through the admin API.
+type HistoryRecord struct {
+	ProductId int           `json:"productId"`
+	Action    string        `json:"action"`
+	Who       string        `json:"who"`
+	When      time.Time     `json:"when"`
+	Etag      string        `json:"etag"`
+	Diff      []FieldChange `json:"diff"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// History is an append-only JSON lines file of HistoryRecord entries.
+type History struct {
+	mu   sync.Mutex
+	path string
+}
+
+var historyFile string
+
+func init() {
+	value, ok := os.LookupEnv("HISTORY_FILE")
+	if !ok {
+		historyFile = "history.jsonl"
+	} else {
+		historyFile = value
+	}
+}
+
+func NewHistory(path string) *History {
+	return &History{path: path}
+}
+
+func (h *History) Append(record HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// For returns the records of one product, oldest first.
+func (h *History) For(productId int) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := []HistoryRecord{}
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		if record.ProductId == productId {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// diffBooks lists the JSON fields that differ between two versions of a book.
+func diffBooks(before, after BookInfo) []FieldChange {
+	prev, next := bookFields(before), bookFields(after)
+	keys := make(map[string]bool)
+	for k := range prev {
+		keys[k] = true
+	}
+	for k := range next {
+		keys[k] = true
+	}
+	fields := make([]string, 0, len(keys))
+	for k := range keys {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if !reflect.DeepEqual(prev[field], next[field]) {
+			changes = append(changes, FieldChange{Field: field, Old: prev[field], New: next[field]})
+		}
+	}
+	return changes
+}
+
+func bookFields(book BookInfo) map[string]interface{} {
+	fields := make(map[string]interface{})
+	data, _ := json.Marshal(book)
+	json.Unmarshal(data, &fields)
+	return fields
+}
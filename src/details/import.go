@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// importRow is a single record read from an import source. Row is the line
+// (CSV) or product position (ONIX) used in the error report.
+type importRow struct {
+	Row  int
+	Book BookInfo
+	Err  error
+}
+
+// runImport implements `details import [flags] <file>`. Valid rows are written
+// to the catalog, invalid rows are reported and skipped. A row with the id of
+// an earlier row is rejected, and so is one with the id of a book already in
+// the catalog unless -overwrite is given. The exit status is non-zero when at
+// least one row was rejected.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "input format: csv or onix (default: from file extension)")
+	path := fs.String("catalog", catalogFile, "catalog file to write to")
+	dryRun := fs.Bool("dry-run", false, "validate the input without writing the catalog")
+	overwrite := fs.Bool("overwrite", false, "replace catalog entries that have the id of an imported row")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: details import [-format csv|onix] [-catalog file] [-dry-run] [-overwrite] <file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	source := fs.Arg(0)
+	if *format == "" {
+		*format = importFormat(source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	catalog, err := LoadCatalog(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load catalog %s: %v\n", *path, err)
+		return 1
+	}
+
+	imported, failed := 0, 0
+	// rowOf remembers the row each id was imported from, so that a second
+	// row with the same id is reported instead of replacing the first.
+	rowOf := make(map[int]int)
+	report := func(r importRow) {
+		if r.Err == nil {
+			r.Err = validateBook(r.Book)
+		}
+		if r.Err == nil && r.Book.Id >= 0 {
+			if row, ok := rowOf[r.Book.Id]; ok {
+				r.Err = fmt.Errorf("duplicate id %d, already imported from row %d", r.Book.Id, row)
+			} else if _, ok := catalog.Get(r.Book.Id); ok && !*overwrite {
+				r.Err = fmt.Errorf("id %d is already in the catalog, use -overwrite to replace it", r.Book.Id)
+			}
+		}
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "row %d: %v\n", r.Row, r.Err)
+			return
+		}
+		if r.Book.Id < 0 {
+			r.Book.Id = catalog.NextId()
+		}
+		rowOf[r.Book.Id] = r.Row
+		catalog.Put(r.Book)
+		imported++
+	}
+
+	switch *format {
+	case "csv":
+		err = readCSV(f, report)
+	case "onix":
+		err = readONIX(f, report)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import %s: %v\n", source, err)
+		return 1
+	}
+
+	if *dryRun {
+		fmt.Printf("dry run: %d valid, %d rejected\n", imported, failed)
+	} else {
+		if err := catalog.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "save catalog %s: %v\n", *path, err)
+			return 1
+		}
+		fmt.Printf("imported %d, rejected %d\n", imported, failed)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func importFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xml", ".onix":
+		return "onix"
+	default:
+		return "csv"
+	}
+}
+
+// validateBook checks the fields every catalog entry must have.
+func validateBook(book BookInfo) error {
+	if book.Title == "" {
+		return errors.New("missing title")
+	}
+	if book.Author == "" {
+		return errors.New("missing author")
+	}
+	if book.Isbn10 == "" && book.Isbn13 == "" {
+		return errors.New("missing ISBN")
+	}
+	if book.Isbn10 != "" && !validIsbn10(book.Isbn10) {
+		return fmt.Errorf("invalid ISBN-10 %q", book.Isbn10)
+	}
+	if book.Isbn13 != "" && !validIsbn13(book.Isbn13) {
+		return fmt.Errorf("invalid ISBN-13 %q", book.Isbn13)
+	}
+	if book.Pages < 0 {
+		return fmt.Errorf("invalid page count %d", book.Pages)
+	}
+	return nil
+}
+
+func normalizeIsbn(isbn string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, isbn)
+}
+
+func validIsbn10(isbn string) bool {
+	isbn = normalizeIsbn(isbn)
+	if len(isbn) != 10 {
+		return false
+	}
+	sum := 0
+	for i, r := range isbn {
+		var digit int
+		switch {
+		case r >= '0' && r <= '9':
+			digit = int(r - '0')
+		case (r == 'X' || r == 'x') && i == 9:
+			digit = 10
+		default:
+			return false
+		}
+		sum += digit * (10 - i)
+	}
+	return sum%11 == 0
+}
+
+func validIsbn13(isbn string) bool {
+	isbn = normalizeIsbn(isbn)
+	if len(isbn) != 13 {
+		return false
+	}
+	sum := 0
+	for i, r := range isbn {
+		if r < '0' || r > '9' {
+			return false
+		}
+		digit := int(r - '0')
+		if i%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// readCSV reads books from a CSV file with a header row. Recognised columns
+// are id, title, author, year, type, pages, publisher, language, isbn10 and
+// isbn13; unknown columns are ignored. Rows without an id get the next free
+// one.
+func readCSV(r io.Reader, emit func(importRow)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.NewReplacer("-", "", "_", "", " ", "").Replace(name)
+		columns[name] = i
+	}
+	if _, ok := columns["authors"]; ok {
+		columns["author"] = columns["authors"]
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				emit(importRow{Row: line, Err: parseErr.Err})
+				continue
+			}
+			return err
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		row := importRow{Row: line, Book: BookInfo{
+			Id:        -1,
+			Title:     field("title"),
+			Author:    field("author"),
+			Year:      field("year"),
+			Type:      field("type"),
+			Publisher: field("publisher"),
+			Language:  field("language"),
+			Isbn10:    field("isbn10"),
+			Isbn13:    field("isbn13"),
+		}}
+		if id := field("id"); id != "" {
+			if row.Book.Id, err = strconv.Atoi(id); err != nil {
+				row.Err = fmt.Errorf("invalid id %q", id)
+			}
+		}
+		if pages := field("pages"); pages != "" && row.Err == nil {
+			if row.Book.Pages, err = strconv.Atoi(pages); err != nil {
+				row.Err = fmt.Errorf("invalid page count %q", pages)
+			}
+		}
+		emit(row)
+	}
+}
+
+// onixProduct is the subset of an ONIX 3.0 (reference tags) <Product> that
+// maps onto BookInfo.
+type onixProduct struct {
+	RecordReference   string `xml:"RecordReference"`
+	ProductIdentifier []struct {
+		Type  string `xml:"ProductIDType"`
+		Value string `xml:"IDValue"`
+	} `xml:"ProductIdentifier"`
+	DescriptiveDetail struct {
+		ProductForm string `xml:"ProductForm"`
+		TitleDetail []struct {
+			TitleType    string `xml:"TitleType"`
+			TitleElement []struct {
+				TitleText    string `xml:"TitleText"`
+				TitlePrefix  string `xml:"TitlePrefix"`
+				TitleWithout string `xml:"TitleWithoutPrefix"`
+			} `xml:"TitleElement"`
+		} `xml:"TitleDetail"`
+		Contributor []struct {
+			Role           string `xml:"ContributorRole"`
+			PersonName     string `xml:"PersonName"`
+			CorporateName  string `xml:"CorporateName"`
+			NamesBeforeKey string `xml:"NamesBeforeKey"`
+			KeyNames       string `xml:"KeyNames"`
+		} `xml:"Contributor"`
+		Language []struct {
+			Role string `xml:"LanguageRole"`
+			Code string `xml:"LanguageCode"`
+		} `xml:"Language"`
+		Extent []struct {
+			Type  string `xml:"ExtentType"`
+			Value string `xml:"ExtentValue"`
+		} `xml:"Extent"`
+	} `xml:"DescriptiveDetail"`
+	PublishingDetail struct {
+		Publisher []struct {
+			Name string `xml:"PublisherName"`
+		} `xml:"Publisher"`
+		PublishingDate []struct {
+			Role string `xml:"PublishingDateRole"`
+			Date string `xml:"Date"`
+		} `xml:"PublishingDate"`
+	} `xml:"PublishingDetail"`
+}
+
+// readONIX streams <Product> records out of an ONIX 3.0 message, so large
+// feeds are never held in memory as a whole.
+func readONIX(r io.Reader, emit func(importRow)) error {
+	decoder := xml.NewDecoder(r)
+	position := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Product" {
+			continue
+		}
+		position++
+		var product onixProduct
+		if err := decoder.DecodeElement(&product, &start); err != nil {
+			emit(importRow{Row: position, Err: err})
+			continue
+		}
+		emit(importRow{Row: position, Book: product.book()})
+	}
+}
+
+func (p onixProduct) book() BookInfo {
+	book := BookInfo{Id: -1}
+	if id, err := strconv.Atoi(strings.TrimSpace(p.RecordReference)); err == nil {
+		book.Id = id
+	}
+	for _, identifier := range p.ProductIdentifier {
+		switch identifier.Type {
+		case "02":
+			book.Isbn10 = strings.TrimSpace(identifier.Value)
+		case "15":
+			book.Isbn13 = strings.TrimSpace(identifier.Value)
+		}
+	}
+
+	detail := p.DescriptiveDetail
+	for _, title := range detail.TitleDetail {
+		// 01: distinctive title
+		if title.TitleType != "01" || len(title.TitleElement) == 0 {
+			continue
+		}
+		element := title.TitleElement[0]
+		if element.TitleText != "" {
+			book.Title = element.TitleText
+		} else {
+			book.Title = strings.TrimSpace(element.TitlePrefix + " " + element.TitleWithout)
+		}
+		break
+	}
+	var authors []string
+	for _, contributor := range detail.Contributor {
+		// A01: by (author)
+		if contributor.Role != "A01" {
+			continue
+		}
+		name := contributor.PersonName
+		if name == "" && contributor.KeyNames != "" {
+			name = strings.TrimSpace(contributor.NamesBeforeKey + " " + contributor.KeyNames)
+		}
+		if name == "" {
+			name = contributor.CorporateName
+		}
+		if name != "" {
+			authors = append(authors, strings.TrimSpace(name))
+		}
+	}
+	book.Author = strings.Join(authors, ", ")
+	book.Type = onixProductForm(detail.ProductForm)
+	for _, language := range detail.Language {
+		if language.Role == "01" {
+			book.Language = onixLanguage(language.Code)
+		}
+	}
+	for _, extent := range detail.Extent {
+		// 00: main content page count
+		if extent.Type == "00" {
+			book.Pages, _ = strconv.Atoi(strings.TrimSpace(extent.Value))
+		}
+	}
+
+	publishing := p.PublishingDetail
+	if len(publishing.Publisher) > 0 {
+		book.Publisher = publishing.Publisher[0].Name
+	}
+	for _, date := range publishing.PublishingDate {
+		// 01: publication date, formatted YYYYMMDD
+		if date.Role == "01" && len(date.Date) >= 4 {
+			book.Year = date.Date[:4]
+		}
+	}
+	return book
+}
+
+func onixProductForm(form string) string {
+	switch form {
+	case "BC":
+		return "paperback"
+	case "BB":
+		return "hardcover"
+	case "EA", "EB", "EC", "ED":
+		return "ebook"
+	default:
+		return "unknown"
+	}
+}
+
+func onixLanguage(code string) string {
+	switch strings.ToLower(code) {
+	case "eng", "en":
+		return "English"
+	default:
+		return code
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsbnChecksum(t *testing.T) {
+	if !validIsbn10("0-486-42461-8") {
+		t.Error("0-486-42461-8 should be a valid ISBN-10")
+	}
+	if validIsbn10("1234567890") {
+		t.Error("1234567890 should not be a valid ISBN-10")
+	}
+	if !validIsbn13("978-0486424613") {
+		t.Error("978-0486424613 should be a valid ISBN-13")
+	}
+	if validIsbn13("123-1234567890") {
+		t.Error("123-1234567890 should not be a valid ISBN-13")
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	input := `id,title,author,year,pages,ISBN-10,ISBN-13
+1,The Comedy of Errors,William Shakespeare,1595,200,0486424618,9780486424613
+,Hamlet,William Shakespeare,1603,abc,,9780486424613
+3,,Nobody,2000,10,0486424618,
+`
+	var rows []importRow
+	if err := readCSV(strings.NewReader(input), func(r importRow) {
+		if r.Err == nil {
+			r.Err = validateBook(r.Book)
+		}
+		rows = append(rows, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Book.Id != 1 || rows[0].Book.Pages != 200 {
+		t.Errorf("row 2: unexpected result %+v", rows[0])
+	}
+	if rows[1].Err == nil || rows[1].Row != 3 {
+		t.Errorf("row 3: expected page count error, got %+v", rows[1])
+	}
+	if rows[2].Err == nil || rows[2].Err.Error() != "missing title" {
+		t.Errorf("row 4: expected missing title, got %v", rows[2].Err)
+	}
+}
+
+func TestReadONIX(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">
+  <Header><Sender><SenderName>Test</SenderName></Sender></Header>
+  <Product>
+    <RecordReference>7</RecordReference>
+    <ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780486424613</IDValue></ProductIdentifier>
+    <DescriptiveDetail>
+      <ProductForm>BC</ProductForm>
+      <TitleDetail>
+        <TitleType>01</TitleType>
+        <TitleElement><TitleElementLevel>01</TitleElementLevel><TitleText>The Comedy of Errors</TitleText></TitleElement>
+      </TitleDetail>
+      <Contributor><ContributorRole>A01</ContributorRole><PersonName>William Shakespeare</PersonName></Contributor>
+      <Language><LanguageRole>01</LanguageRole><LanguageCode>eng</LanguageCode></Language>
+      <Extent><ExtentType>00</ExtentType><ExtentValue>64</ExtentValue><ExtentUnit>03</ExtentUnit></Extent>
+    </DescriptiveDetail>
+    <PublishingDetail>
+      <Publisher><PublishingRole>01</PublishingRole><PublisherName>Dover</PublisherName></Publisher>
+      <PublishingDate><PublishingDateRole>01</PublishingDateRole><Date>20021119</Date></PublishingDate>
+    </PublishingDetail>
+  </Product>
+</ONIXMessage>`
+	var rows []importRow
+	if err := readONIX(strings.NewReader(input), func(r importRow) { rows = append(rows, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("got %d products, want 1", len(rows))
+	}
+	want := BookInfo{Id: 7, Title: "The Comedy of Errors", Author: "William Shakespeare", Year: "2002",
+		Type: "paperback", Pages: 64, Publisher: "Dover", Language: "English", Isbn13: "9780486424613"}
+	if rows[0].Book != want {
+		t.Errorf("got %+v, want %+v", rows[0].Book, want)
+	}
+	if err := validateBook(rows[0].Book); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportDuplicateIds(t *testing.T) {
+	dir := t.TempDir()
+	catalogPath := filepath.Join(dir, "catalog.json")
+	source := filepath.Join(dir, "books.csv")
+	write := func(input string) {
+		if err := os.WriteFile(source, []byte(input), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`id,title,author,year,pages,ISBN-10,ISBN-13
+1,The Comedy of Errors,William Shakespeare,1595,200,0486424618,
+1,Hamlet,William Shakespeare,1603,150,0486424618,
+`)
+	if status := runImport([]string{"-catalog", catalogPath, source}); status != 1 {
+		t.Errorf("duplicate id in the file: exit status %d, want 1", status)
+	}
+	catalog, err := LoadCatalog(catalogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book, _ := catalog.Get(1); book.Title != "The Comedy of Errors" {
+		t.Errorf("book 1 is %q, want the first row", book.Title)
+	}
+
+	write(`id,title,author,year,pages,ISBN-10,ISBN-13
+1,Hamlet,William Shakespeare,1603,150,0486424618,
+`)
+	if status := runImport([]string{"-catalog", catalogPath, source}); status != 1 {
+		t.Errorf("id in the catalog: exit status %d, want 1", status)
+	}
+	if status := runImport([]string{"-catalog", catalogPath, "-overwrite", source}); status != 0 {
+		t.Errorf("id in the catalog with -overwrite: exit status %d, want 0", status)
+	}
+	catalog, _ = LoadCatalog(catalogPath)
+	if book, _ := catalog.Get(1); book.Title != "Hamlet" {
+		t.Errorf("book 1 is %q after -overwrite, want Hamlet", book.Title)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	dir := t.TempDir()
+	catalogPath := filepath.Join(dir, "catalog.json")
+	source := filepath.Join(dir, "books.csv")
+	if err := os.WriteFile(source, []byte(`id,title,author,year,pages,ISBN-10,ISBN-13
+1,The Comedy of Errors,William Shakespeare,1595,200,0486424618,
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := runImport([]string{"-catalog", catalogPath, source}); status != 0 {
+		t.Fatalf("import: exit status %d, want 0", status)
+	}
+	before, err := os.ReadFile(catalogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two new books, one without a title and one already in the catalog.
+	if err := os.WriteFile(source, []byte(`id,title,author,year,pages,ISBN-10,ISBN-13
+2,Hamlet,William Shakespeare,1603,150,0486424618,
+,Macbeth,William Shakespeare,1606,120,,9780486424613
+4,,Nobody,2000,10,0486424618,
+1,Othello,William Shakespeare,1603,140,0486424618,
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var status int
+	output := captureStdout(t, func() {
+		status = runImport([]string{"-catalog", catalogPath, "-dry-run", source})
+	})
+	if status != 1 {
+		t.Errorf("exit status %d, want 1", status)
+	}
+	if !strings.Contains(output, "dry run: 2 valid, 2 rejected\n") {
+		t.Errorf("summary: %q", output)
+	}
+	after, err := os.ReadFile(catalogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("dry run changed the catalog:\n%s", after)
+	}
+}
+
+// captureStdout returns what fn writes to standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stdout = saved }(os.Stdout)
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
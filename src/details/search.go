@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// searchFields are the indexed BookInfo fields and the weight a match in each
+// of them contributes to the score.
+var searchFields = map[string]float64{
+	"title":     3,
+	"author":    2,
+	"publisher": 1,
+	"isbn":      3,
+}
+
+// Scores of the different ways a query term can match an indexed term.
+const (
+	exactMatch  = 1.0
+	prefixMatch = 0.6
+	fuzzyMatch  = 0.3
+)
+
+type posting struct {
+	id    int
+	field string
+}
+
+// SearchIndex is an inverted index over the catalog. It is rebuilt from
+// scratch whenever the catalog changes, which is cheap at the catalog sizes
+// details is used with.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	books    map[int]BookInfo
+	postings map[string][]posting
+	terms    []string // sorted, for prefix lookups
+}
+
+type SearchResult struct {
+	Score float64  `json:"score"`
+	Book  BookInfo `json:"book"`
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{books: map[int]BookInfo{}, postings: map[string][]posting{}}
+}
+
+func (s *SearchIndex) Rebuild(books []BookInfo) {
+	byId := make(map[int]BookInfo, len(books))
+	postings := make(map[string][]posting)
+	add := func(id int, field string, terms []string) {
+		for _, term := range terms {
+			postings[term] = append(postings[term], posting{id: id, field: field})
+		}
+	}
+	for _, book := range books {
+		byId[book.Id] = book
+		add(book.Id, "title", tokenize(book.Title))
+		add(book.Id, "author", tokenize(book.Author))
+		add(book.Id, "publisher", tokenize(book.Publisher))
+		for _, isbn := range []string{book.Isbn10, book.Isbn13} {
+			if isbn != "" {
+				add(book.Id, "isbn", []string{strings.ToLower(normalizeIsbn(isbn))})
+			}
+		}
+	}
+	terms := make([]string, 0, len(postings))
+	for term := range postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	s.mu.Lock()
+	s.books, s.postings, s.terms = byId, postings, terms
+	s.mu.Unlock()
+}
+
+// Search evaluates a query of whitespace separated terms. Every term has to
+// match a book for it to be returned. A term may be scoped to one field with
+// `field:term` (title, author, publisher, isbn), and a trailing `*` restricts
+// it to prefix matching. Unscoped terms match exactly, by prefix, or within a
+// small edit distance, in decreasing order of score.
+func (s *SearchIndex) Search(query string, limit int) []SearchResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var scores map[int]float64
+	for _, raw := range strings.Fields(query) {
+		field := ""
+		if i := strings.IndexByte(raw, ':'); i > 0 {
+			if _, ok := searchFields[strings.ToLower(raw[:i])]; ok {
+				field, raw = strings.ToLower(raw[:i]), raw[i+1:]
+			}
+		}
+		prefixOnly := strings.HasSuffix(raw, "*")
+		raw = strings.TrimSuffix(raw, "*")
+		terms := tokenize(raw)
+		if isbn := normalizeIsbn(raw); field == "isbn" || looksLikeIsbn(isbn) {
+			terms = []string{strings.ToLower(isbn)}
+		}
+		for _, term := range terms {
+			termScores := s.matchTerm(term, field, prefixOnly)
+			if scores == nil {
+				scores = termScores
+				continue
+			}
+			for id := range scores {
+				if score, ok := termScores[id]; ok {
+					scores[id] += score
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{Score: math.Round(score*100) / 100, Book: s.books[id]})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Book.Id < results[j].Book.Id
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// matchTerm returns the best score of every book matching term.
+func (s *SearchIndex) matchTerm(term, field string, prefixOnly bool) map[int]float64 {
+	scores := make(map[int]float64)
+	collect := func(indexed string, match float64) {
+		for _, p := range s.postings[indexed] {
+			if field != "" && p.field != field {
+				continue
+			}
+			if score := match * searchFields[p.field]; score > scores[p.id] {
+				scores[p.id] = score
+			}
+		}
+	}
+
+	if !prefixOnly {
+		collect(term, exactMatch)
+	}
+	for i := sort.SearchStrings(s.terms, term); i < len(s.terms) && strings.HasPrefix(s.terms[i], term); i++ {
+		if s.terms[i] != term {
+			collect(s.terms[i], prefixMatch)
+		}
+	}
+	if prefixOnly {
+		return scores
+	}
+	if maxDistance := fuzziness(term); maxDistance > 0 {
+		for _, indexed := range s.terms {
+			if indexed != term && editDistance(term, indexed, maxDistance) <= maxDistance {
+				collect(indexed, fuzzyMatch)
+			}
+		}
+	}
+	return scores
+}
+
+// fuzziness is the edit distance tolerated for a term of the given length.
+func fuzziness(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the Levenshtein distance between a and b. It gives up once
+// the distance is known to exceed max and returns max+1.
+func editDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func looksLikeIsbn(s string) bool {
+	if len(s) != 10 && len(s) != 13 {
+		return false
+	}
+	for i, r := range s {
+		if !unicode.IsDigit(r) && !(i == 9 && (r == 'X' || r == 'x')) {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
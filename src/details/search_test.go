@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSearchIndex(t *testing.T) {
+	index := NewSearchIndex()
+	index.Rebuild([]BookInfo{
+		{Id: 0, Title: "The Comedy of Errors", Author: "William Shakespeare", Publisher: "Dover", Isbn13: "978-0486424613"},
+		{Id: 1, Title: "Hamlet", Author: "William Shakespeare", Publisher: "Penguin"},
+		{Id: 2, Title: "Pride and Prejudice", Author: "Jane Austen", Publisher: "Penguin"},
+	})
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"shakespeare", []int{0, 1}},
+		{"shakespaere", []int{0, 1}},
+		{"ham*", []int{1}},
+		{"author:austen", []int{2}},
+		{"title:penguin", nil},
+		{"penguin prejudice", []int{2}},
+		{"9780486424613", []int{0}},
+		{"comedy", []int{0}},
+	}
+	for _, tt := range tests {
+		results := index.Search(tt.query, 0)
+		var got []int
+		for _, r := range results {
+			got = append(got, r.Book.Id)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchRanksExactAboveFuzzy(t *testing.T) {
+	index := NewSearchIndex()
+	index.Rebuild([]BookInfo{
+		{Id: 0, Title: "Hamlet", Author: "A"},
+		{Id: 1, Title: "Hamlets", Author: "B"},
+	})
+	results := index.Search("hamlets", 0)
+	if len(results) != 2 || results[0].Book.Id != 1 {
+		t.Errorf("expected the exact match first, got %+v", results)
+	}
+}
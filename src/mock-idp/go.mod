@@ -0,0 +1,3 @@
+module go-bookinfo/mock-idp
+
+go 1.17
@@ -0,0 +1,394 @@
+// mock-idp is a minimal OpenID Connect provider for trying single sign on
+// in productpage offline. It supports the authorization code flow with
+// PKCE, signs ID tokens with a fresh RSA key and lets you pick who to sign
+// in as from a list of users:
+//
+//	mock-idp -addr :9180 -client-id bookinfo -client-secret s3cret \
+//	    -users jason:admin,alice
+//
+// and productpage with
+//
+//	OIDC_ISSUER=http://localhost:9180 OIDC_CLIENT_ID=bookinfo \
+//	OIDC_CLIENT_SECRET=s3cret OIDC_REDIRECT_URL=http://localhost:9080/oidc/callback
+//
+// Nothing is persisted and there are no passwords; do not use it for
+// anything but testing.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// codeLifetime is how long an authorization code can be redeemed.
+const codeLifetime = time.Minute
+
+type user struct {
+	Name  string
+	Roles []string
+}
+
+// grant is what an authorization code, and later its access token, stands
+// for.
+type grant struct {
+	user        user
+	clientId    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	expires     time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURI  string
+	users        map[string]user
+	key          *rsa.PrivateKey
+	kid          string
+	tokenTTL     time.Duration
+
+	mu     sync.Mutex
+	codes  map[string]*grant
+	tokens map[string]*grant
+}
+
+func main() {
+	addr := flag.String("addr", ":9180", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9180", "issuer URL, as clients reach it")
+	clientId := flag.String("client-id", "bookinfo", "the client allowed to sign in")
+	clientSecret := flag.String("client-secret", "", "secret of the client, empty for a public client")
+	redirectURI := flag.String("redirect-uri", "", "the only redirect URI accepted, empty accepts any")
+	userList := flag.String("users", "jason:admin,alice,bob", "comma separated users, each optionally with :role+role")
+	ttl := flag.Duration("token-ttl", time.Hour, "lifetime of ID and access tokens")
+	flag.Parse()
+
+	p, err := newProvider(strings.TrimSuffix(*issuer, "/"), *clientId, *clientSecret, *redirectURI, parseUsers(*userList), *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("issuer %s listening on %s", p.issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p.routes()))
+}
+
+// parseUsers reads "name:role+role,name" lists.
+func parseUsers(list string) map[string]user {
+	users := make(map[string]user)
+	for _, entry := range strings.Split(list, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if fields[0] == "" {
+			continue
+		}
+		u := user{Name: fields[0]}
+		if len(fields) == 2 && fields[1] != "" {
+			u.Roles = strings.Split(fields[1], "+")
+		}
+		users[u.Name] = u
+	}
+	return users
+}
+
+func newProvider(issuer, clientId, clientSecret, redirectURI string, users map[string]user, ttl time.Duration) (*provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &provider{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+		users:        users,
+		key:          key,
+		kid:          randomString(8),
+		tokenTTL:     ttl,
+		codes:        make(map[string]*grant),
+		tokens:       make(map[string]*grant),
+	}, nil
+}
+
+func (p *provider) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", p.userinfo)
+	mux.HandleFunc("/jwks", p.jwks)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// oauthError answers the token endpoint with an RFC 6749 error.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	log.Printf("token: %s: %s", code, description)
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"userinfo_endpoint":                     p.issuer + "/userinfo",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   b64(p.key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+var chooser = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><title>mock-idp</title></head>
+<body>
+<h3>Sign in to {{ .Client }} as</h3>
+<form method="post" action="/authorize">
+{{ range $name, $value := .Params }}<input type="hidden" name="{{ $name }}" value="{{ $value }}">
+{{ end }}{{ range .Users }}<p><button type="submit" name="user" value="{{ .Name }}">{{ .Name }}</button>{{ with .Roles }} ({{ range . }}{{ . }} {{ end }}){{ end }}</p>
+{{ end }}</form>
+</body></html>
+`))
+
+// authorize shows the list of users on GET and, on POST, sends the browser
+// back to the client with a code for the chosen user.
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := map[string]string{}
+	for _, name := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		params[name] = r.Form.Get(name)
+	}
+	// Errors about the client or the redirect URI are shown here rather
+	// than sent to a redirect URI that cannot be trusted.
+	if params["client_id"] != p.clientId {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(params["redirect_uri"])
+	if err != nil || !redirect.IsAbs() || (p.redirectURI != "" && params["redirect_uri"] != p.redirectURI) {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	fail := func(code, description string) {
+		query := redirect.Query()
+		query.Set("error", code)
+		query.Set("error_description", description)
+		query.Set("state", params["state"])
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	}
+	switch {
+	case params["response_type"] != "code":
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	case !strings.Contains(" "+params["scope"]+" ", " openid "):
+		fail("invalid_scope", "the openid scope is required")
+		return
+	case params["code_challenge"] == "" || params["code_challenge_method"] != "S256":
+		fail("invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		var list []user
+		for _, u := range p.users {
+			list = append(list, u)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooser.Execute(w, map[string]interface{}{"Client": p.clientId, "Params": params, "Users": list})
+		return
+	}
+	u, ok := p.users[r.PostForm.Get("user")]
+	if !ok {
+		fail("access_denied", "unknown user")
+		return
+	}
+
+	code := randomString(24)
+	p.mu.Lock()
+	p.codes[code] = &grant{
+		user:        u,
+		clientId:    params["client_id"],
+		redirectURI: params["redirect_uri"],
+		nonce:       params["nonce"],
+		challenge:   params["code_challenge"],
+		expires:     time.Now().Add(codeLifetime),
+	}
+	p.mu.Unlock()
+	log.Printf("authorize: %s signed in to %s", u.Name, params["client_id"])
+
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", params["state"])
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token redeems a code for an ID token and an access token. Codes are
+// single use, and the PKCE verifier has to match the challenge.
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientId, secret, basic := r.BasicAuth()
+	if basic {
+		clientId, _ = url.QueryUnescape(clientId)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != p.clientId || subtle.ConstantTimeCompare([]byte(secret), []byte(p.clientSecret)) != 1 {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	switch {
+	case !ok || time.Now().After(g.expires):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case g.clientId != clientId || g.redirectURI != r.PostForm.Get("redirect_uri"):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the code was issued to another client or redirect URI")
+		return
+	case !pkceMatches(r.PostForm.Get("code_verifier"), g.challenge):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the code verifier does not match the challenge")
+		return
+	}
+
+	now := time.Now()
+	idToken, err := p.sign(map[string]interface{}{
+		"iss":                p.issuer,
+		"sub":                g.user.Name,
+		"aud":                clientId,
+		"azp":                clientId,
+		"iat":                now.Unix(),
+		"exp":                now.Add(p.tokenTTL).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.user.Name,
+	})
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken := randomString(32)
+	g.expires = now.Add(p.tokenTTL)
+	p.mu.Lock()
+	p.tokens[accessToken] = g
+	p.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(p.tokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func pkceMatches(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// userinfo returns the profile of the user an access token was issued to.
+func (p *provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	p.mu.Lock()
+	g, ok := p.tokens[token]
+	p.mu.Unlock()
+	if !ok || time.Now().After(g.expires) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	roles := g.user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":                g.user.Name,
+		"preferred_username": g.user.Name,
+		"email":              g.user.Name + "@bookinfo.example",
+		"roles":              roles,
+	})
+}
+
+// sign makes an RS256 JWT of claims.
+func (p *provider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
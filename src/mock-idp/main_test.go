@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUsers(t *testing.T) {
+	users := parseUsers("jason:admin+moderator, alice,,bob:")
+	if len(users) != 3 {
+		t.Fatalf("got %d users, want 3", len(users))
+	}
+	if roles := users["jason"].Roles; len(roles) != 2 || roles[1] != "moderator" {
+		t.Errorf("jason has roles %v", roles)
+	}
+	if roles := users["bob"].Roles; roles != nil {
+		t.Errorf("bob has roles %v", roles)
+	}
+}
+
+func TestCodeFlow(t *testing.T) {
+	p, err := newProvider("https://idp.example", "bookinfo", "s3cret", "https://app.example/cb", parseUsers("jason:admin"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := p.routes()
+	// The example of RFC 7636, appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorize := url.Values{
+		"response_type": {"code"}, "client_id": {"bookinfo"}, "redirect_uri": {"https://app.example/cb"},
+		"scope": {"openid profile"}, "state": {"xyz"}, "nonce": {"abc"},
+		"code_challenge": {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"}, "code_challenge_method": {"S256"},
+		"user": {"jason"},
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(authorize.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(w, req)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || location.Query().Get("state") != "xyz" {
+		t.Fatalf("authorize: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	code := location.Query().Get("code")
+
+	redeem := func(verifier string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type": {"authorization_code"}, "code": {code},
+			"redirect_uri": {"https://app.example/cb"}, "code_verifier": {verifier},
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("bookinfo", "s3cret")
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w := redeem(strings.Repeat("a", 43)); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong verifier: got %d", w.Code)
+	}
+	// A failed attempt uses the code up as well.
+	if w := redeem(verifier); w.Code != http.StatusBadRequest {
+		t.Errorf("used code: got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(authorize.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(w, req)
+	location, _ = url.Parse(w.Header().Get("Location"))
+	code = location.Query().Get("code")
+	w = redeem(verifier)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &tokens) != nil || strings.Count(tokens.IDToken, ".") != 2 {
+		t.Fatalf("token: got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	handler.ServeHTTP(w, req)
+	var info struct {
+		Sub   string   `json:"sub"`
+		Roles []string `json:"roles"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &info) != nil || info.Sub != "jason" || len(info.Roles) != 1 {
+		t.Errorf("userinfo: got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+)
+
+// registerAdminRoutes adds the pages for signed in admins.
+func registerAdminRoutes(r *gin.Engine) {
+	r.GET("/admin/sessions", requireAdmin, listSessions)
+	r.GET("/admin/apikeys", requireAdmin, listAPIKeys)
+	r.POST("/admin/apikeys", requireAdmin, issueAPIKey)
+	r.DELETE("/admin/apikeys/:id", requireAdmin, revokeAPIKey)
+	auditLog.RegisterRoutes(r, "/admin/audit", requireAdmin)
+}
+
+// requireAdmin lets signed in users with the admin role through.
+func requireAdmin(c *gin.Context) {
+	session := sessions.Default(c)
+	user, _ := session.Get("user").(string)
+	if user == "" {
+		auditLog.Record(c, audit.Entry{Action: "admin.denied", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "please sign in"})
+		return
+	}
+	if !containsString(userRoles(user, session.Get("login"), session.Get("roles")), "admin") {
+		auditLog.Record(c, audit.Entry{Actor: user, Action: "admin.denied", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+		return
+	}
+	c.Next()
+}
+
+// Sign in methods, stored in the session under "login".
+const (
+	loginPassword = "password"
+	loginSSO      = "oidc"
+)
+
+// userRoles returns the roles of a signed in user. Users who signed in with
+// single sign on have the roles the provider gave them, possibly none; only
+// password users get theirs from the users file.
+func userRoles(user string, login, sessionRoles interface{}) []string {
+	if login == loginSSO || strings.HasPrefix(user, ssoUserPrefix) {
+		roles, _ := sessionRoles.([]string)
+		return roles
+	}
+	if login != loginPassword {
+		return nil
+	}
+	return users.Roles(user)
+}
+
+// SessionInfo describes an active session. Ref tells sessions apart without
+// giving away their ids, which would let anyone reading the list take them
+// over.
+type SessionInfo struct {
+	Ref      string    `json:"ref"`
+	User     string    `json:"user,omitempty"`
+	Roles    []string  `json:"roles,omitempty"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+	Expires  time.Time `json:"expires"`
+	Current  bool      `json:"current,omitempty"`
+}
+
+func listSessions(c *gin.Context) {
+	records, err := sessionStore.Active()
+	if err != nil {
+		log.Printf("session: list: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list sessions"})
+		return
+	}
+	current := sessions.Default(c).ID()
+	list := make([]SessionInfo, 0, len(records))
+	for _, record := range records {
+		ref := sha256.Sum256([]byte(record.Id))
+		info := SessionInfo{
+			Ref:      hex.EncodeToString(ref[:6]),
+			Created:  record.Created,
+			LastSeen: record.LastSeen,
+			Expires:  sessionStore.expires(record),
+			Current:  record.Id == current,
+		}
+		if user, ok := record.Values["user"].(string); ok {
+			info.User = user
+			info.Roles = userRoles(user, record.Values["login"], record.Values["roles"])
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/ratelimit"
+)
+
+// API keys let scripts use the /api/v1 routes without a session. A key is
+// sent in the X-API-Key header and acts for the identity it was issued to,
+// which the backends see as the end-user. Only the SHA-256 hash of a key is
+// kept, in API_KEYS_FILE (default apikeys.txt), one
+// "id:hash:identity:scopes:created:revoked" line per key with the times in
+// Unix seconds and 0 for keys in use. Like the users file, it is read again
+// whenever it changes, so keys issued or revoked with the apikey subcommand
+// take effect while the product page is running.
+
+const apiKeyHeader = "X-API-Key"
+
+// The scopes a key can be given.
+const (
+	scopeReadCatalog  = "read-catalog"
+	scopeWriteReviews = "write-reviews"
+)
+
+var apiKeyScopes = []string{scopeReadCatalog, scopeWriteReviews}
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrUnknownAPIKey = errors.New("no such API key")
+)
+
+// APIKey describes an issued key, without the key itself. The usage counts
+// are those since the product page started.
+type APIKey struct {
+	Id       string     `json:"id"`
+	Identity string     `json:"identity"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	Requests uint64     `json:"requests"`
+	Denied   uint64     `json:"denied"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+
+	hash string
+}
+
+// HasScope reports whether the key grants a scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return containsString(k.Scopes, scope)
+}
+
+type apiKeyUsage struct {
+	requests uint64
+	denied   uint64
+	lastUsed time.Time
+	token    string
+	expires  time.Time
+}
+
+type apiKeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    []APIKey
+	usage   map[string]*apiKeyUsage
+	now     func() time.Time
+}
+
+var apiKeys = newAPIKeyStore(apiKeysFile())
+
+func apiKeysFile() string {
+	value, ok := os.LookupEnv("API_KEYS_FILE")
+	if !ok {
+		return "apikeys.txt"
+	}
+	return value
+}
+
+func newAPIKeyStore(path string) *apiKeyStore {
+	return &apiKeyStore{path: path, usage: map[string]*apiKeyUsage{}, now: time.Now}
+}
+
+// reload reads the keys file if it changed since the last read. The size is
+// compared too, as writes close together can leave the same modification
+// time. A missing file means there are no keys. The caller holds the lock.
+func (s *apiKeyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	keys, err := readAPIKeys(s.path)
+	if err != nil {
+		return err
+	}
+	s.keys, s.modTime, s.size = keys, info.ModTime(), info.Size()
+	return nil
+}
+
+func readAPIKeys(path string) ([]APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []APIKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) != 6 || fields[0] == "" || len(fields[1]) != 2*sha256.Size {
+			return nil, fmt.Errorf("%s:%d: expected id:hash:identity:scopes:created:revoked", path, line)
+		}
+		created, err1 := strconv.ParseInt(fields[4], 10, 64)
+		revoked, err2 := strconv.ParseInt(fields[5], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s:%d: invalid time", path, line)
+		}
+		key := APIKey{
+			Id:       fields[0],
+			hash:     fields[1],
+			Identity: fields[2],
+			Scopes:   splitRoles(fields[3]),
+			Created:  time.Unix(created, 0),
+		}
+		if revoked != 0 {
+			t := time.Unix(revoked, 0)
+			key.Revoked = &t
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// write replaces the keys file. The caller holds the lock.
+func (s *apiKeyStore) write(keys []APIKey) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".apikeys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, key := range keys {
+		var revoked int64
+		if key.Revoked != nil {
+			revoked = key.Revoked.Unix()
+		}
+		fmt.Fprintf(w, "%s:%s:%s:%s:%d:%d\n", key.Id, key.hash, key.Identity, strings.Join(key.Scopes, ","), key.Created.Unix(), revoked)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	s.modTime = time.Time{}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue makes a new key for an identity. The key is returned only here;
+// what is stored cannot be turned back into it.
+func (s *apiKeyStore) Issue(identity string, scopes []string) (string, APIKey, error) {
+	if identity == "" || strings.ContainsAny(identity, ":\r\n") {
+		return "", APIKey{}, fmt.Errorf("invalid identity %q", identity)
+	}
+	if len(scopes) == 0 {
+		return "", APIKey{}, errors.New("a key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !containsString(apiKeyScopes, scope) {
+			return "", APIKey{}, fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKey{Id: hex.EncodeToString(id), Identity: identity, Scopes: scopes}
+	plain := "bk_" + key.Id + "_" + hex.EncodeToString(secret)
+	key.hash = hashAPIKey(plain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return "", APIKey{}, err
+	}
+	key.Created = time.Unix(s.now().Unix(), 0)
+	if err := s.write(append(append([]APIKey(nil), s.keys...), key)); err != nil {
+		return "", APIKey{}, err
+	}
+	return plain, key, nil
+}
+
+// Revoke stops a key from working. Revoked keys stay in the file, so the
+// listing still tells who had them.
+func (s *apiKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	keys := append([]APIKey(nil), s.keys...)
+	for i := range keys {
+		if keys[i].Id != id {
+			continue
+		}
+		if keys[i].Revoked != nil {
+			return nil
+		}
+		now := time.Unix(s.now().Unix(), 0)
+		keys[i].Revoked = &now
+		return s.write(keys)
+	}
+	return ErrUnknownAPIKey
+}
+
+// List returns all keys, revoked ones included, with their usage.
+func (s *apiKeyStore) List() ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, len(s.keys))
+	for i, key := range s.keys {
+		keys[i] = s.withUsage(key)
+	}
+	return keys, nil
+}
+
+// withUsage adds the usage counts to a key. The caller holds the lock.
+func (s *apiKeyStore) withUsage(key APIKey) APIKey {
+	if u := s.usage[key.Id]; u != nil {
+		key.Requests, key.Denied = u.requests, u.denied
+		if !u.lastUsed.IsZero() {
+			lastUsed := u.lastUsed
+			key.LastUsed = &lastUsed
+		}
+	}
+	return key
+}
+
+func (s *apiKeyStore) usageOf(id string) *apiKeyUsage {
+	u := s.usage[id]
+	if u == nil {
+		u = &apiKeyUsage{}
+		s.usage[id] = u
+	}
+	return u
+}
+
+// Authenticate returns the key a request presented, counting its use.
+func (s *apiKeyStore) Authenticate(plain string) (*APIKey, error) {
+	hash := hashAPIKey(plain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Printf("apikeys: %v", err)
+	}
+	for _, key := range s.keys {
+		if key.hash != hash {
+			continue
+		}
+		if key.Revoked != nil {
+			break
+		}
+		u := s.usageOf(key.Id)
+		u.requests++
+		u.lastUsed = s.now()
+		key = s.withUsage(key)
+		return &key, nil
+	}
+	return nil, ErrInvalidAPIKey
+}
+
+// deny counts a request a key was not allowed to make.
+func (s *apiKeyStore) deny(key *APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usageOf(key.Id).denied++
+}
+
+// Token returns a JWT for the identity of a key, for the backends, issuing
+// a new one when there is none yet or it is about to expire. Keys carry no
+// roles, whatever roles their identity has when signing in.
+func (s *apiKeyStore) Token(key *APIKey) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usageOf(key.Id)
+	if u.token != "" && s.now().Add(tokenRefreshMargin).Before(u.expires) {
+		return u.token
+	}
+	token, expires, err := tokens.Issue(key.Identity, []string{})
+	if err != nil {
+		log.Printf("jwt: issue token for API key %s: %v", key.Id, err)
+		return ""
+	}
+	u.token, u.expires = token, expires
+	return token
+}
+
+// Middleware authenticates the requests to /api/v1 that carry an API key,
+// answering 401 when the key is not valid. Requests without one go on as
+// before, with their session if any.
+func (s *apiKeyStore) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plain := c.GetHeader(apiKeyHeader)
+		if plain == "" || !strings.HasPrefix(c.Request.URL.Path, "/api/v1/") {
+			c.Next()
+			return
+		}
+		key, err := s.Authenticate(plain)
+		if err != nil {
+			log.Printf("apikeys: rejected %s %s", c.Request.Method, c.Request.URL.Path)
+			auditLog.Record(c, audit.Entry{Action: "apikey.authenticate", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("apiKey", key)
+		c.Next()
+	}
+}
+
+// apiKeyOf returns the API key a request was authenticated with, or nil.
+func apiKeyOf(c *gin.Context) *APIKey {
+	value, _ := c.Get("apiKey")
+	key, _ := value.(*APIKey)
+	return key
+}
+
+// requestUser names who a request is made for: the identity of its API
+// key, else the signed in user of its session, else "".
+func requestUser(c *gin.Context) string {
+	if key := apiKeyOf(c); key != nil {
+		return key.Identity
+	}
+	user, _ := sessions.Default(c).Get("user").(string)
+	return user
+}
+
+// rateLimitIdentity tells the senders of requests apart for the rate limits
+// by their API key, else their signed in user.
+func rateLimitIdentity(c *gin.Context) ratelimit.Identity {
+	id := ratelimit.Identity{User: requestUser(c)}
+	if key := apiKeyOf(c); key != nil {
+		id.APIKey = key.Id
+	}
+	return id
+}
+
+// requireScope turns away requests made with a key that lacks a scope.
+// Requests without a key are left to the handler.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := apiKeyOf(c); key != nil && !key.HasScope(scope) {
+			apiKeys.deny(key)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the API key lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func listAPIKeys(c *gin.Context) {
+	keys, err := apiKeys.List()
+	if err != nil {
+		log.Printf("apikeys: list: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list API keys"})
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func issueAPIKey(c *gin.Context) {
+	var body struct {
+		Identity string   `json:"identity"`
+		Scopes   []string `json:"scopes"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plain, key, err := apiKeys.Issue(body.Identity, body.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("apikeys: %s issued key %s for %s %v", requestUser(c), key.Id, key.Identity, key.Scopes)
+	auditLog.Record(c, audit.Entry{
+		Actor:   requestUser(c),
+		Action:  "apikey.issue",
+		Target:  "apikey/" + key.Id,
+		Details: map[string]string{"identity": key.Identity, "scopes": strings.Join(key.Scopes, ",")},
+	})
+	c.JSON(http.StatusCreated, gin.H{"key": plain, "apiKey": key})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	id := c.Param("id")
+	if err := apiKeys.Revoke(id); err == ErrUnknownAPIKey {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("apikeys: revoke %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke the API key"})
+		return
+	}
+	log.Printf("apikeys: %s revoked key %s", requestUser(c), id)
+	auditLog.Record(c, audit.Entry{Actor: requestUser(c), Action: "apikey.revoke", Target: "apikey/" + id})
+	c.Status(http.StatusNoContent)
+}
+
+// runAPIKey implements `productpage apikey [-file path] issue [-scopes
+// list] <identity>`, `productpage apikey revoke <id>` and `productpage
+// apikey list`. The key is printed once, when it is issued:
+//
+//	productpage apikey issue -scopes read-catalog partner-search
+func runAPIKey(args []string) int {
+	fs := flag.NewFlagSet("apikey", flag.ContinueOnError)
+	file := fs.String("file", apiKeysFile(), "API keys file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: productpage apikey [-file path] issue [-scopes list] <identity>")
+		fmt.Fprintln(fs.Output(), "       productpage apikey [-file path] revoke <id>")
+		fmt.Fprintln(fs.Output(), "       productpage apikey [-file path] list")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	s := newAPIKeyStore(*file)
+
+	switch command, args := fs.Arg(0), fs.Args()[1:]; command {
+	case "issue":
+		issue := flag.NewFlagSet("apikey issue", flag.ContinueOnError)
+		scopes := issue.String("scopes", scopeReadCatalog, "comma separated scopes: "+strings.Join(apiKeyScopes, ", "))
+		if err := issue.Parse(args); err != nil {
+			return 2
+		}
+		if issue.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		plain, key, err := s.Issue(issue.Arg(0), splitRoles(*scopes))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apikey: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "issued key %s for %s, it is shown only once:\n", key.Id, key.Identity)
+		fmt.Println(plain)
+	case "revoke":
+		if len(args) != 1 {
+			fs.Usage()
+			return 2
+		}
+		if err := s.Revoke(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "apikey: %v\n", err)
+			return 1
+		}
+	case "list":
+		keys, err := s.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apikey: %v\n", err)
+			return 1
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tIDENTITY\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.Revoked != nil {
+				revoked = key.Revoked.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.Id, key.Identity, strings.Join(key.Scopes, ","), key.Created.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.txt")
+	s := newAPIKeyStore(path)
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	if _, err := s.Authenticate("bk_nothing"); err != ErrInvalidAPIKey {
+		t.Errorf("without a keys file: got %v", err)
+	}
+	plain, key, err := s.Issue("partner-search", []string{scopeReadCatalog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), plain) || !strings.Contains(string(data), hashAPIKey(plain)) {
+		t.Errorf("keys file holds %q, want the hash of the key", data)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := s.Authenticate(plain)
+		if err != nil || got.Id != key.Id || got.Identity != "partner-search" || !got.HasScope(scopeReadCatalog) || got.HasScope(scopeWriteReviews) {
+			t.Fatalf("authenticate: %+v, %v", got, err)
+		}
+	}
+	if _, err := s.Authenticate(plain + "0"); err != ErrInvalidAPIKey {
+		t.Errorf("wrong key: got %v", err)
+	}
+	s.deny(&key)
+	keys, _ := s.List()
+	if len(keys) != 1 || keys[0].Requests != 2 || keys[0].Denied != 1 || keys[0].LastUsed == nil || !keys[0].LastUsed.Equal(now) {
+		t.Errorf("usage: %+v", keys)
+	}
+
+	// Revoking with another store, as the apikey subcommand does, takes
+	// effect without a restart.
+	if err := newAPIKeyStore(path).Revoke(key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(plain); err != ErrInvalidAPIKey {
+		t.Errorf("revoked key: got %v", err)
+	}
+	if keys, _ := s.List(); len(keys) != 1 || keys[0].Revoked == nil || keys[0].Requests != 2 {
+		t.Errorf("revoked key is listed as %+v", keys)
+	}
+	if err := s.Revoke("0123"); err != ErrUnknownAPIKey {
+		t.Errorf("unknown key: got %v", err)
+	}
+}
+
+func TestAPIKeyStoreIssueRejects(t *testing.T) {
+	s := newAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.txt"))
+	for _, tt := range []struct {
+		identity string
+		scopes   []string
+	}{
+		{"", []string{scopeReadCatalog}},
+		{"a:b", []string{scopeReadCatalog}},
+		{"partner", nil},
+		{"partner", []string{"admin"}},
+	} {
+		if _, _, err := s.Issue(tt.identity, tt.scopes); err == nil {
+			t.Errorf("issued a key for %q with %v", tt.identity, tt.scopes)
+		}
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	s := newAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.txt"))
+	defer func(saved *apiKeyStore) { apiKeys = saved }(apiKeys)
+	apiKeys = s
+	reader, _, err := s.Issue("partner-search", []string{scopeReadCatalog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _, err := s.Issue("partner-reviews", []string{scopeReadCatalog, scopeWriteReviews})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	store := NewServerStore(newMemorySessions(), time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	r := gin.New()
+	r.Use(sessions.Sessions("session", store))
+	r.Use(s.Middleware())
+	r.Use(csrfProtect)
+	user := func(c *gin.Context) { c.String(http.StatusOK, requestUser(c)) }
+	r.GET("/api/v1/products", requireScope(scopeReadCatalog), user)
+	r.POST("/api/v1/products/:productId/reviews", requireScope(scopeWriteReviews), user)
+	r.POST("/productpage/reviews/:reviewId/vote", user)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		status int
+		user   string
+	}{
+		{"no key", http.MethodGet, "/api/v1/products", "", http.StatusOK, ""},
+		{"invalid key", http.MethodGet, "/api/v1/products", "bk_guess", http.StatusUnauthorized, ""},
+		{"read", http.MethodGet, "/api/v1/products", reader, http.StatusOK, "partner-search"},
+		{"write without the scope", http.MethodPost, "/api/v1/products/0/reviews", reader, http.StatusForbidden, ""},
+		{"write", http.MethodPost, "/api/v1/products/0/reviews", writer, http.StatusOK, "partner-reviews"},
+		{"write without a key", http.MethodPost, "/api/v1/products/0/reviews", "", http.StatusForbidden, ""},
+		{"key outside the API", http.MethodPost, "/productpage/reviews/1/vote", writer, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set(apiKeyHeader, tt.key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || tt.status == http.StatusOK && w.Body.String() != tt.user {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, w.Body.String(), tt.status, tt.user)
+		}
+	}
+
+	keys, _ := s.List()
+	if keys[0].Requests != 2 || keys[0].Denied != 1 || keys[1].Requests != 1 {
+		t.Errorf("usage: %+v", keys)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+)
+
+// Signed in users get a JWT naming them and their roles, which is sent to
+// details and reviews as `Authorization: Bearer`. The backends check it
+// against the keys published at /.well-known/jwks.json.
+
+// tokenIssuer signs tokens with an RSA key (RS256) or an EC P-256 key
+// (ES256).
+type tokenIssuer struct {
+	key      crypto.Signer
+	alg      string
+	kid      string
+	issuer   string
+	audience string
+	ttl      time.Duration
+}
+
+var tokens = newTokenIssuerFromEnv()
+
+// newTokenIssuerFromEnv reads the PEM private key from JWT_SIGNING_KEY_FILE,
+// the iss and aud claims from JWT_ISSUER (default productpage) and
+// JWT_AUDIENCE (default bookinfo), and the lifetime of tokens from JWT_TTL
+// (default 1h). Without a key file a P-256 key is generated, and tokens do
+// not survive a restart.
+func newTokenIssuerFromEnv() *tokenIssuer {
+	var key crypto.Signer
+	if path, ok := os.LookupEnv("JWT_SIGNING_KEY_FILE"); ok && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("jwt signing key: %v", err)
+		}
+		if key, err = parsePrivateKey(data); err != nil {
+			log.Fatalf("jwt signing key %s: %v", path, err)
+		}
+	} else {
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = generated
+	}
+	issuer := "productpage"
+	if value, ok := os.LookupEnv("JWT_ISSUER"); ok {
+		issuer = value
+	}
+	audience := "bookinfo"
+	if value, ok := os.LookupEnv("JWT_AUDIENCE"); ok {
+		audience = value
+	}
+	ttl := time.Hour
+	if value, ok := os.LookupEnv("JWT_TTL"); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("invalid JWT_TTL %q", value)
+		}
+		ttl = parsed
+	}
+	t, err := newTokenIssuer(key, issuer, audience, ttl)
+	if err != nil {
+		log.Fatalf("jwt signing key: %v", err)
+	}
+	return t
+}
+
+func newTokenIssuer(key crypto.Signer, issuer, audience string, ttl time.Duration) (*tokenIssuer, error) {
+	t := &tokenIssuer{key: key, issuer: issuer, audience: audience, ttl: ttl}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		t.alg = "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("EC keys must use the P-256 curve")
+		}
+		t.alg = "ES256"
+	default:
+		return nil, errors.New("unsupported key type, use RSA or EC P-256")
+	}
+	t.kid = thumbprint(t.jwk())
+	return t, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported key type")
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func (t *tokenIssuer) jwk() auth.JWK {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	switch pub := t.key.Public().(type) {
+	case *rsa.PublicKey:
+		return auth.JWK{Kty: "RSA", Kid: t.kid, Use: "sig", Alg: t.alg, N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return auth.JWK{Kty: "EC", Kid: t.kid, Use: "sig", Alg: t.alg, Crv: "P-256", X: b64(pub.X.FillBytes(make([]byte, 32))), Y: b64(pub.Y.FillBytes(make([]byte, 32)))}
+	}
+	return auth.JWK{}
+}
+
+// thumbprint is the RFC 7638 thumbprint of a key, used as its key id.
+func thumbprint(k auth.JWK) string {
+	var members string
+	if k.Kty == "RSA" {
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS returns the public key set to verify the tokens with.
+func (t *tokenIssuer) JWKS() auth.JWKS {
+	return auth.JWKS{Keys: []auth.JWK{t.jwk()}}
+}
+
+// Issue signs a token for a user, returning it with its expiry.
+func (t *tokenIssuer) Issue(user string, roles []string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(t.ttl)
+	if roles == nil {
+		roles = []string{}
+	}
+	claims := map[string]interface{}{
+		"iss":   t.issuer,
+		"sub":   user,
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   expires.Unix(),
+		"roles": roles,
+	}
+	if t.audience != "" {
+		claims["aud"] = t.audience
+	}
+	header, err := json.Marshal(map[string]string{"alg": t.alg, "typ": "JWT", "kid": t.kid})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := t.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+			// JWS wants the fixed size r || s, not ASN.1.
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), expires, nil
+}
+
+// tokenRefreshMargin renews a token this long before it expires, so it
+// does not run out on the way to the backends.
+const tokenRefreshMargin = time.Minute
+
+// sessionToken returns the token of the signed in user, issuing a new one
+// when there is none yet or it is about to expire. It returns "" for
+// anonymous sessions.
+func sessionToken(session sessions.Session) string {
+	user, ok := session.Get("user").(string)
+	if !ok || user == "" {
+		return ""
+	}
+	token, _ := session.Get("token").(string)
+	expires, _ := session.Get("tokenExpires").(int64)
+	if token != "" && time.Now().Add(tokenRefreshMargin).Before(time.Unix(expires, 0)) {
+		return token
+	}
+	token, expiry, err := tokens.Issue(user, userRoles(user, session.Get("login"), session.Get("roles")))
+	if err != nil {
+		log.Printf("jwt: issue token for %q: %v", user, err)
+		return ""
+	}
+	session.Set("token", token)
+	session.Set("tokenExpires", expiry.Unix())
+	session.Save()
+	return token
+}
+
+func jwksRoute(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, tokens.JWKS())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go-bookinfo.local/common/auth"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		issuer, err := newTokenIssuer(key, "productpage", "bookinfo", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, expires, err := issuer.Issue("jason", []string{"admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("%s: expires in %v", issuer.alg, d)
+		}
+
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			t.Fatalf("%s: token %q", issuer.alg, token)
+		}
+		var header map[string]string
+		var claims struct {
+			Iss, Sub, Aud string
+			Roles         []string
+		}
+		decode := func(segment string, v interface{}) {
+			data, err := base64.RawURLEncoding.DecodeString(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		decode(parts[0], &header)
+		decode(parts[1], &claims)
+		jwks := issuer.JWKS()
+		if header["alg"] != issuer.alg || header["kid"] != jwks.Keys[0].Kid || jwks.Keys[0].Kid == "" {
+			t.Errorf("%s: header %v, keys %+v", issuer.alg, header, jwks.Keys)
+		}
+		if claims.Iss != "productpage" || claims.Sub != "jason" || claims.Aud != "bookinfo" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+			t.Errorf("%s: claims %+v", issuer.alg, claims)
+		}
+
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if err := rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+				t.Errorf("RS256 signature: %v", err)
+			}
+		case *ecdsa.PrivateKey:
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if len(signature) != 64 || !ecdsa.Verify(&k.PublicKey, digest[:], r, s) {
+				t.Error("ES256 signature does not verify")
+			}
+		}
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// The example of RFC 7638, section 3.1.
+	k := auth.JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	if got := thumbprint(k); got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("thumbprint = %s", got)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+)
+
+// Single sign on with the OpenID Connect authorization code flow and PKCE.
+// /oidc/login sends the browser to the identity provider, which sends it
+// back to /oidc/callback with a code. The code is exchanged for an ID token,
+// which is validated, and the user it names is signed in like with a
+// password.
+
+// oidcConfig is the part of the provider's discovery document in use.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	client       *http.Client
+	now          func() time.Time
+
+	mu          sync.Mutex
+	config      *oidcConfig
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcLoginTimeout is how long the user has to sign in at the provider.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidc is nil, and single sign on off, unless OIDC_ISSUER is set.
+var oidc = newOIDCProviderFromEnv()
+
+// newOIDCProviderFromEnv configures single sign on from OIDC_ISSUER,
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET (empty for public clients),
+// OIDC_REDIRECT_URL (the address of /oidc/callback as the browser sees it)
+// and OIDC_SCOPES (default "openid profile email").
+func newOIDCProviderFromEnv() *oidcProvider {
+	issuer, ok := os.LookupEnv("OIDC_ISSUER")
+	if !ok || issuer == "" {
+		return nil
+	}
+	scopes := "openid profile email"
+	if value, ok := os.LookupEnv("OIDC_SCOPES"); ok {
+		scopes = value
+	}
+	redirectURL := "http://localhost:9080/oidc/callback"
+	if value, ok := os.LookupEnv("OIDC_REDIRECT_URL"); ok {
+		redirectURL = value
+	}
+	return newOIDCProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL, scopes)
+}
+
+func newOIDCProvider(issuer, clientId, clientSecret, redirectURL, scopes string) *oidcProvider {
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		now:          time.Now,
+	}
+}
+
+// discover fetches the discovery document, once it has been fetched
+// successfully it is kept.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+	var config oidcConfig
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &config); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", config.Issuer, p.issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JwksURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	p.config = &config
+	return p.config, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url, accessToken string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// authCodeURL is where the browser signs in.
+func (p *oidcProvider) authCodeURL(config *oidcConfig, state, nonce, verifier string) string {
+	query := neturl.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientId},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {p.scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return config.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// pkceChallenge is the S256 code challenge of RFC 7636 for a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, base64url encoded.
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// exchange trades an authorization code and its PKCE verifier for tokens.
+func (p *oidcProvider) exchange(ctx context.Context, config *oidcConfig, code, verifier string) (*tokenResponse, error) {
+	form := neturl.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientId)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		request.SetBasicAuth(neturl.QueryEscape(p.clientId), neturl.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request: status %d: %s %s", resp.StatusCode, tokens.Error, tokens.Description)
+	}
+	if tokens.IdToken == "" {
+		return nil, errors.New("token response without an ID token")
+	}
+	return &tokens, nil
+}
+
+// verifyIDToken checks the signature of an ID token against the provider's
+// keys and its issuer, audience, times and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, config *oidcConfig, token, nonce string) (map[string]interface{}, error) {
+	payload, err := auth.VerifySignature(token, func(kid string) (crypto.PublicKey, error) {
+		return p.key(ctx, config, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("ID token from issuer %q", iss)
+	}
+	audiences := stringList(claims["aud"])
+	if !containsString(audiences, p.clientId) {
+		return nil, errors.New("ID token is for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.clientId {
+		return nil, errors.New("ID token is for another client")
+	}
+	now := p.now()
+	exp, _ := claims["exp"].(float64)
+	if exp == 0 || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("ID token expired")
+	}
+	if iat, _ := claims["iat"].(float64); iat != 0 && now.Add(jwtLeeway).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token without a subject")
+	}
+	return claims, nil
+}
+
+// jwtLeeway allows for clock skew when checking exp and iat.
+const jwtLeeway = time.Minute
+
+// key returns a signing key of the provider, fetching the key set again
+// when the key id is unknown, at most every ten seconds.
+func (p *oidcProvider) key(ctx context.Context, config *oidcConfig, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if now := p.now(); now.Sub(p.keysFetched) >= 10*time.Second {
+		var set auth.JWKS
+		if err := p.getJSON(ctx, config.JwksURI, "", &set); err != nil {
+			return nil, fmt.Errorf("fetch keys: %v", err)
+		}
+		keys, err := auth.ParseJWKS(set)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysFetched = keys, now
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// userinfo fetches the claims of the userinfo endpoint, if there is one.
+func (p *oidcProvider) userinfo(ctx context.Context, config *oidcConfig, accessToken string) (map[string]interface{}, error) {
+	if config.UserinfoEndpoint == "" || accessToken == "" {
+		return nil, nil
+	}
+	var claims map[string]interface{}
+	if err := p.getJSON(ctx, config.UserinfoEndpoint, accessToken, &claims); err != nil {
+		return nil, fmt.Errorf("userinfo: %v", err)
+	}
+	return claims, nil
+}
+
+// ssoUserPrefix starts the names of users signed in by single sign on. Names
+// in the users file cannot contain a colon, so the provider cannot sign
+// someone in as a password user.
+const ssoUserPrefix = "sso:"
+
+// userFromClaims maps the claims of the provider to a user name, the first
+// of preferred_username, email and sub behind ssoUserPrefix, and roles, from
+// the roles or the groups claim. Roles is never nil.
+func userFromClaims(claims map[string]interface{}) (string, []string) {
+	var user string
+	for _, claim := range []string{"preferred_username", "email", "sub"} {
+		if value, _ := claims[claim].(string); value != "" {
+			user = ssoUserPrefix + value
+			break
+		}
+	}
+	roles := stringList(claims["roles"])
+	if roles == nil {
+		roles = stringList(claims["groups"])
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	return user, roles
+}
+
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// localPath returns the path and query of a URL when it points back into
+// the product page, so the return address cannot send users elsewhere.
+func localPath(raw string) string {
+	u, err := neturl.Parse(raw)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || strings.Contains(u.Path, "\\") {
+		return "/productpage"
+	}
+	if u.RawQuery != "" {
+		return u.Path + "?" + u.RawQuery
+	}
+	return u.Path
+}
+
+// refererPath returns the local path of the page a request came from, for
+// redirecting back to it. A referer on another site gives /productpage.
+func refererPath(c *gin.Context) string {
+	u, err := neturl.Parse(c.Request.Referer())
+	if err != nil || c.Request.Referer() == "" || u.Host != "" && u.Host != c.Request.Host {
+		return "/productpage"
+	}
+	return localPath(u.RequestURI())
+}
+
+func oidcLoginRoute(c *gin.Context) {
+	if oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign on is not configured"})
+		return
+	}
+	config, err := oidc.discover(c.Request.Context())
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "the identity provider is currently unavailable"})
+		return
+	}
+	back := c.Query("return")
+	if back == "" {
+		back = refererPath(c)
+	}
+	state, nonce, verifier := randomString(24), randomString(24), randomString(48)
+	session := sessions.Default(c)
+	session.Set("oidcState", state)
+	session.Set("oidcNonce", nonce)
+	session.Set("oidcVerifier", verifier)
+	session.Set("oidcReturn", localPath(back))
+	session.Set("oidcStarted", oidc.now().Unix())
+	session.Save()
+	c.Redirect(http.StatusFound, oidc.authCodeURL(config, state, nonce, verifier))
+}
+
+func oidcCallbackRoute(c *gin.Context) {
+	session := sessions.Default(c)
+	state, _ := session.Get("oidcState").(string)
+	nonce, _ := session.Get("oidcNonce").(string)
+	verifier, _ := session.Get("oidcVerifier").(string)
+	back, _ := session.Get("oidcReturn").(string)
+	started, _ := session.Get("oidcStarted").(int64)
+	for _, key := range []string{"oidcState", "oidcNonce", "oidcVerifier", "oidcReturn", "oidcStarted"} {
+		session.Delete(key)
+	}
+	if back == "" {
+		back = "/productpage"
+	}
+
+	fail := func(reason string, err error) {
+		log.Printf("oidc: sign in failed: %s: %v", reason, err)
+		auditLog.Record(c, audit.Entry{Action: "login", Outcome: audit.Failure, Details: map[string]string{"method": "oidc", "reason": reason}})
+		session.Set("loginError", "single sign on failed: "+reason)
+		session.Save()
+		c.Redirect(http.StatusSeeOther, back)
+	}
+	switch {
+	case oidc == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign on is not configured"})
+		return
+	case c.Query("error") != "":
+		fail(c.Query("error"), errors.New(c.Query("error_description")))
+		return
+	case state == "" || subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(state)) != 1:
+		fail("invalid state", errors.New("the state does not match the session"))
+		return
+	case oidc.now().Sub(time.Unix(started, 0)) > oidcLoginTimeout:
+		fail("the sign in took too long", errors.New("login expired"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	config, err := oidc.discover(ctx)
+	if err != nil {
+		fail("the identity provider is unavailable", err)
+		return
+	}
+	tokens, err := oidc.exchange(ctx, config, c.Query("code"), verifier)
+	if err != nil {
+		fail("could not redeem the code", err)
+		return
+	}
+	claims, err := oidc.verifyIDToken(ctx, config, tokens.IdToken, nonce)
+	if err != nil {
+		fail("invalid ID token", err)
+		return
+	}
+	info, err := oidc.userinfo(ctx, config, tokens.AccessToken)
+	if err != nil {
+		fail("could not get the user info", err)
+		return
+	}
+	if info != nil {
+		if info["sub"] != claims["sub"] {
+			fail("invalid user info", errors.New("userinfo is about another subject"))
+			return
+		}
+		for claim, value := range info {
+			if _, ok := claims[claim]; !ok {
+				claims[claim] = value
+			}
+		}
+	}
+
+	user, roles := userFromClaims(claims)
+	session.Clear()
+	session.Set("sid", newSessionId())
+	session.Set("user", user)
+	session.Set("login", loginSSO)
+	session.Set("roles", roles)
+	// Issues the token for the backends and saves the session.
+	sessionToken(session)
+	log.Printf("oidc: signed in %q with roles %v", user, roles)
+	auditLog.Record(c, audit.Entry{Actor: user, Action: "login", Details: map[string]string{"method": "oidc", "roles": strings.Join(roles, ",")}})
+	c.Redirect(http.StatusSeeOther, back)
+}
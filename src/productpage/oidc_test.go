@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// The example of RFC 7636, appendix B.
+	got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("pkceChallenge = %q, want %q", got, want)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"/productpage?id=1", "/productpage?id=1"},
+		{"/", "/"},
+		{"", "/productpage"},
+		{"//evil.example/", "/productpage"},
+		{"/\\evil.example/", "/productpage"},
+		{"https://evil.example/productpage", "/productpage"},
+		{"productpage", "/productpage"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.raw); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRefererPath(t *testing.T) {
+	tests := []struct {
+		referer string
+		want    string
+	}{
+		{"http://bookinfo.example/productpage?u=normal", "/productpage?u=normal"},
+		{"/reviews", "/reviews"},
+		{"", "/productpage"},
+		{"https://evil.example/productpage", "/productpage"},
+		{"http://bookinfo.example//evil.example/", "/productpage"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "http://bookinfo.example/login", nil)
+		c.Request.Header.Set("Referer", tt.referer)
+		if got := refererPath(c); got != tt.want {
+			t.Errorf("refererPath with referer %q = %q, want %q", tt.referer, got, tt.want)
+		}
+	}
+}
+
+func TestUserFromClaims(t *testing.T) {
+	user, roles := userFromClaims(map[string]interface{}{
+		"sub": "248289761001", "email": "jason@example.com",
+		"groups": []interface{}{"admin", "moderator"},
+	})
+	if user != "sso:jason@example.com" || len(roles) != 2 || roles[0] != "admin" {
+		t.Errorf("got %q %v", user, roles)
+	}
+	user, roles = userFromClaims(map[string]interface{}{
+		"sub": "248289761001", "preferred_username": "jason",
+		"roles": "admin", "groups": []interface{}{"moderator"},
+	})
+	if user != "sso:jason" || len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("got %q %v", user, roles)
+	}
+	user, roles = userFromClaims(map[string]interface{}{"sub": "248289761001", "preferred_username": "jason"})
+	if user != "sso:jason" || roles == nil || len(roles) != 0 {
+		t.Errorf("without roles: got %q %#v", user, roles)
+	}
+}
+
+func TestUserRolesOfSSOUsers(t *testing.T) {
+	defer func(saved *userStore) { users = saved }(users)
+	users = newUserStore(filepath.Join(t.TempDir(), "users.txt"))
+	if err := users.SetPassword("jason", "s3cret", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		user  string
+		login interface{}
+		roles interface{}
+		want  string
+	}{
+		{"password", "jason", loginPassword, nil, "admin"},
+		{"sso without roles", "jason", loginSSO, []string{}, ""},
+		{"sso with roles", "sso:jason", loginSSO, []string{"moderator"}, "moderator"},
+		{"sso user without marker", "sso:jason", nil, nil, ""},
+		{"no marker", "jason", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(userRoles(tt.user, tt.login, tt.roles), ","); got != tt.want {
+			t.Errorf("%s: roles %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.JWKS{Keys: []auth.JWK{
+			{Kty: "RSA", Kid: "idp", N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	}))
+	defer server.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "idp"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64(signature)
+	}
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.example", "sub": "248289761001", "aud": "bookinfo",
+			"iat": now.Unix(), "exp": now.Add(time.Minute).Unix(), "nonce": "n-0S6_WzA2Mj",
+		}
+		for k, value := range changes {
+			c[k] = value
+		}
+		return c
+	}
+
+	p := newOIDCProvider("https://idp.example/", "bookinfo", "", "", "")
+	config := &oidcConfig{Issuer: "https://idp.example", JwksURI: server.URL}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(claims(nil)), true},
+		{"audience list", sign(claims(map[string]interface{}{"aud": []string{"bookinfo", "other"}, "azp": "bookinfo"})), true},
+		{"wrong nonce", sign(claims(map[string]interface{}{"nonce": "replayed"})), false},
+		{"wrong audience", sign(claims(map[string]interface{}{"aud": "other"})), false},
+		{"wrong azp", sign(claims(map[string]interface{}{"azp": "other"})), false},
+		{"wrong issuer", sign(claims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"expired", sign(claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"no subject", sign(claims(map[string]interface{}{"sub": ""})), false},
+		{"tampered", sign(claims(nil)) + "x", false},
+	}
+	for _, tt := range tests {
+		got, err := p.verifyIDToken(context.Background(), config, tt.token, "n-0S6_WzA2Mj")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verifyIDToken error = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && got["sub"] != "248289761001" {
+			t.Errorf("%s: claims = %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func TestEventsRoute(t *testing.T) {
+	defer func(saved Data) { ratings = saved }(ratings)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	store := NewServerStore(newMemorySessions(), time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	r.Use(sessions.Sessions("session", store))
+	r.GET("/api/v1/products/:productId/events", eventsRoute)
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	tests := []struct {
+		name        string
+		ratings     string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"invalid url", "http://bad host", http.StatusInternalServerError, "application/json", `"error"`},
+		{"unreachable", unreachable.URL, http.StatusOK, "text/event-stream", ": ratings are currently unavailable"},
+	}
+	for _, tt := range tests {
+		ratings = Data{Name: tt.ratings, Endpoint: "ratings"}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/products/0/events", nil))
+		if w.Code != tt.status || !strings.HasPrefix(w.Header().Get("Content-Type"), tt.contentType) || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %s %q", tt.name, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	}
+}
+
+func TestAPIRoutes(t *testing.T) {
+	defer func(savedKeys *apiKeyStore, savedDetails, savedReviews, savedRatings Data) {
+		apiKeys, details, reviews, ratings = savedKeys, savedDetails, savedReviews, savedRatings
+	}(apiKeys, details, reviews, ratings)
+	apiKeys = newAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.txt"))
+	reader, _, err := apiKeys.Issue("partner-search", []string{scopeReadCatalog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _, err := apiKeys.Issue("partner-reviews", []string{scopeWriteReviews})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requested []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	details = Data{Name: backend.URL, Endpoint: "details"}
+	reviews = Data{Name: backend.URL, Endpoint: "reviews"}
+	ratings = Data{Name: backend.URL, Endpoint: "ratings"}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	store := NewServerStore(newMemorySessions(), time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	r.Use(sessions.Sessions("session", store))
+	r.Use(apiKeys.Middleware())
+	registerAPIRoutes(r)
+
+	tests := []struct {
+		path    string
+		key     string
+		status  int
+		backend string
+	}{
+		{"/api/v1/products/3", reader, http.StatusOK, "/details/3"},
+		{"/api/v1/products/3/reviews", reader, http.StatusOK, "/reviews/3"},
+		{"/api/v1/products/3/ratings", reader, http.StatusOK, "/ratings/3"},
+		{"/api/v1/products/3", writer, http.StatusForbidden, ""},
+		{"/api/v1/products/3/reviews", writer, http.StatusForbidden, ""},
+		{"/api/v1/products/3/ratings", writer, http.StatusForbidden, ""},
+		{"/api/v1/products/three/ratings", reader, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		requested = nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set(apiKeyHeader, tt.key)
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || strings.Join(requested, ",") != tt.backend {
+			t.Errorf("%s: got %d and requested %v, want %d and %q", tt.path, w.Code, requested, tt.status, tt.backend)
+		}
+	}
+}
+
+func TestGetForwardHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	store := NewServerStore(newMemorySessions(), time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	r.Use(sessions.Sessions("session", store))
+	var headers map[string][]string
+	r.GET("/", func(c *gin.Context) {
+		if user := c.Query("user"); user != "" {
+			session := sessions.Default(c)
+			session.Set("user", user)
+			session.Save()
+		}
+		headers = getForwardHeaders(c)
+	})
+
+	tests := []struct {
+		name          string
+		user          string
+		authorization string
+	}{
+		{"anonymous", "", "Bearer from-the-client"},
+		{"signed in", "alice", "Bearer "},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?user="+tt.user, nil)
+		req.Header.Set("x-request-id", "abc")
+		req.Header.Set("Authorization", "Bearer from-the-client")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		for header := range headers {
+			if header != http.CanonicalHeaderKey(header) {
+				t.Errorf("%s: header %q is not canonical", tt.name, header)
+			}
+		}
+		if got := headers["X-Request-Id"]; len(got) != 1 || got[0] != "abc" {
+			t.Errorf("%s: x-request-id %v", tt.name, got)
+		}
+		got := headers["Authorization"]
+		if len(got) != 1 || !strings.HasPrefix(got[0], tt.authorization) || tt.user != "" && got[0] == "Bearer from-the-client" {
+			t.Errorf("%s: authorization %v", tt.name, got)
+		}
+	}
+}
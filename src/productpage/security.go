@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+)
+
+// SecurityHeaders are added to every response. "{nonce}" in the content
+// security policy is replaced by a nonce made for each response, which the
+// templates put on their inline scripts.
+type SecurityHeaders struct {
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+	// HSTSMaxAge is the max-age of Strict-Transport-Security in seconds,
+	// sent on HTTPS requests only. Zero leaves the header out.
+	HSTSMaxAge int
+}
+
+// The styles stay open to inline use, for the style attributes of the
+// templates and of Bootstrap.
+const defaultContentSecurityPolicy = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; " +
+	"base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// newSecurityHeadersFromEnv reads CONTENT_SECURITY_POLICY, FRAME_OPTIONS,
+// REFERRER_POLICY and HSTS_MAX_AGE, where set, over the defaults. An empty
+// value leaves the header out.
+func newSecurityHeadersFromEnv() SecurityHeaders {
+	h := SecurityHeaders{
+		ContentSecurityPolicy: defaultContentSecurityPolicy,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "same-origin",
+		HSTSMaxAge:            365 * 24 * 60 * 60,
+	}
+	if value, ok := os.LookupEnv("CONTENT_SECURITY_POLICY"); ok {
+		h.ContentSecurityPolicy = value
+	}
+	if value, ok := os.LookupEnv("FRAME_OPTIONS"); ok {
+		h.FrameOptions = value
+	}
+	if value, ok := os.LookupEnv("REFERRER_POLICY"); ok {
+		h.ReferrerPolicy = value
+	}
+	if value, ok := os.LookupEnv("HSTS_MAX_AGE"); ok {
+		if value == "" {
+			value = "0"
+		}
+		maxAge, err := strconv.Atoi(value)
+		if err != nil || maxAge < 0 {
+			log.Fatalf("invalid HSTS_MAX_AGE %q", value)
+		}
+		h.HSTSMaxAge = maxAge
+	}
+	return h
+}
+
+func (h SecurityHeaders) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.Writer.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		if h.ContentSecurityPolicy != "" {
+			policy := h.ContentSecurityPolicy
+			if strings.Contains(policy, "{nonce}") {
+				nonce := randomString(16)
+				c.Set("cspNonce", nonce)
+				policy = strings.ReplaceAll(policy, "{nonce}", nonce)
+			}
+			header.Set("Content-Security-Policy", policy)
+		}
+		if h.FrameOptions != "" {
+			header.Set("X-Frame-Options", h.FrameOptions)
+		}
+		if h.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", h.ReferrerPolicy)
+		}
+		if h.HSTSMaxAge > 0 && isHTTPS(c) {
+			header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(h.HSTSMaxAge)+"; includeSubDomains")
+		}
+		c.Next()
+	}
+}
+
+// cspNonce returns the nonce of the content security policy of a response,
+// for the inline scripts of its template.
+func cspNonce(c *gin.Context) string {
+	return c.GetString("cspNonce")
+}
+
+// isHTTPS tells whether the browser used HTTPS, directly or through a
+// gateway that terminates TLS.
+func isHTTPS(c *gin.Context) bool {
+	return c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https")
+}
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	csrfCookie    = "csrf"
+)
+
+// csrfProtect rejects state changing requests that do not carry the CSRF
+// token of their session, in the csrf_token form field or the X-CSRF-Token
+// header. Another site can make a browser send the session cookie, but it
+// cannot read the token from our pages.
+//
+// Anonymous visitors get no session just for a token: theirs is kept in a
+// cookie signed with the session key, which the form must repeat (the
+// double submit pattern). Once signed in, only the session's token counts.
+//
+// Requests made with an API key do not use the session, and need no token.
+func csrfProtect(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if apiKeyOf(c) != nil {
+		c.Next()
+		return
+	}
+	session := sessions.Default(c)
+	expected, _ := session.Get("csrfToken").(string)
+	if _, signedIn := session.Get("user").(string); expected == "" && !signedIn {
+		expected = csrfCookieToken(c)
+	}
+	token := c.GetHeader(csrfHeader)
+	if token == "" {
+		token = c.PostForm(csrfFormField)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		log.Printf("csrf: rejected %s %s", c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid or missing CSRF token, please reload the page"})
+		return
+	}
+	c.Next()
+}
+
+// csrfToken returns the CSRF token for the forms of a page: the one of the
+// session of a signed in user, made when the session has none yet, else
+// the one of the anonymous CSRF cookie. Signing in and out start new
+// sessions, and with them new tokens.
+func csrfToken(c *gin.Context) string {
+	session := sessions.Default(c)
+	if token, ok := session.Get("csrfToken").(string); ok && token != "" {
+		return token
+	}
+	if _, signedIn := session.Get("user").(string); !signedIn {
+		return anonymousCSRFToken(c)
+	}
+	token := newCSRFToken()
+	if token == "" {
+		return ""
+	}
+	session.Set("csrfToken", token)
+	if err := session.Save(); err != nil {
+		log.Printf("csrf: %v", err)
+	}
+	return token
+}
+
+// anonymousCSRFToken returns the token of the CSRF cookie, setting a new
+// cookie when there is no valid one.
+func anonymousCSRFToken(c *gin.Context) string {
+	if token := csrfCookieToken(c); token != "" {
+		return token
+	}
+	token := newCSRFToken()
+	if token == "" {
+		return ""
+	}
+	value, err := securecookie.EncodeMulti(csrfCookie, token, sessionStore.codecs...)
+	if err != nil {
+		log.Printf("csrf: %v", err)
+		return ""
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// csrfCookieToken returns the token of the CSRF cookie of a request, "" when
+// there is none or its signature does not check out.
+func csrfCookieToken(c *gin.Context) string {
+	value, err := c.Cookie(csrfCookie)
+	if err != nil {
+		return ""
+	}
+	var token string
+	if err := securecookie.DecodeMulti(csrfCookie, value, &token, sessionStore.codecs...); err != nil {
+		return ""
+	}
+	return token
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("csrf: %v", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(SecurityHeaders{
+		ContentSecurityPolicy: defaultContentSecurityPolicy,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "same-origin",
+		HSTSMaxAge:            600,
+	}.Middleware())
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, cspNonce(c)) })
+
+	nonces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		nonce := w.Body.String()
+		if nonce == "" || nonces[nonce] {
+			t.Fatalf("nonce %q is empty or reused", nonce)
+		}
+		nonces[nonce] = true
+		if policy := w.Header().Get("Content-Security-Policy"); !strings.Contains(policy, "script-src 'self' 'nonce-"+nonce+"'") {
+			t.Errorf("Content-Security-Policy %q lacks the nonce %q", policy, nonce)
+		}
+		for header, want := range map[string]string{
+			"X-Frame-Options":           "DENY",
+			"Referrer-Policy":           "same-origin",
+			"X-Content-Type-Options":    "nosniff",
+			"Strict-Transport-Security": "",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("%s = %q, want %q", header, got, want)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r.ServeHTTP(w, req)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=600; includeSubDomains" {
+		t.Errorf("Strict-Transport-Security over HTTPS = %q", got)
+	}
+
+	r = gin.New()
+	r.Use(SecurityHeaders{ReferrerPolicy: "no-referrer"}.Middleware())
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, cspNonce(c)) })
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Header().Get("Content-Security-Policy") != "" || w.Header().Get("X-Frame-Options") != "" || w.Body.String() != "" {
+		t.Errorf("disabled headers were sent: %v", w.Header())
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newMemorySessions()
+	defer func(saved *ServerStore) { sessionStore = saved }(sessionStore)
+	sessionStore = NewServerStore(backend, time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	r := gin.New()
+	r.Use(sessions.Sessions("session", sessionStore))
+	r.Use(csrfProtect)
+	r.GET("/form", func(c *gin.Context) { c.String(http.StatusOK, csrfToken(c)) })
+	r.POST("/form", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.POST("/login", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Clear()
+		session.Set("sid", newSessionId())
+		session.Set("user", "jason")
+		session.Save()
+	})
+	r.POST("/logout", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Options(sessions.Options{Path: "/", MaxAge: -1})
+		session.Save()
+	})
+
+	cookies := make(map[string]*http.Cookie)
+	do := func(method, path, token string, header bool) *httptest.ResponseRecorder {
+		t.Helper()
+		var req *http.Request
+		if method == http.MethodPost && !header {
+			req = httptest.NewRequest(method, path, strings.NewReader(url.Values{csrfFormField: {token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, path, nil)
+			if token != "" {
+				req.Header.Set(csrfHeader, token)
+			}
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		for _, cookie := range w.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		return w
+	}
+	post := func(name, token string, header bool, status int) {
+		t.Helper()
+		if w := do(http.MethodPost, "/form", token, header); w.Code != status {
+			t.Errorf("%s: got %d, want %d", name, w.Code, status)
+		}
+	}
+
+	post("without a token", "", false, http.StatusForbidden)
+	anonymous := do(http.MethodGet, "/form", "", false).Body.String()
+	if again := do(http.MethodGet, "/form", "", false).Body.String(); again != anonymous {
+		t.Errorf("the anonymous token changed: %q, then %q", anonymous, again)
+	}
+	if records, _ := backend.List(); len(records) != 0 {
+		t.Errorf("anonymous pages stored %d sessions", len(records))
+	}
+	post("wrong token", anonymous+"x", false, http.StatusForbidden)
+	post("anonymous form field", anonymous, false, http.StatusNoContent)
+	post("anonymous header", anonymous, true, http.StatusNoContent)
+	signed := cookies[csrfCookie]
+	cookies[csrfCookie] = &http.Cookie{Name: csrfCookie, Value: anonymous}
+	post("unsigned cookie", anonymous, false, http.StatusForbidden)
+	cookies[csrfCookie] = signed
+
+	if w := do(http.MethodPost, "/login", anonymous, false); w.Code != http.StatusOK {
+		t.Fatalf("login: got %d", w.Code)
+	}
+	post("anonymous token once signed in", anonymous, false, http.StatusForbidden)
+	token := do(http.MethodGet, "/form", "", false).Body.String()
+	if token == anonymous {
+		t.Fatal("the session reused the anonymous token")
+	}
+	if again := do(http.MethodGet, "/form", "", false).Body.String(); again != token {
+		t.Errorf("the token changed within a session: %q, then %q", token, again)
+	}
+	post("session form field", token, false, http.StatusNoContent)
+	post("session header", token, true, http.StatusNoContent)
+
+	if w := do(http.MethodPost, "/logout", token, false); w.Code != http.StatusOK {
+		t.Fatalf("logout: got %d", w.Code)
+	}
+	delete(cookies, "session")
+	post("the token outlived its session", token, false, http.StatusForbidden)
+}
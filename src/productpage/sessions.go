@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+)
+
+// Sessions are kept server-side; the cookie only carries the signed id of
+// the session, so signing out ends a session for good. SESSION_STORE picks
+// where they are kept: "memory", the default, forgets them on restart, and
+// "file" keeps one file per session in SESSION_DIR (default sessions).
+// Sessions end SESSION_MAX_AGE (default 24h) after they started, or
+// SESSION_IDLE_TIMEOUT (default 30m) after their last request.
+
+// SessionRecord is a session as kept by a backend.
+type SessionRecord struct {
+	Id       string
+	Values   map[interface{}]interface{}
+	Created  time.Time
+	LastSeen time.Time
+}
+
+// SessionBackend keeps session records. Load returns nil for unknown ids.
+type SessionBackend interface {
+	Load(id string) (*SessionRecord, error)
+	Save(record *SessionRecord) error
+	Delete(id string) error
+	List() ([]*SessionRecord, error)
+}
+
+const (
+	// sessionTouchInterval limits how often requests write the time they
+	// were last seen, which only matters to the idle timeout.
+	sessionTouchInterval = time.Minute
+	// sessionSweepInterval is how often ended sessions are removed.
+	sessionSweepInterval = 5 * time.Minute
+)
+
+// ServerStore implements sessions.Store on top of a SessionBackend. The id
+// of a session is its "sid" value, so setting a new one, as signing in
+// does, moves the session to a new id and drops the old one.
+type ServerStore struct {
+	backend     SessionBackend
+	codecs      []securecookie.Codec
+	options     *gsessions.Options
+	maxAge      time.Duration
+	idleTimeout time.Duration
+	now         func() time.Time
+}
+
+var sessionStore *ServerStore
+
+func newServerStoreFromEnv() *ServerStore {
+	var backend SessionBackend
+	switch kind := os.Getenv("SESSION_STORE"); kind {
+	case "", "memory":
+		backend = newMemorySessions()
+	case "file":
+		dir := "sessions"
+		if value, ok := os.LookupEnv("SESSION_DIR"); ok {
+			dir = value
+		}
+		var err error
+		if backend, err = newFileSessions(dir); err != nil {
+			log.Fatalf("session store: %v", err)
+		}
+	default:
+		log.Fatalf("unknown SESSION_STORE %q, use memory or file", kind)
+	}
+	durationEnv := func(name string, fallback time.Duration) time.Duration {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return fallback
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s %q", name, value)
+		}
+		return d
+	}
+	return NewServerStore(backend, durationEnv("SESSION_MAX_AGE", 24*time.Hour), durationEnv("SESSION_IDLE_TIMEOUT", 30*time.Minute), sessionKey())
+}
+
+func NewServerStore(backend SessionBackend, maxAge, idleTimeout time.Duration, keyPairs ...[]byte) *ServerStore {
+	return &ServerStore{
+		backend:     backend,
+		codecs:      securecookie.CodecsFromPairs(keyPairs...),
+		options:     &gsessions.Options{Path: "/"},
+		maxAge:      maxAge,
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+	}
+}
+
+func (s *ServerStore) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+func (s *ServerStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session named by the cookie of the request, or a new one
+// when there is none or it has ended.
+func (s *ServerStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		// Signed with another key, or left over from the cookie store.
+		return session, nil
+	}
+	record, err := s.backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	now := s.now()
+	if record == nil || !s.active(record, now) {
+		return session, nil
+	}
+	if now.Sub(record.LastSeen) >= sessionTouchInterval {
+		record.LastSeen = now
+		if err := s.backend.Save(record); err != nil {
+			log.Printf("session: %v", err)
+		}
+	}
+	session.ID = record.Id
+	session.Values = record.Values
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session to the backend and its id to the cookie. A
+// negative MaxAge deletes the session.
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	sid, _ := session.Values["sid"].(string)
+	if sid == "" {
+		sid = newSessionId()
+		session.Values["sid"] = sid
+	}
+	now := s.now()
+	record := &SessionRecord{Id: sid, Values: session.Values, Created: now, LastSeen: now}
+	if sid == session.ID {
+		existing, err := s.backend.Load(sid)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			record.Created = existing.Created
+		}
+	} else if session.ID != "" {
+		if err := s.backend.Delete(session.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.backend.Save(record); err != nil {
+		return err
+	}
+	session.ID = sid
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), sid, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *ServerStore) active(record *SessionRecord, now time.Time) bool {
+	return now.Before(s.expires(record))
+}
+
+// expires returns when a session ends unless it sees another request.
+func (s *ServerStore) expires(record *SessionRecord) time.Time {
+	end := record.Created.Add(s.maxAge)
+	if idle := record.LastSeen.Add(s.idleTimeout); idle.Before(end) {
+		return idle
+	}
+	return end
+}
+
+// Active returns the sessions that have not ended.
+func (s *ServerStore) Active() ([]*SessionRecord, error) {
+	records, err := s.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	active := records[:0]
+	for _, record := range records {
+		if s.active(record, now) {
+			active = append(active, record)
+		}
+	}
+	return active, nil
+}
+
+// Run removes ended sessions from the backend until ctx is done.
+func (s *ServerStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := s.sweep(); err != nil {
+			log.Printf("session: sweep: %v", err)
+		} else if n > 0 {
+			log.Printf("session: removed %d ended sessions", n)
+		}
+	}
+}
+
+func (s *ServerStore) sweep() (int, error) {
+	records, err := s.backend.List()
+	if err != nil {
+		return 0, err
+	}
+	now := s.now()
+	removed := 0
+	for _, record := range records {
+		if !s.active(record, now) {
+			if err := s.backend.Delete(record.Id); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// memorySessions keeps sessions in memory. Records are copied in and out,
+// as requests of the same session may run at the same time.
+type memorySessions struct {
+	mu      sync.Mutex
+	records map[string]*SessionRecord
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{records: make(map[string]*SessionRecord)}
+}
+
+func copyRecord(record *SessionRecord) *SessionRecord {
+	c := *record
+	c.Values = make(map[interface{}]interface{}, len(record.Values))
+	for k, v := range record.Values {
+		c.Values[k] = v
+	}
+	return &c
+}
+
+func (m *memorySessions) Load(id string) (*SessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.records[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyRecord(record), nil
+}
+
+func (m *memorySessions) Save(record *SessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[record.Id] = copyRecord(record)
+	return nil
+}
+
+func (m *memorySessions) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, id)
+	return nil
+}
+
+func (m *memorySessions) List() ([]*SessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([]*SessionRecord, 0, len(m.records))
+	for _, record := range m.records {
+		records = append(records, copyRecord(record))
+	}
+	return records, nil
+}
+
+// fileSessions keeps every session in a gob encoded file of its own, so
+// sessions survive restarts and can be shared by replicas on one volume.
+type fileSessions struct {
+	dir string
+}
+
+// sessionIdPattern matches the ids of newSessionId, which keeps ids taken
+// from elsewhere out of file names.
+var sessionIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+const sessionFileSuffix = ".session"
+
+func newFileSessions(dir string) (*fileSessions, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessions{dir: dir}, nil
+}
+
+func (f *fileSessions) path(id string) (string, error) {
+	if !sessionIdPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	return filepath.Join(f.dir, id+sessionFileSuffix), nil
+}
+
+func (f *fileSessions) Load(id string) (*SessionRecord, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var record SessionRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+		return nil, fmt.Errorf("session %s: %v", path, err)
+	}
+	return &record, nil
+}
+
+// Save replaces the file of a session through a rename, so that a crash
+// leaves either the old or the new session behind.
+func (f *fileSessions) Save(record *SessionRecord) error {
+	path, err := f.path(record.Id)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *fileSessions) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *fileSessions) List() ([]*SessionRecord, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var records []*SessionRecord
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), sessionFileSuffix)
+		if id == entry.Name() || !sessionIdPattern.MatchString(id) {
+			continue
+		}
+		record, err := f.Load(id)
+		if err != nil {
+			log.Printf("session: %v", err)
+			continue
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
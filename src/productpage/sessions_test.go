@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gsessions "github.com/gorilla/sessions"
+)
+
+func TestServerStore(t *testing.T) {
+	files, err := newFileSessions(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, backend := range map[string]SessionBackend{"memory": newMemorySessions(), "file": files} {
+		t.Run(name, func(t *testing.T) {
+			testServerStore(t, backend)
+		})
+	}
+}
+
+func testServerStore(t *testing.T, backend SessionBackend) {
+	now := time.Unix(1700000000, 0)
+	store := NewServerStore(backend, 2*time.Hour, 30*time.Minute, []byte("0123456789abcdef0123456789abcdef"))
+	store.now = func() time.Time { return now }
+
+	var cookie *http.Cookie
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	load := func() *gsessions.Session {
+		t.Helper()
+		s, err := store.New(request(), "session")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	save := func(s *gsessions.Session) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := store.Save(request(), w, s); err != nil {
+			t.Fatal(err)
+		}
+		cookie = w.Result().Cookies()[0]
+	}
+
+	s := load()
+	s.Values["loginError"] = "wrong password"
+	s.Values["roles"] = []string{"admin"}
+	s.Values["tokenExpires"] = int64(42)
+	save(s)
+	anonymous := s.ID
+
+	s = load()
+	if s.IsNew || s.Values["loginError"] != "wrong password" || s.Values["tokenExpires"] != int64(42) {
+		t.Fatalf("loaded %v", s.Values)
+	}
+	if roles, _ := s.Values["roles"].([]string); len(roles) != 1 {
+		t.Fatalf("loaded roles %v", s.Values["roles"])
+	}
+
+	// Signing in sets a new sid, which moves the session.
+	s.Values = map[interface{}]interface{}{"sid": newSessionId(), "user": "jason"}
+	save(s)
+	if s.ID == anonymous {
+		t.Fatal("the session id did not change at sign in")
+	}
+	if record, _ := backend.Load(anonymous); record != nil {
+		t.Error("the session from before signing in is still there")
+	}
+	if active, _ := store.Active(); len(active) != 1 || active[0].Values["user"] != "jason" {
+		t.Errorf("active sessions: %v", active)
+	}
+
+	// Requests keep the session from idling out, until it is too old.
+	for i := 0; i < 4; i++ {
+		now = now.Add(25 * time.Minute)
+		if s = load(); s.IsNew {
+			t.Fatalf("session idled out after %d requests", i)
+		}
+	}
+	now = now.Add(25 * time.Minute)
+	if s = load(); !s.IsNew {
+		t.Error("session outlived its maximum age")
+	}
+	if n, err := store.sweep(); n != 1 || err != nil {
+		t.Errorf("sweep removed %d sessions, %v", n, err)
+	}
+
+	s = load()
+	s.Values["user"] = "alice"
+	save(s)
+	stolen := cookie
+	now = now.Add(31 * time.Minute)
+	if s = load(); !s.IsNew {
+		t.Error("session did not idle out")
+	}
+
+	cookie = stolen
+	now = now.Add(-31 * time.Minute)
+	s = load()
+	s.Options.MaxAge = -1
+	save(s)
+	cookie = stolen
+	if s = load(); !s.IsNew {
+		t.Error("session survived signing out")
+	}
+}
+
+func TestServerStoreRejectsForgedCookies(t *testing.T) {
+	store := NewServerStore(newMemorySessions(), time.Hour, time.Hour, []byte("0123456789abcdef0123456789abcdef"))
+	s, _ := store.New(httptest.NewRequest(http.MethodGet, "/", nil), "session")
+	s.Values["user"] = "jason"
+	w := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest(http.MethodGet, "/", nil), w, s); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{s.ID, w.Result().Cookies()[0].Value + "x"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: value})
+		if loaded, _ := store.New(r, "session"); !loaded.IsNew {
+			t.Errorf("cookie %q loaded a session", value)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The users who can sign in are kept in a file of "name:bcrypt hash:roles"
+// lines, roles being comma separated and optional, in USERS_FILE (default
+// users.txt), which the useradd subcommand maintains.
+// The file is read again whenever it changes, so users can be added while
+// the product page is running.
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrLockedOut          = errors.New("too many failed sign ins, try again later")
+)
+
+const (
+	// maxLoginFailures failed sign ins within loginFailureWindow lock the
+	// account for lockoutDuration.
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+	lockoutDuration    = 15 * time.Minute
+)
+
+// dummyHash is compared against when the user does not exist, so the time
+// a sign in takes does not tell whether the username is known.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+type userEntry struct {
+	hash  []byte
+	roles []string
+}
+
+type userStore struct {
+	path string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	entries  map[string]userEntry
+	failures map[string]*loginFailures
+	swept    time.Time
+	now      func() time.Time
+}
+
+var users = newUserStore(usersFile())
+
+func usersFile() string {
+	value, ok := os.LookupEnv("USERS_FILE")
+	if !ok {
+		return "users.txt"
+	}
+	return value
+}
+
+func newUserStore(path string) *userStore {
+	return &userStore{path: path, entries: map[string]userEntry{}, failures: map[string]*loginFailures{}, now: time.Now}
+}
+
+// reload reads the users file if it changed since the last read. A missing
+// file means there are no users. The caller holds the lock.
+func (s *userStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.entries, s.modTime = map[string]userEntry{}, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	entries, err := readUsers(s.path)
+	if err != nil {
+		return err
+	}
+	s.entries, s.modTime = entries, info.ModTime()
+	return nil
+}
+
+func readUsers(path string) (map[string]userEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make(map[string]userEntry)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash:roles", path, line)
+		}
+		entry := userEntry{hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			entry.roles = splitRoles(fields[2])
+		}
+		entries[fields[0]] = entry
+	}
+	return entries, scanner.Err()
+}
+
+func splitRoles(list string) []string {
+	var roles []string
+	for _, role := range strings.Split(list, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// Authenticate checks the password of a user. After maxLoginFailures
+// failures the account is locked out for a while, and during that time
+// even the right password is refused.
+func (s *userStore) Authenticate(name, password string) error {
+	s.mu.Lock()
+	if err := s.reload(); err != nil {
+		log.Printf("users: %v", err)
+	}
+	entry, known := s.entries[name]
+	hash := entry.hash
+	f := s.failures[name]
+	now := s.now()
+	if f != nil && now.Before(f.lockedUntil) {
+		s.mu.Unlock()
+		return ErrLockedOut
+	}
+	s.mu.Unlock()
+
+	// bcrypt is slow on purpose, so compare without holding the lock.
+	if !known {
+		hash = dummyHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if known && err == nil {
+		delete(s.failures, name)
+		return nil
+	}
+	s.sweepFailures(now)
+	f = s.failures[name]
+	if f == nil || now.Sub(f.first) > loginFailureWindow {
+		f = &loginFailures{first: now}
+		s.failures[name] = f
+	}
+	f.count++
+	if f.count >= maxLoginFailures {
+		f.lockedUntil = now.Add(lockoutDuration)
+		log.Printf("users: locked out %q after %d failed sign ins", name, f.count)
+	}
+	return ErrInvalidCredentials
+}
+
+// sweepFailures forgets the failures that no longer count and the lockouts
+// that have ended, so that sign ins with made up names do not pile up. It
+// sweeps at most once per loginFailureWindow. The caller holds the lock.
+func (s *userStore) sweepFailures(now time.Time) {
+	if now.Sub(s.swept) < loginFailureWindow {
+		return
+	}
+	s.swept = now
+	for name, f := range s.failures {
+		if now.Sub(f.first) > loginFailureWindow && !now.Before(f.lockedUntil) {
+			delete(s.failures, name)
+		}
+	}
+}
+
+// Roles returns the roles of a user.
+func (s *userStore) Roles(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Printf("users: %v", err)
+	}
+	return s.entries[name].roles
+}
+
+// SetPassword adds a user to the users file, or changes their password.
+// The roles of an existing user are kept when roles is nil.
+func (s *userStore) SetPassword(name, password string, roles []string) error {
+	if name == "" || strings.ContainsAny(name, ":\r\n") {
+		return fmt.Errorf("invalid username %q", name)
+	}
+	for _, role := range roles {
+		if strings.ContainsAny(role, ":,\r\n") {
+			return fmt.Errorf("invalid role %q", role)
+		}
+	}
+	if password == "" {
+		return errors.New("the password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make(map[string]userEntry)
+	if _, err := os.Stat(s.path); err == nil {
+		if entries, err = readUsers(s.path); err != nil {
+			return err
+		}
+	}
+	if roles == nil {
+		roles = entries[name].roles
+	}
+	entries[name] = userEntry{hash: hash, roles: roles}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	names := make([]string, 0, len(entries))
+	for user := range entries {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	w := bufio.NewWriter(tmp)
+	for _, user := range names {
+		fmt.Fprintf(w, "%s:%s:%s\n", user, entries[user].hash, strings.Join(entries[user].roles, ","))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	s.modTime = time.Time{}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// sessionKey returns the key that signs the session cookie, from
+// SESSION_KEY, or the file named by SESSION_KEY_FILE. Without either a
+// random key is used, and sessions do not survive a restart.
+func sessionKey() []byte {
+	if value, ok := os.LookupEnv("SESSION_KEY"); ok && value != "" {
+		return []byte(value)
+	}
+	if path, ok := os.LookupEnv("SESSION_KEY_FILE"); ok && path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("session key: %v", err)
+		}
+		return []byte(strings.TrimSpace(string(key)))
+	}
+	log.Println("SESSION_KEY is not set, using a random session key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// newSessionId returns a random identifier, stored in the session at sign
+// in so that every sign in starts a new session.
+func newSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// runUseradd implements `productpage useradd [-file path] [-roles list]
+// <name>`, reading the password from the first line of stdin:
+//
+//	read -rs PASSWORD && echo "$PASSWORD" | productpage useradd jason
+func runUseradd(args []string) int {
+	fs := flag.NewFlagSet("useradd", flag.ContinueOnError)
+	file := fs.String("file", usersFile(), "users file")
+	roleList := fs.String("roles", "", "comma separated roles, default: keep the roles of an existing user")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: productpage useradd [-file path] [-roles list] <name> < password")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "useradd: no password on stdin")
+		return 1
+	}
+	password := strings.TrimRight(line, "\r\n")
+
+	var roles []string
+	if *roleList != "" {
+		roles = splitRoles(*roleList)
+	}
+	if err := newUserStore(*file).SetPassword(fs.Arg(0), password, roles); err != nil {
+		fmt.Fprintf(os.Stderr, "useradd: %v\n", err)
+		return 1
+	}
+	return 0
+}
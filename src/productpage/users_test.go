@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	s := newUserStore(path)
+	if err := s.Authenticate("jason", "jason"); err != ErrInvalidCredentials {
+		t.Errorf("without a users file: got %v, want %v", err, ErrInvalidCredentials)
+	}
+	if err := s.SetPassword("jason", "s3cret", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Authenticate("jason", "s3cret"); err != nil {
+		t.Errorf("right password: %v", err)
+	}
+	if err := s.Authenticate("jason", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if err := s.Authenticate("nobody", "s3cret"); err != ErrInvalidCredentials {
+		t.Errorf("unknown user: got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "jason:$2a$") || strings.Contains(string(data), "s3cret") {
+		t.Errorf("users file holds %q, want a bcrypt hash", data)
+	}
+}
+
+func TestUserStoreLocksOut(t *testing.T) {
+	s := newUserStore(filepath.Join(t.TempDir(), "users.txt"))
+	if err := s.SetPassword("jason", "s3cret", nil); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < maxLoginFailures; i++ {
+		if err := s.Authenticate("jason", "wrong"); err != ErrInvalidCredentials {
+			t.Fatalf("failure %d: got %v", i+1, err)
+		}
+	}
+	if err := s.Authenticate("jason", "s3cret"); err != ErrLockedOut {
+		t.Errorf("right password while locked out: got %v, want %v", err, ErrLockedOut)
+	}
+
+	now = now.Add(lockoutDuration + time.Second)
+	if err := s.Authenticate("jason", "s3cret"); err != nil {
+		t.Errorf("right password after the lockout: %v", err)
+	}
+}
+
+func TestSetPasswordRejectsBadNames(t *testing.T) {
+	s := newUserStore(filepath.Join(t.TempDir(), "users.txt"))
+	for _, name := range []string{"", "a:b", "a\nb"} {
+		if err := s.SetPassword(name, "pw", nil); err == nil {
+			t.Errorf("SetPassword(%q) succeeded", name)
+		}
+	}
+}
+
+func TestUserStoreRoles(t *testing.T) {
+	s := newUserStore(filepath.Join(t.TempDir(), "users.txt"))
+	if err := s.SetPassword("jason", "s3cret", []string{"admin", "moderator"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPassword("jason", "changed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if roles := s.Roles("jason"); len(roles) != 2 || roles[0] != "admin" || roles[1] != "moderator" {
+		t.Errorf("roles = %v, want the roles kept on a password change", roles)
+	}
+	if roles := s.Roles("nobody"); roles != nil {
+		t.Errorf("roles of an unknown user = %v", roles)
+	}
+}
+
+func TestUserStoreSweepsFailures(t *testing.T) {
+	s := newUserStore(filepath.Join(t.TempDir(), "users.txt"))
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	for _, name := range []string{"a", "b", "c"} {
+		s.Authenticate(name, "wrong")
+	}
+	now = now.Add(10 * time.Minute)
+	for i := 0; i < maxLoginFailures; i++ {
+		s.Authenticate("locked", "wrong")
+	}
+
+	now = now.Add(loginFailureWindow - 10*time.Minute + time.Second)
+	s.Authenticate("d", "wrong")
+	if len(s.failures) != 2 || s.failures["locked"] == nil || s.failures["d"] == nil {
+		t.Errorf("failures after the window: %v", s.failures)
+	}
+	now = now.Add(lockoutDuration + loginFailureWindow)
+	s.Authenticate("e", "wrong")
+	if len(s.failures) != 1 || s.failures["e"] == nil {
+		t.Errorf("failures after the lockout: %v", s.failures)
+	}
+}
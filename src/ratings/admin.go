@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+)
+
+var adminToken string
+
+func init() {
+	adminToken = os.Getenv("RATINGS_ADMIN_TOKEN")
+}
+
+// requireAdmin accepts requests carrying `Authorization: Bearer <token>` with
+// the token configured in RATINGS_ADMIN_TOKEN, or a JWT granting the admin
+// role. Without either the admin API is disabled.
+func requireAdmin(c *gin.Context) {
+	if auth.ClaimsOf(c).HasRole("admin") {
+		c.Next()
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		auditLog.Record(c, audit.Entry{Action: "admin.denied", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin credentials required"})
+		return
+	}
+	c.Next()
+}
+
+// actor names who performed an admin action, for the logs: the subject of
+// a verified token, else the holder of the admin token. The end-user
+// header is never trusted here.
+func actor(c *gin.Context) string {
+	if claims := auth.ClaimsOf(c); claims != nil {
+		return claims.Subject
+	}
+	return "admin"
+}
+
+// registerOutboxRoutes exposes the state of the outbox under path for admins.
+func registerOutboxRoutes(r *gin.Engine, path string, auth gin.HandlerFunc) {
+	r.GET(path, auth, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"targets":     events.Targets(),
+			"pending":     events.Pending(),
+			"deadLetters": events.DeadLetters(),
+		})
+	})
+	r.POST(path+"/redrive", auth, func(c *gin.Context) {
+		redriven := events.Redrive()
+		auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "outbox.redrive", Details: map[string]string{"redriven": strconv.Itoa(redriven)}})
+		c.JSON(http.StatusOK, gin.H{"redriven": redriven})
+	})
+}
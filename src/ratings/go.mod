@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/gin-gonic/gin v1.8.2
+	go-bookinfo.local/common v0.0.0
 	go.mongodb.org/mongo-driver v1.11.1
 )
 
@@ -36,3 +37,5 @@ require (
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace go-bookinfo.local/common => ../common
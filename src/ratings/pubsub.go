@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RatingEvent is a rating change as published to subscribers. Ids increase
+// with every event, so a client that lost its connection can ask for the
+// events after the last one it saw.
+type RatingEvent struct {
+	Id     int64
+	Record RatingRecord
+}
+
+// ratingBroker fans rating changes out to the subscribers of a product. It
+// keeps the most recent events to replay them to reconnecting subscribers.
+// A subscriber that falls too far behind is dropped rather than slowing
+// down the writes; it reconnects and catches up from the replay.
+type ratingBroker struct {
+	mu          sync.Mutex
+	nextId      int64
+	recent      []RatingEvent
+	subscribers map[*ratingSubscriber]struct{}
+}
+
+type ratingSubscriber struct {
+	productId int
+	updates   chan RatingEvent
+}
+
+const (
+	// maxRecentRatingEvents is how many events are kept for replay.
+	maxRecentRatingEvents = 256
+	// subscriberBuffer is how many events a subscriber may lag behind.
+	subscriberBuffer = 32
+	// heartbeatInterval keeps idle streams from being cut by proxies.
+	heartbeatInterval = 15 * time.Second
+)
+
+var ratingEvents = newRatingBroker()
+
+func newRatingBroker() *ratingBroker {
+	return &ratingBroker{nextId: 1, subscribers: make(map[*ratingSubscriber]struct{})}
+}
+
+// Publish sends a rating change to the subscribers of its product. It never
+// blocks, so it is safe to call while holding the lock of the write.
+func (b *ratingBroker) Publish(record RatingRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	event := RatingEvent{Id: b.nextId, Record: record}
+	b.nextId++
+	b.recent = append(b.recent, event)
+	if len(b.recent) > maxRecentRatingEvents {
+		b.recent = b.recent[len(b.recent)-maxRecentRatingEvents:]
+	}
+	for s := range b.subscribers {
+		if s.productId != record.ProductId {
+			continue
+		}
+		select {
+		case s.updates <- event:
+		default:
+			delete(b.subscribers, s)
+			close(s.updates)
+		}
+	}
+}
+
+// Subscribe returns the events of a product after lastId, a channel of the
+// ones to come and a function to stop the subscription. The channel is
+// closed when the subscriber is dropped for falling behind.
+func (b *ratingBroker) Subscribe(productId int, lastId int64) ([]RatingEvent, <-chan RatingEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var backlog []RatingEvent
+	if lastId > 0 {
+		for _, event := range b.recent {
+			if event.Id > lastId && event.Record.ProductId == productId {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	s := &ratingSubscriber{productId: productId, updates: make(chan RatingEvent, subscriberBuffer)}
+	b.subscribers[s] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[s]; ok {
+			delete(b.subscribers, s)
+			close(s.updates)
+		}
+	}
+	return backlog, s.updates, cancel
+}
+
+// streamRatings serves the rating changes of a product as Server-Sent
+// Events named "rating". It honours Last-Event-ID and sends a comment every
+// heartbeatInterval while there is nothing to report.
+func streamRatings(c *gin.Context) {
+	productId, err := strconv.Atoi(c.Param("productId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "please provide numeric product ID",
+		})
+		return
+	}
+	lastId, _ := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+	backlog, updates, cancel := ratingEvents.Subscribe(productId, lastId)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", 3000)
+	for _, event := range backlog {
+		writeRatingEvent(c.Writer, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-updates:
+			if !ok {
+				return
+			}
+			writeRatingEvent(c.Writer, event)
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": keepalive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeRatingEvent(w io.Writer, event RatingEvent) {
+	data, _ := json.Marshal(event.Record)
+	fmt.Fprintf(w, "id: %d\nevent: rating\ndata: %s\n\n", event.Id, data)
+}
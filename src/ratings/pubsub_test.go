@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestRatingBrokerDeliversPerProduct(t *testing.T) {
+	b := newRatingBroker()
+	_, updates, cancel := b.Subscribe(1, 0)
+	defer cancel()
+
+	b.Publish(RatingRecord{ProductId: 0, Reviewer: "Reviewer1", Stars: 3})
+	b.Publish(RatingRecord{ProductId: 1, Reviewer: "Reviewer2", Stars: 2})
+
+	event := <-updates
+	if event.Record.ProductId != 1 || event.Record.Stars != 2 || event.Id != 2 {
+		t.Errorf("got %+v, want the rating of product 1 with id 2", event)
+	}
+	select {
+	case extra := <-updates:
+		t.Errorf("unexpected event %+v", extra)
+	default:
+	}
+}
+
+func TestRatingBrokerReplaysAfterLastId(t *testing.T) {
+	b := newRatingBroker()
+	for stars := 1; stars <= 4; stars++ {
+		b.Publish(RatingRecord{ProductId: 0, Reviewer: "Reviewer1", Stars: stars})
+	}
+	b.Publish(RatingRecord{ProductId: 1, Reviewer: "Reviewer1", Stars: 5})
+
+	backlog, _, cancel := b.Subscribe(0, 2)
+	defer cancel()
+	if len(backlog) != 2 || backlog[0].Id != 3 || backlog[1].Id != 4 {
+		t.Errorf("backlog = %+v, want events 3 and 4", backlog)
+	}
+
+	fresh, _, cancelFresh := b.Subscribe(0, 0)
+	defer cancelFresh()
+	if len(fresh) != 0 {
+		t.Errorf("a new subscriber got a backlog of %d events", len(fresh))
+	}
+}
+
+func TestRatingBrokerDropsSlowSubscribers(t *testing.T) {
+	b := newRatingBroker()
+	_, updates, cancel := b.Subscribe(0, 0)
+	defer cancel()
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(RatingRecord{ProductId: 0, Reviewer: "Reviewer1", Stars: 1 + i%5})
+	}
+	n := 0
+	for range updates {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", n, subscriberBuffer)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+	"go-bookinfo.local/common/mtls"
+	"go-bookinfo.local/common/ratelimit"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -15,13 +18,11 @@ import (
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 var healthy = true
 var unavailable = false
-var userAddedRatings []Result // used to demonstrate POST functionality
 
 var db *sql.DB
 
@@ -31,6 +32,24 @@ var username string
 var password string
 var url string
 
+// meshTLS is nil, leaving the services on plain HTTP, unless TLS_CERT_FILE
+// and TLS_KEY_FILE are set.
+var meshTLS = mtls.NewFromEnv()
+
+// jwtVerifier is nil, verifying nothing, unless JWT_JWKS_URL is set.
+var jwtVerifier = auth.NewJWTVerifierFromEnv(meshTLS.Transport("productpage"))
+
+// authorizer is nil, allowing every request, unless AUTHZ_POLICY_FILE is
+// set.
+var authorizer = auth.NewAuthorizerFromEnv()
+
+// rateLimiter is nil, limiting nothing, unless RATE_LIMIT_FILE is set.
+var rateLimiter = ratelimit.NewFromEnv()
+
+// auditLog is nil, leaving the entries to the service log, unless
+// AUDIT_LOG_DIR is set.
+var auditLog *audit.Log
+
 type Reviewer struct {
 	Reviewer1 int `json:"Reviewer1"`
 	Reviewer2 int `json:"Reviewer2"`
@@ -96,7 +115,14 @@ func init() {
 }
 
 func main() {
+	auditLog = audit.NewFromEnv("ratings")
+	go events.Run(context.Background())
+
 	r := gin.Default()
+	r.Use(jwtVerifier.Middleware())
+	r.Use(rateLimiter.Middleware(ratelimit.TokenIdentity))
+	r.Use(authorizer.Middleware(mtls.PeerPrincipal))
+	r.GET("/metrics", rateLimiter.Metrics)
 	r.GET("/health", func(c *gin.Context) {
 		fmt.Println("health check")
 		if healthy {
@@ -110,41 +136,61 @@ func main() {
 		}
 
 	})
-	r.POST("/^\\/ratings\\/[0-9]*/", func(c *gin.Context) {
-		req := c.Request
-		productIdStr := strings.Split(req.URL.Path, "/")[0]
-		productId, err := strconv.Atoi(productIdStr)
+	r.POST("/ratings/:productId", requireLocalStore, func(c *gin.Context) {
+		productId, err := strconv.Atoi(c.Param("productId"))
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "please provide numeric product ID",
 			})
-			log.Fatal(err)
 			return
-		} else {
-			var body []byte
-			_, err := req.Body.Read(body)
-			if err != nil {
-				log.Fatal(err)
-			}
-			var reviewer Reviewer
-			err = json.Unmarshal([]byte(body), &reviewer)
-			if err != nil {
-				log.Fatal(err)
+		}
+		var ratings map[string]int
+		if err := c.ShouldBindJSON(&ratings); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "please provide valid ratings JSON",
+			})
+			return
+		}
+		for reviewer, stars := range ratings {
+			if stars < 1 || stars > 5 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": fmt.Sprintf("rating of %s must be between 1 and 5", reviewer),
+				})
+				return
 			}
-			c.JSON(http.StatusBadRequest, putLocalReviews(productId, reviewer))
 		}
+		details := make(map[string]string, len(ratings))
+		for reviewer, stars := range ratings {
+			details[reviewer] = strconv.Itoa(stars)
+		}
+		auditLog.Record(c, audit.Entry{
+			Action:  "rating.write",
+			Target:  fmt.Sprintf("product/%d", productId),
+			Details: details,
+		})
+		c.JSON(http.StatusOK, putLocalReviews(productId, ratings))
 	})
-	r.GET("/^\\/ratings\\/[0-9]*/", func(c *gin.Context) {
-		req := c.Request
-		productIdStr := strings.Split(req.URL.Path, "/")[0]
-		productId, err := strconv.Atoi(productIdStr)
+	registerOutboxRoutes(r, "/ratings/outbox", requireAdmin)
+	auditLog.RegisterRoutes(r, "/ratings/audit", requireAdmin)
+	r.GET("/ratings/:productId/events", requireLocalStore, streamRatings)
+	r.GET("/ratings/:productId/history", requireLocalStore, func(c *gin.Context) {
+		productId, err := strconv.Atoi(c.Param("productId"))
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "please provide numeric product ID",
 			})
-			log.Fatal(err)
 			return
-		} else if os.Getenv("SERVICE_VERSION") == "v2" {
+		}
+		c.JSON(http.StatusOK, store.History(productId))
+	})
+	r.GET("/ratings/:productId", func(c *gin.Context) {
+		productId, err := strconv.Atoi(c.Param("productId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "please provide numeric product ID",
+			})
+			return
+		} else if databaseBacked() {
 			var firstRating = 0
 			var secondRating = 0
 			if os.Getenv("DB_TYPE") == "mysql" {
@@ -294,12 +340,38 @@ func main() {
 
 	})
 	http.TimeoutHandler(r, time.Second*5, "request time out")
-	r.Run(os.Args[0])
+	port := "9080"
+	if len(os.Args) > 1 {
+		port = os.Args[1]
+	}
+	if err := meshTLS.Run(r, fmt.Sprintf("0.0.0.0:%s", port)); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func putLocalReviews(productId int, ratings Reviewer) interface{} {
+// databaseBacked reports whether ratings are read from MySQL or MongoDB, as
+// in ratings v2.
+func databaseBacked() bool {
+	return os.Getenv("SERVICE_VERSION") == "v2"
+}
 
-	userAddedRatings[productId] = Result{Id: productId, Ratings: ratings}
+// requireLocalStore turns away the routes of the in-memory store when the
+// ratings come from a database instead. The database holds the current
+// ratings only, so its answers and the store's would disagree: there is no
+// history to serve, and writes and live updates would not show up in GET
+// /ratings/:productId.
+func requireLocalStore(c *gin.Context) {
+	if databaseBacked() {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{
+			"error": "ratings v2 serves the ratings database, which keeps no history and is not written to",
+		})
+		return
+	}
+	c.Next()
+}
+
+func putLocalReviews(productId int, ratings map[string]int) interface{} {
+	store.Add(productId, ratings)
 	return getLocalReviews(productId)
 }
 
@@ -314,9 +386,6 @@ func getLocalReviewsSuccessful(c *gin.Context, productId int) {
 }
 
 func getLocalReviews(productId int) interface{} {
-	if len(userAddedRatings) < productId {
-		return userAddedRatings[productId]
-	}
-	result := Result{Id: productId, Ratings: Reviewer{5, 4}}
-	return result
+	current := store.Current(productId)
+	return Result{Id: productId, Ratings: Reviewer{current["Reviewer1"], current["Reviewer2"]}}
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireLocalStore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ratings/:productId/history", requireLocalStore, func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.History(0))
+	})
+	for version, status := range map[string]int{"v1": http.StatusOK, "v2": http.StatusNotImplemented} {
+		t.Setenv("SERVICE_VERSION", version)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ratings/0/history", nil))
+		if w.Code != status {
+			t.Errorf("%s: got %d, want %d", version, w.Code, status)
+		}
+	}
+}
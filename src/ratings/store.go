@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go-bookinfo.local/common/outbox"
+)
+
+// RatingRecord is one rating given by a reviewer. Posting a new rating for a
+// reviewer adds a record; the most recent one is the reviewer's current
+// rating.
+type RatingRecord struct {
+	ProductId int       `json:"productId"`
+	Reviewer  string    `json:"reviewer"`
+	Stars     int       `json:"stars"`
+	Time      time.Time `json:"time"`
+}
+
+// ratingStore keeps the ratings of the local (non database) versions in
+// memory. Every product starts out with the classic 5 and 4 stars.
+type ratingStore struct {
+	mu      sync.RWMutex
+	records map[int][]RatingRecord
+	started time.Time
+}
+
+var store = newRatingStore()
+
+// events is the outbox the writes of the store record their events in.
+var events *outbox.Outbox
+
+func init() {
+	events = outbox.NewFromEnv("ratings")
+}
+
+func newRatingStore() *ratingStore {
+	return &ratingStore{records: make(map[int][]RatingRecord), started: time.Now().UTC()}
+}
+
+func (s *ratingStore) defaults(productId int) []RatingRecord {
+	return []RatingRecord{
+		{ProductId: productId, Reviewer: "Reviewer1", Stars: 5, Time: s.started},
+		{ProductId: productId, Reviewer: "Reviewer2", Stars: 4, Time: s.started},
+	}
+}
+
+// Add records new ratings for a product.
+func (s *ratingStore) Add(productId int, ratings map[string]int) []RatingRecord {
+	now := time.Now().UTC()
+	reviewers := make([]string, 0, len(ratings))
+	for reviewer := range ratings {
+		reviewers = append(reviewers, reviewer)
+	}
+	sort.Strings(reviewers)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[productId]; !ok {
+		s.records[productId] = s.defaults(productId)
+	}
+	added := make([]RatingRecord, 0, len(reviewers))
+	for _, reviewer := range reviewers {
+		record := RatingRecord{ProductId: productId, Reviewer: reviewer, Stars: ratings[reviewer], Time: now}
+		s.records[productId] = append(s.records[productId], record)
+		added = append(added, record)
+		events.Record("rating.updated", record)
+		ratingEvents.Publish(record)
+	}
+	return added
+}
+
+// History returns every rating recorded for a product, oldest first.
+func (s *ratingStore) History(productId int) []RatingRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records, ok := s.records[productId]
+	if !ok {
+		return s.defaults(productId)
+	}
+	return append([]RatingRecord(nil), records...)
+}
+
+// Current returns the latest rating of every reviewer of a product.
+func (s *ratingStore) Current(productId int) map[string]int {
+	current := make(map[string]int)
+	for _, record := range s.History(productId) {
+		current[record.Reviewer] = record.Stars
+	}
+	return current
+}
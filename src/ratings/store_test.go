@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-bookinfo.local/common/outbox"
+)
+
+func TestRatingStoreRecordsEvents(t *testing.T) {
+	defer func(saved *outbox.Outbox) { events = saved }(events)
+	events = outbox.New("ratings", []string{"http://hooks.example"}, "", 1, time.Minute)
+
+	s := newRatingStore()
+	s.Add(3, map[string]int{"bob": 2, "alice": 5})
+	pending := events.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("%d events pending, want 2", len(pending))
+	}
+	var record RatingRecord
+	json.Unmarshal(pending[0].Event.Data, &record)
+	if pending[0].Event.Type != "rating.updated" || pending[0].Event.Source != "ratings" || record.Reviewer != "alice" || record.Stars != 5 {
+		t.Errorf("unexpected event %+v", pending[0].Event)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+	"go-bookinfo.local/common/mtls"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var adminToken string
+
+func init() {
+	adminToken = os.Getenv("REVIEWS_ADMIN_TOKEN")
+}
+
+// requireAdmin accepts requests carrying `Authorization: Bearer <token>` with
+// the token configured in REVIEWS_ADMIN_TOKEN, or a JWT granting the admin
+// role. Without either the admin API is disabled.
+func requireAdmin(c *gin.Context) {
+	if !isAdmin(c) {
+		auditLog.Record(c, audit.Entry{Action: "admin.denied", Target: c.Request.Method + " " + c.Request.URL.Path, Outcome: audit.Failure})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin credentials required"})
+		return
+	}
+	c.Next()
+}
+
+func isAdmin(c *gin.Context) bool {
+	if auth.ClaimsOf(c).HasRole("admin") {
+		return true
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// actor names who performed an action, for the logs: the subject of a
+// verified token, an admin by token, else the calling service. The
+// end-user header is never trusted here.
+func actor(c *gin.Context) string {
+	if claims := auth.ClaimsOf(c); claims != nil {
+		return claims.Subject
+	}
+	if isAdmin(c) {
+		return "admin"
+	}
+	if peer := mtls.PeerPrincipal(c); peer != "" {
+		return peer
+	}
+	return "anonymous"
+}
+
+// registerModerationRoutes exposes the queue of held reviews. Moderators
+// approve or reject them; only approved reviews are served.
+func registerModerationRoutes(r *gin.Engine) {
+	r.GET("/reviews/moderation", requireAdmin, func(c *gin.Context) {
+		status := c.DefaultQuery("status", StatusHeld)
+		c.JSON(http.StatusOK, store.WithStatus(status))
+	})
+	r.POST("/reviews/moderation/:reviewId/approve", requireAdmin, func(c *gin.Context) {
+		moderateReview(c, StatusApproved)
+	})
+	r.POST("/reviews/moderation/:reviewId/reject", requireAdmin, func(c *gin.Context) {
+		moderateReview(c, StatusRejected)
+	})
+}
+
+// registerTransferRoutes exposes bulk export and import of all reviews, see
+// transfer.go.
+func registerTransferRoutes(r *gin.Engine) {
+	r.GET("/reviews/export", requireAdmin, exportReviews)
+	r.POST("/reviews/import", requireAdmin, importReviews)
+}
+
+func moderateReview(c *gin.Context, status string) {
+	id, err := strconv.Atoi(c.Param("reviewId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide numeric review ID"})
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	// The reason is optional, an empty body is fine.
+	_ = c.ShouldBindJSON(&body)
+
+	note := fmt.Sprintf("%s by %s", status, actor(c))
+	if body.Reason != "" {
+		note += ": " + body.Reason
+	}
+	review, ok := store.SetStatus(id, status, note)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+		return
+	}
+	log.Printf("review %d %s", id, note)
+	auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "review.moderate", Target: fmt.Sprintf("review/%d", id), Details: map[string]string{"status": status, "reason": body.Reason}})
+	c.JSON(http.StatusOK, review)
+}
+
+// registerOutboxRoutes exposes the state of the outbox under path for admins.
+func registerOutboxRoutes(r *gin.Engine, path string, auth gin.HandlerFunc) {
+	r.GET(path, auth, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"targets":     events.Targets(),
+			"pending":     events.Pending(),
+			"deadLetters": events.DeadLetters(),
+		})
+	})
+	r.POST(path+"/redrive", auth, func(c *gin.Context) {
+		redriven := events.Redrive()
+		auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "outbox.redrive", Details: map[string]string{"redriven": strconv.Itoa(redriven)}})
+		c.JSON(http.StatusOK, gin.H{"redriven": redriven})
+	})
+}
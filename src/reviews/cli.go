@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The export and import subcommands talk to a running reviews service: the
+// reviews live in its memory. The admin token is read from
+// REVIEWS_ADMIN_TOKEN like the service does, and with the TLS_* variables
+// set as for the services they call it over mutual TLS.
+
+// runExport implements `reviews export [flags]`, writing the export to a
+// file or stdout as it is received.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	server := fs.String("server", meshTLS.Scheme()+"://localhost:9082", "reviews service URL")
+	format := fs.String("format", "", "output format: jsonl or csv (default: from -o extension, else jsonl)")
+	out := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: reviews export [-server url] [-format jsonl|csv] [-o file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if *format == "" {
+		*format = transferFormat(*out)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*server, "/")+"/reviews/export?format="+*format, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := adminRequest(request)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runImport implements `reviews import [flags] <file>`, streaming the file
+// to the service. The exit status is non-zero when a record was rejected or
+// the import was aborted.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	server := fs.String("server", meshTLS.Scheme()+"://localhost:9082", "reviews service URL")
+	format := fs.String("format", "", "input format: jsonl or csv (default: from file extension)")
+	policy := fs.String("policy", PolicySkip, "when a reviewer already reviewed the product: skip, overwrite or fail")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: reviews import [-server url] [-format jsonl|csv] [-policy skip|overwrite|fail] <file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	source := fs.Arg(0)
+	if *format == "" {
+		*format = transferFormat(source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	url := fmt.Sprintf("%s/reviews/import?format=%s&policy=%s", strings.TrimSuffix(*server, "/"), *format, *policy)
+	request, err := http.NewRequest(http.MethodPost, url, f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := adminRequest(request)
+	if err != nil && resp == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	var report ImportReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "import: %s\n", resp.Status)
+		return 1
+	}
+	for _, e := range report.Errors {
+		fmt.Println(e)
+	}
+	fmt.Printf("imported %d, overwritten %d, skipped %d, rejected %d\n",
+		report.Imported, report.Overwritten, report.Skipped, report.Failed)
+	if report.Aborted {
+		fmt.Println("import aborted")
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// adminRequest sends a request with the admin token. Error responses are
+// returned along with an error so callers can read their body.
+func adminRequest(request *http.Request) (*http.Response, error) {
+	if adminToken != "" {
+		request.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	client := &http.Client{Transport: meshTLS.Transport("reviews")}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("%s %s: %s", request.Method, request.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+func transferFormat(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return "csv"
+	}
+	return "jsonl"
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Verdict is the outcome of moderating a review. Verdicts are ordered: the
+// pipeline result is the most severe verdict of any moderator.
+type Verdict int
+
+const (
+	Approve Verdict = iota
+	Hold
+	Reject
+)
+
+func (v Verdict) Status() string {
+	switch v {
+	case Hold:
+		return StatusHeld
+	case Reject:
+		return StatusRejected
+	default:
+		return StatusApproved
+	}
+}
+
+type Decision struct {
+	Verdict Verdict
+	Reason  string
+}
+
+// Moderator inspects a review before it is published.
+type Moderator interface {
+	Name() string
+	Moderate(r Review) Decision
+}
+
+// Pipeline runs every moderator on a review and combines their decisions.
+type Pipeline []Moderator
+
+// Moderate returns the most severe verdict and the reasons given for it.
+func (p Pipeline) Moderate(r Review) (Verdict, []string) {
+	verdict := Approve
+	var reasons []string
+	for _, m := range p {
+		d := m.Moderate(r)
+		if d.Verdict == Approve {
+			continue
+		}
+		reason := fmt.Sprintf("%s: %s", m.Name(), d.Reason)
+		switch {
+		case d.Verdict > verdict:
+			verdict, reasons = d.Verdict, []string{reason}
+		case d.Verdict == verdict:
+			reasons = append(reasons, reason)
+		}
+	}
+	return verdict, reasons
+}
+
+var moderation Pipeline
+
+func init() {
+	words := defaultWordlist
+	if path := os.Getenv("MODERATION_WORDLIST"); path != "" {
+		var err error
+		if words, err = loadWordlist(path); err != nil {
+			log.Fatalf("load wordlist %s: %v", path, err)
+		}
+	}
+	moderation = Pipeline{
+		LengthModerator{Min: 10, Max: 2000},
+		NewWordlistModerator(words),
+		SpamModerator{MaxLinks: 2},
+		DuplicateModerator{},
+	}
+}
+
+// LengthModerator rejects reviews that are too short to be useful or too
+// long to display.
+type LengthModerator struct {
+	Min, Max int
+}
+
+func (LengthModerator) Name() string { return "length" }
+
+func (m LengthModerator) Moderate(r Review) Decision {
+	n := len([]rune(strings.TrimSpace(r.Text)))
+	switch {
+	case n < m.Min:
+		return Decision{Reject, fmt.Sprintf("shorter than %d characters", m.Min)}
+	case n > m.Max:
+		return Decision{Reject, fmt.Sprintf("longer than %d characters", m.Max)}
+	}
+	return Decision{Verdict: Approve}
+}
+
+var defaultWordlist = []string{"crap", "damn", "idiot", "stupid", "sucks"}
+
+// WordlistModerator holds reviews containing any of a list of words.
+type WordlistModerator struct {
+	words map[string]bool
+}
+
+func NewWordlistModerator(words []string) WordlistModerator {
+	m := WordlistModerator{words: make(map[string]bool, len(words))}
+	for _, w := range words {
+		m.words[strings.ToLower(w)] = true
+	}
+	return m
+}
+
+func (WordlistModerator) Name() string { return "wordlist" }
+
+func (m WordlistModerator) Moderate(r Review) Decision {
+	for _, word := range strings.FieldsFunc(strings.ToLower(r.Text), func(c rune) bool {
+		return !unicode.IsLetter(c) && c != '\''
+	}) {
+		if m.words[word] {
+			return Decision{Hold, fmt.Sprintf("contains %q", word)}
+		}
+	}
+	return Decision{Verdict: Approve}
+}
+
+// loadWordlist reads one word per line, ignoring blank lines and # comments.
+func loadWordlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+// SpamModerator looks for the usual signs of spam: links, shouting and long
+// runs of the same character. More than MaxLinks links is rejected outright,
+// anything else suspicious is held for a human.
+type SpamModerator struct {
+	MaxLinks int
+}
+
+func (SpamModerator) Name() string { return "spam" }
+
+func (m SpamModerator) Moderate(r Review) Decision {
+	links := len(linkPattern.FindAllString(r.Text, -1))
+	if links > m.MaxLinks {
+		return Decision{Reject, fmt.Sprintf("%d links", links)}
+	}
+	if links > 0 {
+		return Decision{Hold, "contains links"}
+	}
+
+	letters, upper, run, longestRun := 0, 0, 0, 0
+	var prev rune
+	for _, c := range r.Text {
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+		if c == prev && !unicode.IsSpace(c) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longestRun {
+			longestRun = run
+		}
+		prev = c
+	}
+	if letters >= 20 && upper*10 > letters*7 {
+		return Decision{Hold, "mostly upper case"}
+	}
+	if longestRun >= 6 {
+		return Decision{Hold, "repeated characters"}
+	}
+	return Decision{Verdict: Approve}
+}
+
+// DuplicateModerator rejects a review whose text, ignoring case, spacing and
+// punctuation, was already posted for the same product.
+type DuplicateModerator struct{}
+
+func (DuplicateModerator) Name() string { return "duplicate" }
+
+func (DuplicateModerator) Moderate(r Review) Decision {
+	text := normalizeText(r.Text)
+	for _, existing := range store.ForProduct(r.ProductId, "") {
+		if existing.Id != r.Id && existing.Status != StatusRejected && normalizeText(existing.Text) == text {
+			return Decision{Reject, fmt.Sprintf("duplicate of review %d", existing.Id)}
+		}
+	}
+	return Decision{Verdict: Approve}
+}
+
+func normalizeText(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}), " ")
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPipelineModerate(t *testing.T) {
+	store = newReviewStore(nil)
+	store.Add(Review{ProductId: 7, Reviewer: "alice", Text: "Lovely play, would see again.", Status: StatusApproved})
+
+	tests := []struct {
+		text string
+		want Verdict
+	}{
+		{"A wonderful comedy, I laughed a lot.", Approve},
+		{"short", Reject},
+		{"This play sucks, honestly.", Hold},
+		{"See www.example.com for more.", Hold},
+		{"Buy http://a.example http://b.example http://c.example", Reject},
+		{"THIS IS THE BEST PLAY EVER WRITTEN", Hold},
+		{"Great!!!!!!!! Loved every minute.", Hold},
+		{"lovely PLAY -- would see again!", Reject},
+	}
+	for _, tt := range tests {
+		got, reasons := moderation.Moderate(Review{ProductId: 7, Text: tt.text})
+		if got != tt.want {
+			t.Errorf("Moderate(%q) = %v %v, want %v", tt.text, got, reasons, tt.want)
+		}
+	}
+}
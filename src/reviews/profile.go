@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Profile describes the behaviour of one reviews version. The built-in
+// profiles reproduce the classic bookinfo variants, further ones can be
+// defined in the file named by PROFILES_FILE.
+type Profile struct {
+	Name           string `json:"name"`
+	Ratings        bool   `json:"ratings"`
+	StarColor      string `json:"starColor,omitempty"`
+	RatingsTimeout int    `json:"ratingsTimeoutMs,omitempty"`
+	Sentiment      bool   `json:"sentiment,omitempty"`
+}
+
+var builtinProfiles = map[string]Profile{
+	"v1": {Name: "v1", Ratings: false},
+	"v2": {Name: "v2", Ratings: true, StarColor: "black", RatingsTimeout: 10000},
+	"v3": {Name: "v3", Ratings: true, StarColor: "red", RatingsTimeout: 2500},
+	"v4": {Name: "v4", Ratings: true, StarColor: "red", RatingsTimeout: 2500, Sentiment: true},
+}
+
+var profile Profile
+
+// profiles holds every known profile, reported by /version.
+var profiles map[string]Profile
+
+func init() {
+	profiles = make(map[string]Profile, len(builtinProfiles))
+	for name, p := range builtinProfiles {
+		profiles[name] = p
+	}
+	if path := os.Getenv("PROFILES_FILE"); path != "" {
+		custom, err := loadProfiles(path)
+		if err != nil {
+			log.Fatalf("load profiles %s: %v", path, err)
+		}
+		for name, p := range custom {
+			profiles[name] = p
+		}
+	}
+
+	profile = resolveProfile(os.Getenv("SERVICE_VERSION"), os.Getenv("ENABLE_RATINGS"), os.Getenv("STAR_COLOR"))
+}
+
+// resolveProfile picks the profile of a version, v1 when it is empty, and
+// applies the ENABLE_RATINGS and STAR_COLOR overrides.
+func resolveProfile(version, enableRatings, starColor string) Profile {
+	if version == "" {
+		version = "v1"
+	}
+	p, ok := profiles[version]
+	if !ok {
+		log.Printf("unknown SERVICE_VERSION %q, using the v1 profile", version)
+		p = profiles["v1"]
+		p.Name = version
+	}
+
+	// ENABLE_RATINGS and STAR_COLOR predate profiles and still override them.
+	if enableRatings != "" {
+		p.Ratings, _ = strconv.ParseBool(enableRatings)
+	}
+	if starColor != "" {
+		p.StarColor = starColor
+	}
+	if p.Ratings && p.StarColor == "" {
+		p.StarColor = "black"
+	}
+	if p.RatingsTimeout <= 0 {
+		p.RatingsTimeout = 10000
+	}
+	return p
+}
+
+// Timeout is the time to wait for the ratings service. RatingsTimeout is in
+// milliseconds, as its JSON name says.
+func (p Profile) Timeout() time.Duration {
+	return time.Duration(p.RatingsTimeout) * time.Millisecond
+}
+
+// loadProfiles reads a JSON object mapping profile names to profiles, e.g.
+//
+//	{"v4": {"ratings": true, "starColor": "blue", "ratingsTimeoutMs": 500}}
+func loadProfiles(path string) (map[string]Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var custom map[string]Profile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, err
+	}
+	for name, p := range custom {
+		if name == "" {
+			return nil, fmt.Errorf("profile with empty name")
+		}
+		p.Name = name
+		custom[name] = p
+	}
+	return custom, nil
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// versionRoute reports the profile in use and the names of all profiles.
+func versionRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":  profile.Name,
+		"profile":  profile,
+		"profiles": profileNames(),
+		"pod":      podHostname,
+		"cluster":  clusterName,
+	})
+}
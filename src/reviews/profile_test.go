@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolveProfile(t *testing.T) {
+	tests := []struct {
+		name                    string
+		version, ratings, color string
+		want                    Profile
+	}{
+		{"default", "", "", "", Profile{Name: "v1", RatingsTimeout: 10000}},
+		{"v3", "v3", "", "", Profile{Name: "v3", Ratings: true, StarColor: "red", RatingsTimeout: 2500}},
+		{"unknown version", "v9", "", "", Profile{Name: "v9", RatingsTimeout: 10000}},
+		{"ratings enabled", "v1", "true", "", Profile{Name: "v1", Ratings: true, StarColor: "black", RatingsTimeout: 10000}},
+		{"star color", "v2", "", "blue", Profile{Name: "v2", Ratings: true, StarColor: "blue", RatingsTimeout: 10000}},
+	}
+	for _, tt := range tests {
+		if got := resolveProfile(tt.version, tt.ratings, tt.color); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if got := (Profile{RatingsTimeout: 2500}).Timeout(); got != 2500*time.Millisecond {
+		t.Errorf("timeout of 2500 ms is %v", got)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profiles.json")
+	if err := os.WriteFile(path, []byte(`{"v5": {"ratings": true, "starColor": "blue", "ratingsTimeoutMs": 500}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	custom, err := loadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Profile{Name: "v5", Ratings: true, StarColor: "blue", RatingsTimeout: 500}); custom["v5"] != want {
+		t.Errorf("got %+v, want %+v", custom["v5"], want)
+	}
+	for _, data := range []string{`{"": {"ratings": true}}`, `["v5"]`} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadProfiles(path); err == nil {
+			t.Errorf("%s: loaded", data)
+		}
+	}
+}
+
+func TestVersionRoute(t *testing.T) {
+	defer func(saved Profile) { profile = saved }(profile)
+	profile = resolveProfile("v2", "", "")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/version", versionRoute)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var body struct {
+		Version  string   `json:"version"`
+		Profile  Profile  `json:"profile"`
+		Profiles []string `json:"profiles"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Version != "v2" || body.Profile.RatingsTimeout != 10000 || len(body.Profiles) < 4 || body.Profiles[0] != "v1" {
+		t.Errorf("got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RatingsClient fetches ratings for a product. Each call is bounded by a
+// deadline covering all attempts; transport errors and 5xx responses are
+// retried. The last successful answer per product is kept so callers can fall
+// back to it when the ratings service is unavailable.
+type RatingsClient struct {
+	baseURL string
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	mu        sync.Mutex
+	lastKnown map[int]Result
+}
+
+var errRatingsUnavailable = errors.New("ratings service is unavailable")
+
+// errNoRatingHistory is returned by History when the ratings service keeps
+// no history, as ratings v2 does, which reads a database of current ratings.
+var errNoRatingHistory = errors.New("ratings service keeps no rating history")
+
+var ratingsClient *RatingsClient
+
+var ratingsRetries int
+
+func NewRatingsClient(baseURL string, timeout time.Duration, retries int) *RatingsClient {
+	return &RatingsClient{
+		baseURL:   baseURL,
+		client:    &http.Client{Transport: meshTLS.Transport("ratings")},
+		timeout:   timeout,
+		retries:   retries,
+		backoff:   100 * time.Millisecond,
+		lastKnown: make(map[int]Result),
+	}
+}
+
+func init() {
+	value, ok := os.LookupEnv("RATINGS_RETRIES")
+	if !ok {
+		ratingsRetries = 2
+	} else {
+		ratingsRetries, _ = strconv.Atoi(value)
+	}
+}
+
+// Get returns the ratings of a product. When the ratings service can not be
+// reached it returns the last known ratings with stale set, or an error if
+// there are none.
+func (rc *RatingsClient) Get(ctx context.Context, productId int, headers http.Header) (result Result, stale bool, err error) {
+	result, err = rc.fetch(ctx, productId, headers)
+	if err == nil {
+		rc.mu.Lock()
+		rc.lastKnown[productId] = result
+		rc.mu.Unlock()
+		return result, false, nil
+	}
+
+	rc.mu.Lock()
+	cached, ok := rc.lastKnown[productId]
+	rc.mu.Unlock()
+	if ok {
+		return cached, true, err
+	}
+	return Result{}, false, err
+}
+
+func (rc *RatingsClient) fetch(ctx context.Context, productId int, headers http.Header) (Result, error) {
+	var result Result
+	err := rc.getJSON(ctx, fmt.Sprintf("%s/%d", rc.baseURL, productId), headers, &result)
+	return result, err
+}
+
+// History returns every rating recorded for a product, oldest first. It is
+// not cached: callers aggregating ratings want current data or none.
+func (rc *RatingsClient) History(ctx context.Context, productId int, headers http.Header) ([]RatingRecord, error) {
+	var records []RatingRecord
+	err := rc.getJSON(ctx, fmt.Sprintf("%s/%d/history", rc.baseURL, productId), headers, &records)
+	return records, err
+}
+
+// Rate records star ratings for a product, keyed by reviewer. Writes are not
+// retried: the ratings service appends every rating to its history.
+func (rc *RatingsClient) Rate(ctx context.Context, productId int, stars map[string]int, headers http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(stars)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/%d", rc.baseURL, productId)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for _, header := range headersToPropagate {
+		if value := headers.Get(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+
+	resp, err := rc.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRatingsUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// getJSON decodes the response to a GET of url into v, retrying within the
+// client deadline.
+func (rc *RatingsClient) getJSON(ctx context.Context, url string, headers http.Header, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	var lastErr error
+	for attempt := 0; attempt <= rc.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(rc.backoff << (attempt - 1)):
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %v", errRatingsUnavailable, lastErr)
+			}
+		}
+
+		retry, err := rc.do(ctx, url, headers, v)
+		if err == nil || errors.Is(err, errNoRatingHistory) {
+			return err
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %v", errRatingsUnavailable, lastErr)
+}
+
+// do performs one request and reports whether a failure is worth retrying.
+func (rc *RatingsClient) do(ctx context.Context, url string, headers http.Header, v interface{}) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, header := range headersToPropagate {
+		if value := headers.Get(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+
+	resp, err := rc.client.Do(request)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotImplemented {
+		return false, errNoRatingHistory
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("decode ratings: %w", err)
+	}
+	return false, nil
+}
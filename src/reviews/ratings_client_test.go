@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRatingsClientRetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/ratings/3" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"id":3,"ratings":{"Reviewer1":5,"Reviewer2":2}}`))
+	}))
+	defer server.Close()
+
+	client := NewRatingsClient(server.URL+"/ratings", time.Second, 2)
+	client.backoff = time.Millisecond
+	result, stale, err := client.Get(context.Background(), 3, http.Header{})
+	if err != nil || stale {
+		t.Fatalf("got err=%v stale=%v", err, stale)
+	}
+	if result.Ratings.Reviewer1 != 5 || result.Ratings.Reviewer2 != 2 {
+		t.Errorf("unexpected ratings %+v", result)
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+}
+
+func TestRatingsClientFallsBackToLastKnown(t *testing.T) {
+	up := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"id":0,"ratings":{"Reviewer1":4,"Reviewer2":3}}`))
+	}))
+	defer server.Close()
+
+	client := NewRatingsClient(server.URL+"/ratings", 50*time.Millisecond, 1)
+	if _, _, err := client.Get(context.Background(), 0, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&up, 0)
+	result, stale, err := client.Get(context.Background(), 0, http.Header{})
+	if err == nil || !stale {
+		t.Fatalf("expected a stale result after a timeout, got err=%v stale=%v", err, stale)
+	}
+	if result.Ratings.Reviewer1 != 4 {
+		t.Errorf("unexpected cached ratings %+v", result)
+	}
+
+	if _, stale, err := client.Get(context.Background(), 1, http.Header{}); err == nil || stale {
+		t.Errorf("expected an error without cached ratings, got err=%v stale=%v", err, stale)
+	}
+}
+
+func TestRatingsClientPropagatesPresentHeadersOnly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-request-id"); got != "abc" {
+			t.Errorf("x-request-id = %q", got)
+		}
+		if _, ok := r.Header["Jwt"]; ok {
+			t.Error("jwt header should not be sent when absent")
+		}
+		w.Write([]byte(`{"id":0,"ratings":{"Reviewer1":1,"Reviewer2":1}}`))
+	}))
+	defer server.Close()
+
+	headers := http.Header{}
+	headers.Set("X-Request-Id", "abc")
+	client := NewRatingsClient(server.URL+"/ratings", time.Second, 0)
+	if _, _, err := client.Get(context.Background(), 0, headers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRatingsClientHistoryNotKept(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer server.Close()
+
+	client := NewRatingsClient(server.URL+"/ratings", time.Second, 2)
+	client.backoff = time.Millisecond
+	if _, err := client.History(context.Background(), 0, http.Header{}); !errors.Is(err, errNoRatingHistory) {
+		t.Errorf("got %v, want errNoRatingHistory", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+	"go-bookinfo.local/common/auth"
+	"go-bookinfo.local/common/markdown"
+	"go-bookinfo.local/common/mtls"
+	"go-bookinfo.local/common/ratelimit"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,14 +27,30 @@ type Result struct {
 	Ratings Reviewer `json:"ratings"`
 }
 
-var ratingsEnabled bool
-var starColor string
 var servicesDomain string
 var ratingsHostname string
 var ratingsService string
 var podHostname string
 var clusterName string
 
+// meshTLS is nil, leaving the services on plain HTTP, unless TLS_CERT_FILE
+// and TLS_KEY_FILE are set.
+var meshTLS = mtls.NewFromEnv()
+
+// jwtVerifier is nil, verifying nothing, unless JWT_JWKS_URL is set.
+var jwtVerifier = auth.NewJWTVerifierFromEnv(meshTLS.Transport("productpage"))
+
+// authorizer is nil, allowing every request, unless AUTHZ_POLICY_FILE is
+// set.
+var authorizer = auth.NewAuthorizerFromEnv()
+
+// rateLimiter is nil, limiting nothing, unless RATE_LIMIT_FILE is set.
+var rateLimiter = ratelimit.NewFromEnv()
+
+// auditLog is nil, leaving the entries to the service log, unless
+// AUDIT_LOG_DIR is set.
+var auditLog *audit.Log
+
 // HTTP headers to propagate for distributed tracing are documented at
 // https://istio.io/docs/tasks/telemetry/distributed-tracing/overview/#trace-context-propagation
 var headersToPropagate = []string{
@@ -83,20 +106,7 @@ var headersToPropagate = []string{
 }
 
 func init() {
-	var value, ok = os.LookupEnv("ENABLE_RATINGS")
-	if !ok {
-		ratingsEnabled = false
-	} else {
-		ratingsEnabled, _ = strconv.ParseBool(value)
-	}
-	value, ok = os.LookupEnv("STAR_COLOR")
-	if !ok {
-		starColor = "black"
-	} else {
-		starColor = value
-	}
-
-	value, ok = os.LookupEnv("SERVICES_DOMAIN")
+	value, ok := os.LookupEnv("SERVICES_DOMAIN")
 	if !ok {
 		servicesDomain = ""
 	} else {
@@ -107,19 +117,41 @@ func init() {
 	if !ok {
 		ratingsHostname = "ratings"
 	} else {
-		ratingsHostname = fmt.Sprintf(".%s", value)
+		ratingsHostname = value
 	}
-	ratingsService = fmt.Sprintf("http://%s%s:9080/ratings", ratingsHostname, servicesDomain)
+	ratingsService = fmt.Sprintf("%s://%s%s:9080/ratings", meshTLS.Scheme(), ratingsHostname, servicesDomain)
 
 	podHostname = os.Getenv("HOSTNAME")
 	clusterName = os.Getenv("CLUSTER_NAME")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
+	}
+
+	auditLog = audit.NewFromEnv("reviews")
+	ratingsClient = NewRatingsClient(ratingsService, profile.Timeout(), ratingsRetries)
+	go events.Run(context.Background())
+
 	r := gin.Default()
+	r.Use(func(c *gin.Context) {
+		c.Header("x-reviews-version", profile.Name)
+	})
+	r.Use(jwtVerifier.Middleware())
+	r.Use(rateLimiter.Middleware(ratelimit.TokenIdentity))
+	r.Use(authorizer.Middleware(mtls.PeerPrincipal))
 	r.GET("/", func(c *gin.Context) {
 	})
 
+	r.GET("/version", versionRoute)
+
+	r.GET("/metrics", rateLimiter.Metrics)
 	r.GET("/health", func(c *gin.Context) {
 		fmt.Println("health check")
 		c.JSON(http.StatusOK, gin.H{
@@ -135,6 +167,7 @@ func main() {
 
 		starsReviewer1 := -1
 		starsReviewer2 := -1
+		stale := false
 
 		var data Data
 		if err := c.ShouldBindUri(&data); err != nil {
@@ -143,116 +176,370 @@ func main() {
 		}
 		productId := data.ID
 
-		if ratingsEnabled {
-			ratings := getRatings(productId, c.Request.Header)
-			starsReviewer1 = ratings.Ratings.Reviewer1
-			starsReviewer2 = ratings.Ratings.Reviewer2
+		if profile.Ratings {
+			ratings, cached, err := ratingsClient.Get(c.Request.Context(), productId, c.Request.Header)
+			if err != nil {
+				log.Printf("Error: unable to get ratings for product %d: %v", productId, err)
+			}
+			if err == nil || cached {
+				starsReviewer1 = ratings.Ratings.Reviewer1
+				starsReviewer2 = ratings.Ratings.Reviewer2
+				stale = cached
+			}
 		}
 
-		jsonResStr := getJsonResponse(productId, starsReviewer1, starsReviewer2)
+		sortOrder := c.Query("sort")
+		if sortOrder != "" && sortOrder != "helpful" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be helpful"})
+			return
+		}
+
+		jsonResStr := getJsonResponse(productId, starsReviewer1, starsReviewer2, stale, auth.RequestUser(c), sortOrder)
 
 		c.JSON(http.StatusOK, jsonResStr)
 	})
+
+	r.POST("/reviews/:productId", func(c *gin.Context) {
+		var data Data
+		if err := c.ShouldBindUri(&data); err != nil {
+			c.JSON(400, gin.H{"msg": err})
+			return
+		}
+		var body struct {
+			Reviewer string `json:"reviewer"`
+			Text     string `json:"text"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Signed in users always post under their own name. When tokens
+		// are verified, only signed in users can post.
+		if user := auth.RequestUser(c); user != "" {
+			body.Reviewer = user
+		} else if auth.Verified(c) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in to post a review"})
+			return
+		}
+		if body.Reviewer == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reviewer is required"})
+			return
+		}
+
+		review := Review{ProductId: data.ID, Reviewer: body.Reviewer, Text: strings.TrimSpace(body.Text)}
+		var verdict Verdict
+		var reasons []string
+		store.Moderate(moderation, review, func(v Verdict, r []string) {
+			verdict, reasons = v, r
+			review.Status = verdict.Status()
+			review.Moderation = reasons
+			review = store.Add(review)
+		})
+		log.Printf("review %d for product %d by %s: %s %v", review.Id, review.ProductId, review.Reviewer, review.Status, reasons)
+		auditLog.Record(c, audit.Entry{
+			Action:  "review.create",
+			Target:  fmt.Sprintf("review/%d", review.Id),
+			Details: map[string]string{"product": strconv.Itoa(review.ProductId), "reviewer": review.Reviewer, "status": review.Status},
+		})
+
+		switch verdict {
+		case Reject:
+			c.JSON(http.StatusUnprocessableEntity, review)
+		case Hold:
+			c.JSON(http.StatusAccepted, review)
+		default:
+			c.JSON(http.StatusCreated, review)
+		}
+	})
+
+	r.GET("/reviews/search", searchReviews)
+	r.PUT("/reviews/:productId/:reviewId", editReview)
+	r.DELETE("/reviews/:productId/:reviewId", deleteReview)
+	r.PUT("/reviews/:productId/:reviewId/vote", voteReview)
+	r.DELETE("/reviews/:productId/:reviewId/vote", withdrawVote)
+
+	registerModerationRoutes(r)
+	registerTransferRoutes(r)
+	registerOutboxRoutes(r, "/reviews/outbox", requireAdmin)
+	auditLog.RegisterRoutes(r, "/reviews/audit", requireAdmin)
+
+	r.GET("/reviews/:productId/summary", func(c *gin.Context) {
+		var data Data
+		if err := c.ShouldBindUri(&data); err != nil {
+			c.JSON(400, gin.H{"msg": err})
+			return
+		}
+		if !profile.Ratings {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("ratings are not enabled in reviews %s", profile.Name),
+			})
+			return
+		}
+		records, err := ratingsClient.History(c.Request.Context(), data.ID, c.Request.Header)
+		if errors.Is(err, errNoRatingHistory) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the ratings service keeps no rating history to summarize"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error: unable to get rating history for product %d: %v", data.ID, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Ratings service is currently unavailable",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, summarize(data.ID, records, time.Now()))
+	})
 	if len(os.Args) > 1 {
 		// load from Dockerfile
-		if err := r.Run(fmt.Sprintf("0.0.0.0:%s", os.Args[1])); err != nil {
+		if err := meshTLS.Run(r, fmt.Sprintf("0.0.0.0:%s", os.Args[1])); err != nil {
 			log.Fatal(err)
 		}
 	} else {
 		// for test
-		if err := r.Run(fmt.Sprintf("0.0.0.0:%s", "9082")); err != nil {
+		if err := meshTLS.Run(r, fmt.Sprintf("0.0.0.0:%s", "9082")); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
-func getJsonResponse(productId int, starsReviewer1 int, starsReviewer2 int) interface{} {
+// getJsonResponse builds the reviews of a product. A star count of -1 means
+// no ratings are available; stale marks ratings served from the last known
+// values because the ratings service could not be reached. Votes are reported
+// from the point of view of user, and sortOrder "helpful" puts the most
+// helpful reviews first.
+func getJsonResponse(productId int, starsReviewer1 int, starsReviewer2 int, stale bool, user string, sortOrder string) interface{} {
 
 	type Rating struct {
 		Stars int    `json:"stars"`
 		Color string `json:"color"`
+		Stale bool   `json:"stale,omitempty"`
 		Error string `json:"error"`
 	}
 
 	type Reviewer struct {
-		Reviewer string `json:"reviewer"`
-		Text     string `json:"text"`
-		Rating   Rating `json:"rating"`
+		Id        int        `json:"reviewId"`
+		Reviewer  string     `json:"reviewer"`
+		Text      string     `json:"text"`
+		Html      string     `json:"html"`
+		Rating    Rating     `json:"rating"`
+		Sentiment *Sentiment `json:"sentiment,omitempty"`
+		Votes     VoteCount  `json:"votes"`
 	}
 
 	type Result struct {
 		Id          int        `json:"id"`
+		Version     string     `json:"version"`
 		PodName     string     `json:"podname"`
 		ClusterName string     `json:"clusterame"`
 		Reviewers   []Reviewer `json:"reviewers"`
 	}
 
 	var rat1 Rating
-	if ratingsEnabled {
+	if profile.Ratings {
 		if starsReviewer1 != -1 {
-			rat1 = Rating{Stars: starsReviewer1, Color: starColor}
+			rat1 = Rating{Stars: starsReviewer1, Color: profile.StarColor, Stale: stale}
 		} else {
 			rat1 = Rating{Error: "Ratings service is currently unavailable"}
 		}
 	}
 	var rat2 Rating
-	if ratingsEnabled {
+	if profile.Ratings {
 		if starsReviewer2 != -1 {
-			rat2 = Rating{Stars: starsReviewer2, Color: starColor}
+			rat2 = Rating{Stars: starsReviewer2, Color: profile.StarColor, Stale: stale}
 		} else {
 			rat2 = Rating{Error: "Ratings service is currently unavailable"}
 		}
 	}
+	// Only the classic reviewers have ratings.
+	ratingOf := map[string]Rating{"Reviewer1": rat1, "Reviewer2": rat2}
+
 	var r = Result{
-		Id: productId, PodName: podHostname,
+		Id: productId, Version: profile.Name, PodName: podHostname,
 		ClusterName: clusterName,
-		Reviewers: []Reviewer{{Reviewer: "Reviewer1", Text: "An extremely entertaining play by Shakespeare. The slapstick humour is refreshing!", Rating: rat1},
-			{Reviewer: "Reviewer2", Text: "Absolutely fun and entertaining. The play lacks thematic depth when compared to other plays by Shakespeare.", Rating: rat2}},
+		Reviewers:   []Reviewer{},
+	}
+	approved := store.ForProduct(productId, StatusApproved)
+	counts := make(map[int]VoteCount, len(approved))
+	for _, review := range approved {
+		counts[review.Id] = votes.Count(review.Id, user)
+	}
+	if sortOrder == "helpful" {
+		sortByHelpfulness(approved, counts)
+	}
+	for _, review := range approved {
+		reviewer := Reviewer{
+			Id:       review.Id,
+			Reviewer: review.Reviewer,
+			Text:     review.Text,
+			Html:     markdown.Render(review.Text),
+			Rating:   ratingOf[review.Reviewer],
+			Votes:    counts[review.Id],
+		}
+		if profile.Sentiment {
+			s := sentimentFor(review.Text, reviewer.Rating.Stars)
+			reviewer.Sentiment = &s
+		}
+		r.Reviewers = append(r.Reviewers, reviewer)
 	}
 
 	return r
 }
 
-func getRatings(productId int, headers map[string][]string) Result {
-	////cb.property("com.ibm.ws.jaxrs.client.connection.timeout", timeout)
-	////cb.property("com.ibm.ws.jaxrs.client.receive.timeout", timeout)
-	var timeout time.Duration
-	if starColor == "black" {
-		timeout = 10000
-	} else {
-		timeout = 2500
+// votedReview looks up the approved review a vote is for. It answers the
+// request itself and returns false when the vote cannot be taken.
+func votedReview(c *gin.Context) (Review, string, bool) {
+	user := auth.RequestUser(c)
+	if user == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in to vote"})
+		return Review{}, "", false
+	}
+	productId, err1 := strconv.Atoi(c.Param("productId"))
+	reviewId, err2 := strconv.Atoi(c.Param("reviewId"))
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide numeric product and review IDs"})
+		return Review{}, "", false
 	}
-	client := http.Client{
-		Timeout: timeout * time.Second,
+	for _, review := range store.ForProduct(productId, StatusApproved) {
+		if review.Id == reviewId {
+			return review, user, true
+		}
 	}
-	request, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", ratingsService, productId), nil)
-	if err != nil {
-		log.Fatal(err)
+	c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+	return Review{}, "", false
+}
+
+func voteReview(c *gin.Context) {
+	review, user, ok := votedReview(c)
+	if !ok {
+		return
 	}
-	for i := range headersToPropagate {
-		value := headers[headersToPropagate[i]]
-		request.Header.Set(headersToPropagate[i], value[0])
+	var body struct {
+		Vote string `json:"vote"`
 	}
+	if err := c.ShouldBindJSON(&body); err != nil || (body.Vote != VoteHelpful && body.Vote != VoteUnhelpful) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "vote must be helpful or unhelpful"})
+		return
+	}
+	if review.Reviewer == user {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you cannot vote on your own review"})
+		return
+	}
+	votes.Set(review.Id, user, body.Vote == VoteHelpful)
+	auditLog.Record(c, audit.Entry{Action: "review.vote", Target: fmt.Sprintf("review/%d", review.Id), Details: map[string]string{"vote": body.Vote}})
+	c.JSON(http.StatusOK, votes.Count(review.Id, user))
+}
 
-	resp, err := client.Do(request)
-	if err != nil {
-		log.Fatal(err)
+func withdrawVote(c *gin.Context) {
+	review, user, ok := votedReview(c)
+	if !ok {
+		return
 	}
-	statusCode := resp.StatusCode
-	if statusCode != http.StatusOK {
-		log.Printf("Error:unable to contact %s got status of %v", ratingsService, statusCode)
-		return Result{}
-	} else {
-		var data []byte
-		_, err := resp.Body.Read(data)
-		if err != nil {
-			log.Fatal(err)
+	if !votes.Delete(review.Id, user) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no vote to withdraw"})
+		return
+	}
+	auditLog.Record(c, audit.Entry{Action: "review.unvote", Target: fmt.Sprintf("review/%d", review.Id)})
+	c.JSON(http.StatusOK, votes.Count(review.Id, user))
+}
+
+// searchReviews answers `GET /reviews/search?q=&productId=&limit=`.
+func searchReviews(c *gin.Context) {
+	q := c.Query("q")
+	if strings.TrimSpace(q) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide a query with q"})
+		return
+	}
+	productId := -1
+	if value := c.Query("productId"); value != "" {
+		var err error
+		if productId, err = strconv.Atoi(value); err != nil || productId < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "please provide numeric product ID"})
+			return
 		}
-		var result Result
-		err = json.Unmarshal(data, &result)
-		if err != nil {
-			log.Fatal(err)
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	results := reviewIndex.Search(q, productId, limit)
+	c.JSON(http.StatusOK, gin.H{"query": q, "total": len(results), "results": results})
+}
+
+// ownReview looks up the review addressed by the request for its author. It
+// answers the request itself and returns false when that fails; admins may
+// act on any review.
+func ownReview(c *gin.Context) (Review, bool) {
+	productId, err1 := strconv.Atoi(c.Param("productId"))
+	reviewId, err2 := strconv.Atoi(c.Param("reviewId"))
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "please provide numeric product and review IDs"})
+		return Review{}, false
+	}
+	review, ok := store.Get(reviewId)
+	if !ok || review.ProductId != productId {
+		c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+		return Review{}, false
+	}
+	if user := auth.RequestUser(c); user != review.Reviewer || user == "" {
+		switch {
+		case isAdmin(c):
+		case user == "":
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in to change a review"})
+			return Review{}, false
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the author can change a review"})
+			return Review{}, false
 		}
-		return result
 	}
+	return review, true
+}
+
+// editReview replaces the text of a review. The new text is moderated like
+// a new review; a rejected edit leaves the review unchanged.
+func editReview(c *gin.Context) {
+	review, ok := ownReview(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	review.Text = strings.TrimSpace(body.Text)
+	var verdict Verdict
+	var reasons []string
+	store.Moderate(moderation, review, func(v Verdict, r []string) {
+		if verdict, reasons = v, r; verdict != Reject {
+			review.Status = verdict.Status()
+			review.Moderation = reasons
+			store.Replace(review)
+		}
+	})
+	if verdict == Reject {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "edit rejected", "moderation": reasons})
+		return
+	}
+	log.Printf("review %d edited by %s: %s %v", review.Id, actor(c), review.Status, reasons)
+	auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "review.edit", Target: fmt.Sprintf("review/%d", review.Id), Details: map[string]string{"status": review.Status}})
+	if verdict == Hold {
+		c.JSON(http.StatusAccepted, review)
+		return
+	}
+	c.JSON(http.StatusOK, review)
+}
+
+func deleteReview(c *gin.Context) {
+	review, ok := ownReview(c)
+	if !ok {
+		return
+	}
+	store.Delete(review.Id)
+	votes.DeleteReview(review.Id)
+	log.Printf("review %d deleted by %s", review.Id, actor(c))
+	auditLog.Record(c, audit.Entry{Actor: actor(c), Action: "review.delete", Target: fmt.Sprintf("review/%d", review.Id)})
+	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/auth"
+)
+
+// newTestIssuer serves the JWKS of a fresh key and returns a function that
+// signs tokens for a user with it, the way productpage does.
+func newTestIssuer(t *testing.T) (string, func(user string) string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := auth.JWKS{Keys: []auth.JWK{{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(key.X.Bytes()), Y: b64(key.Y.Bytes())}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func(user string) string {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": "ec"})
+		payload, _ := json.Marshal(map[string]interface{}{"sub": user, "exp": time.Now().Add(time.Hour).Unix()})
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+}
+
+func TestOwnReview(t *testing.T) {
+	jwksURL, sign := newTestIssuer(t)
+	defer func(saved *auth.JWTVerifier) { jwtVerifier = saved }(jwtVerifier)
+	jwtVerifier = auth.NewJWTVerifier(jwksURL, "", "", nil)
+	store = newReviewStore(nil)
+	review := store.Add(Review{ProductId: 0, Reviewer: "alice", Text: "A lovely play.", Status: StatusApproved})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(jwtVerifier.Middleware())
+	r.DELETE("/reviews/:productId/:reviewId", func(c *gin.Context) {
+		if _, ok := ownReview(c); ok {
+			c.Status(http.StatusNoContent)
+		}
+	})
+	token := func(user string) string {
+		return "Bearer " + sign(user)
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		endUser       string
+		status        int
+	}{
+		{"header only", "", "alice", http.StatusUnauthorized},
+		{"someone else", token("bob"), "", http.StatusForbidden},
+		{"header contradicts token", token("bob"), "alice", http.StatusForbidden},
+		{"author", token("alice"), "alice", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/reviews/0/"+strconv.Itoa(review.Id), nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.endUser != "" {
+			req.Header.Set("end-user", tt.endUser)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// token is a word of a review text: its stem and where it was found.
+type token struct {
+	term       string
+	start, end int // byte offsets in the text
+}
+
+// tokenize splits text into lower case, stemmed words.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, c := range text + " " {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || (c == '\'' && start >= 0) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			word := strings.TrimRight(strings.ToLower(text[start:i]), "'")
+			word = strings.TrimSuffix(word, "'s")
+			tokens = append(tokens, token{term: stem(word), start: start, end: start + len(strings.TrimRight(text[start:i], "'"))})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// ReviewIndex is an inverted index over the approved reviews. It records
+// the positions of every term so phrases can be matched, and is updated
+// review by review as the store changes.
+type ReviewIndex struct {
+	mu       sync.RWMutex
+	reviews  map[int]Review
+	postings map[string]map[int][]int // term -> review id -> positions
+}
+
+type ReviewHit struct {
+	ReviewId  int     `json:"reviewId"`
+	ProductId int     `json:"productId"`
+	Reviewer  string  `json:"reviewer"`
+	Score     float64 `json:"score"`
+	Snippet   string  `json:"snippet"`
+}
+
+var reviewIndex = NewReviewIndex()
+
+func NewReviewIndex() *ReviewIndex {
+	return &ReviewIndex{reviews: map[int]Review{}, postings: map[string]map[int][]int{}}
+}
+
+func init() {
+	store.OnChange(reviewIndex.Update)
+}
+
+// Update indexes an approved review and drops any other from the index.
+func (x *ReviewIndex) Update(r Review, deleted bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.reviews[r.Id]; ok {
+		for _, t := range tokenize(old.Text) {
+			delete(x.postings[t.term], r.Id)
+			if len(x.postings[t.term]) == 0 {
+				delete(x.postings, t.term)
+			}
+		}
+		delete(x.reviews, r.Id)
+	}
+	if deleted || r.Status != StatusApproved {
+		return
+	}
+	x.reviews[r.Id] = r
+	for pos, t := range tokenize(r.Text) {
+		byReview, ok := x.postings[t.term]
+		if !ok {
+			byReview = make(map[int][]int)
+			x.postings[t.term] = byReview
+		}
+		byReview[r.Id] = append(byReview[r.Id], pos)
+	}
+}
+
+// query is a parsed search: each clause is a single word or a phrase of
+// consecutive words, and every clause has to match.
+type query [][]string
+
+// parseQuery splits a query into words and "quoted phrases".
+func parseQuery(q string) query {
+	var clauses query
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			// Inside quotes.
+			var phrase []string
+			for _, t := range tokenize(part) {
+				phrase = append(phrase, t.term)
+			}
+			if len(phrase) > 0 {
+				clauses = append(clauses, phrase)
+			}
+			continue
+		}
+		for _, t := range tokenize(part) {
+			clauses = append(clauses, []string{t.term})
+		}
+	}
+	return clauses
+}
+
+// Search returns the reviews matching every word and phrase of q, best
+// first. Scores are tf-idf summed over the clauses. A productId of -1
+// searches all products.
+func (x *ReviewIndex) Search(q string, productId int, limit int) []ReviewHit {
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return []ReviewHit{}
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var scores map[int]float64
+	for _, clause := range clauses {
+		matches := x.matchPhrase(clause)
+		df := float64(len(matches))
+		idf := math.Log(1 + float64(len(x.reviews))/math.Max(df, 1))
+		clauseScores := make(map[int]float64, len(matches))
+		for id, positions := range matches {
+			if productId >= 0 && x.reviews[id].ProductId != productId {
+				continue
+			}
+			clauseScores[id] = (1 + math.Log(float64(len(positions)))) * idf
+		}
+		if scores == nil {
+			scores = clauseScores
+			continue
+		}
+		for id := range scores {
+			if score, ok := clauseScores[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]ReviewHit, 0, len(scores))
+	for id, score := range scores {
+		r := x.reviews[id]
+		hits = append(hits, ReviewHit{
+			ReviewId:  id,
+			ProductId: r.ProductId,
+			Reviewer:  r.Reviewer,
+			Score:     round2(score),
+			Snippet:   snippet(r.Text, clauses),
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ReviewId < hits[j].ReviewId
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// matchPhrase returns, per review, the positions where the phrase starts.
+func (x *ReviewIndex) matchPhrase(phrase []string) map[int][]int {
+	matches := make(map[int][]int)
+	for id, positions := range x.postings[phrase[0]] {
+		for _, pos := range positions {
+			if x.phraseAt(id, phrase, pos) {
+				matches[id] = append(matches[id], pos)
+			}
+		}
+	}
+	return matches
+}
+
+func (x *ReviewIndex) phraseAt(id int, phrase []string, pos int) bool {
+	for i, term := range phrase[1:] {
+		found := false
+		for _, p := range x.postings[term][id] {
+			if p == pos+i+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// snippetWords is how many words a snippet shows around the first match.
+const snippetWords = 24
+
+// snippet cuts the part of text around the first match of the query and
+// wraps every matching word in <mark>. The text is HTML escaped.
+func snippet(text string, clauses query) string {
+	tokens := tokenize(text)
+	marked := make([]bool, len(tokens))
+	first := -1
+	for _, clause := range clauses {
+		for i := range tokens {
+			if i+len(clause) > len(tokens) {
+				break
+			}
+			match := true
+			for j, term := range clause {
+				if tokens[i+j].term != term {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			for j := range clause {
+				marked[i+j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return html.EscapeString(text)
+	}
+	if first < 0 {
+		first = 0
+	}
+
+	from := first - snippetWords/3
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(tokens) {
+		to = len(tokens)
+	}
+
+	var b strings.Builder
+	start := tokens[from].start
+	if from > 0 {
+		b.WriteString("… ")
+	}
+	pos := start
+	for i := from; i < to; i++ {
+		t := tokens[i]
+		b.WriteString(html.EscapeString(text[pos:t.start]))
+		if marked[i] {
+			b.WriteString("<mark>" + html.EscapeString(text[t.start:t.end]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(text[t.start:t.end]))
+		}
+		pos = t.end
+	}
+	if to < len(tokens) {
+		b.WriteString(" …")
+	} else {
+		b.WriteString(html.EscapeString(text[pos:]))
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"caresses": "caress", "ponies": "poni", "cats": "cat", "agreed": "agre",
+		"plastered": "plaster", "motoring": "motor", "sing": "sing", "hopping": "hop",
+		"falling": "fall", "filing": "file", "happy": "happi", "relational": "relat",
+		"conditional": "condit", "generalization": "gener", "hopeful": "hope",
+		"goodness": "good", "adoption": "adopt", "controlling": "control",
+		"entertaining": "entertain", "entertained": "entertain", "plays": "plai",
+	} {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func newSearchTestStore() {
+	store = newReviewStore([]int{0, 1})
+	reviewIndex = NewReviewIndex()
+	store.OnChange(reviewIndex.Update)
+}
+
+func TestReviewSearch(t *testing.T) {
+	newSearchTestStore()
+	bob := store.Add(Review{ProductId: 1, Reviewer: "bob", Text: "The slapstick entertains, the plot does not.", Status: StatusApproved})
+	store.Add(Review{ProductId: 1, Reviewer: "eve", Text: "Held back: slapstick <everywhere>.", Status: StatusHeld})
+
+	// Both products have the default review by Reviewer1.
+	if hits := reviewIndex.Search("entertaining slapstick", -1, 0); len(hits) != 3 {
+		t.Fatalf("stemmed search = %+v", hits)
+	}
+	hits := reviewIndex.Search("entertaining slapstick", 1, 0)
+	if len(hits) != 2 || hits[1].ReviewId != bob.Id {
+		t.Fatalf("product search = %+v", hits)
+	}
+	if hits := reviewIndex.Search("everywhere", -1, 0); len(hits) != 0 {
+		t.Errorf("held review found: %+v", hits)
+	}
+	if hits := reviewIndex.Search(`"slapstick humour"`, 1, 0); len(hits) != 1 || hits[0].Reviewer != "Reviewer1" {
+		t.Errorf("phrase search = %+v", hits)
+	}
+	if hits := reviewIndex.Search(`"humour slapstick"`, -1, 0); len(hits) != 0 {
+		t.Errorf("phrase matched out of order: %+v", hits)
+	}
+	if got := hits[1].Snippet; got != "The <mark>slapstick</mark> <mark>entertains</mark>, the plot does not." {
+		t.Errorf("snippet = %q", got)
+	}
+}
+
+func TestReviewSearchFollowsStore(t *testing.T) {
+	newSearchTestStore()
+	r := store.Add(Review{ProductId: 2, Reviewer: "bob", Text: "A gripping tale.", Status: StatusHeld})
+	if hits := reviewIndex.Search("gripping", -1, 0); len(hits) != 0 {
+		t.Fatalf("held review indexed: %+v", hits)
+	}
+	store.SetStatus(r.Id, StatusApproved, "")
+	if hits := reviewIndex.Search("gripping", -1, 0); len(hits) != 1 {
+		t.Fatalf("approved review not indexed: %+v", hits)
+	}
+	r.Text, r.Status = "A dull tale.", StatusApproved
+	store.Replace(r)
+	if hits := reviewIndex.Search("gripping", -1, 0); len(hits) != 0 {
+		t.Errorf("edited text still indexed: %+v", hits)
+	}
+	store.Delete(r.Id)
+	if hits := reviewIndex.Search("dull", -1, 0); len(hits) != 0 {
+		t.Errorf("deleted review still indexed: %+v", hits)
+	}
+}
+
+func TestSnippetEscapesAndTrims(t *testing.T) {
+	text := strings.Repeat("word ", 40) + "<b>target</b> " + strings.Repeat("more ", 40)
+	got := snippet(text, parseQuery("target"))
+	if !strings.Contains(got, "&lt;b&gt;<mark>target</mark>&lt;/b&gt;") || !strings.HasPrefix(got, "… ") || !strings.HasSuffix(got, " …") {
+		t.Errorf("snippet = %q", got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Sentiment is the lexicon based sentiment of a review text. Score runs from
+// -1 (very negative) to 1 (very positive). Mismatch is set when the text
+// disagrees with the star rating the reviewer gave.
+type Sentiment struct {
+	Score    float64 `json:"score"`
+	Label    string  `json:"label"`
+	Mismatch bool    `json:"mismatch,omitempty"`
+}
+
+const (
+	SentimentPositive = "positive"
+	SentimentNeutral  = "neutral"
+	SentimentNegative = "negative"
+)
+
+// Word valences on a -3..3 scale. The list is small on purpose: it covers
+// the words people actually use about books and plays.
+var defaultLexicon = map[string]float64{
+	"amazing": 3, "awesome": 3, "brilliant": 3, "excellent": 3, "fantastic": 3,
+	"masterpiece": 3, "outstanding": 3, "superb": 3, "wonderful": 3,
+	"beautiful": 2, "captivating": 2, "delightful": 2, "engaging": 2,
+	"enjoyable": 2, "entertaining": 2, "funny": 2, "fun": 2, "great": 2,
+	"gripping": 2, "love": 2, "loved": 2, "moving": 2, "recommend": 2,
+	"refreshing": 2, "witty": 2,
+	"clever": 1, "good": 1, "interesting": 1, "like": 1, "liked": 1,
+	"nice": 1, "pleasant": 1, "solid": 1,
+	"lacks": -1, "long": -1, "mediocre": -1, "predictable": -1, "slow": -1,
+	"confusing": -2, "bad": -2, "boring": -2, "disappointing": -2,
+	"dull": -2, "flat": -2, "poor": -2, "tedious": -2, "weak": -2,
+	"awful": -3, "dreadful": -3, "hate": -3, "hated": -3, "horrible": -3,
+	"terrible": -3, "unreadable": -3, "waste": -3, "worst": -3,
+}
+
+var negations = map[string]bool{
+	"not": true, "no": true, "never": true, "hardly": true, "without": true,
+	"isn't": true, "wasn't": true, "don't": true, "doesn't": true, "didn't": true,
+	"can't": true, "couldn't": true, "won't": true, "nothing": true,
+}
+
+var intensifiers = map[string]float64{
+	"absolutely": 1.5, "extremely": 1.5, "really": 1.3, "so": 1.3,
+	"truly": 1.3, "very": 1.3, "quite": 1.1,
+	"barely": 0.5, "slightly": 0.5, "somewhat": 0.7,
+}
+
+var lexicon map[string]float64
+
+func init() {
+	lexicon = defaultLexicon
+	if path := os.Getenv("SENTIMENT_LEXICON"); path != "" {
+		var err error
+		if lexicon, err = loadLexicon(path); err != nil {
+			log.Fatalf("load lexicon %s: %v", path, err)
+		}
+	}
+}
+
+// loadLexicon reads "word score" lines, ignoring blank lines and # comments.
+// The words extend the default lexicon.
+func loadLexicon(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	words := make(map[string]float64, len(defaultLexicon))
+	for w, v := range defaultLexicon {
+		words[w] = v
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"word score\"", line)
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		words[strings.ToLower(fields[0])] = v
+	}
+	return words, scanner.Err()
+}
+
+// analyzeSentiment scores a text. Each clause is scored on its own: a
+// negation up to three words before a word flips and dampens it, an
+// intensifier right before it scales it, and after "but" the rest of the
+// sentence counts more than what came before.
+func analyzeSentiment(text string) Sentiment {
+	var total float64
+	for _, sentence := range strings.FieldsFunc(text, func(c rune) bool {
+		return c == '.' || c == '!' || c == '?' || c == ';'
+	}) {
+		words := strings.FieldsFunc(strings.ToLower(sentence), func(c rune) bool {
+			return !unicode.IsLetter(c) && c != '\''
+		})
+		var before, after float64
+		contrast := false
+		for i, word := range words {
+			if word == "but" || word == "however" {
+				contrast = true
+				continue
+			}
+			v, ok := lexicon[word]
+			if !ok {
+				continue
+			}
+			if i > 0 {
+				if k, ok := intensifiers[words[i-1]]; ok {
+					v *= k
+				}
+			}
+			for j := i - 1; j >= 0 && j >= i-3; j-- {
+				if negations[words[j]] {
+					v *= -0.75
+					break
+				}
+			}
+			if contrast {
+				after += v
+			} else {
+				before += v
+			}
+		}
+		if contrast {
+			total += 0.5*before + 1.5*after
+		} else {
+			total += before
+		}
+	}
+
+	// Squash the sum into -1..1, the same normalization VADER uses.
+	score := round2(total / math.Sqrt(total*total+15))
+	label := SentimentNeutral
+	switch {
+	case score >= 0.05:
+		label = SentimentPositive
+	case score <= -0.05:
+		label = SentimentNegative
+	}
+	return Sentiment{Score: score, Label: label}
+}
+
+// sentimentFor scores a review and compares it with its star rating, stars
+// being 0 when the rating is unknown.
+func sentimentFor(text string, stars int) Sentiment {
+	s := analyzeSentiment(text)
+	s.Mismatch = (stars >= 4 && s.Label == SentimentNegative) ||
+		(stars >= 1 && stars <= 2 && s.Label == SentimentPositive)
+	return s
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestAnalyzeSentiment(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"An extremely entertaining play by Shakespeare. The slapstick humour is refreshing!", SentimentPositive},
+		{"A dull and tedious read.", SentimentNegative},
+		{"The play was not good.", SentimentNegative},
+		{"It was never boring.", SentimentPositive},
+		{"Great costumes, but a boring and confusing plot.", SentimentNegative},
+		{"I read it on a train.", SentimentNeutral},
+	}
+	for _, tt := range tests {
+		if got := analyzeSentiment(tt.text); got.Label != tt.want {
+			t.Errorf("analyzeSentiment(%q) = %+v, want %s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSentimentMismatch(t *testing.T) {
+	if s := sentimentFor("Terrible, a waste of time.", 5); !s.Mismatch {
+		t.Errorf("negative text with 5 stars should mismatch: %+v", s)
+	}
+	if s := sentimentFor("Wonderful and witty.", 1); !s.Mismatch {
+		t.Errorf("positive text with 1 star should mismatch: %+v", s)
+	}
+	if s := sentimentFor("Terrible, a waste of time.", 0); s.Mismatch {
+		t.Errorf("unrated review should not mismatch: %+v", s)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import "strings"
+
+// stem reduces an English word to its stem with the Porter algorithm, so
+// that "entertaining", "entertained" and "entertains" all index as
+// "entertain". Words of up to two letters are returned unchanged.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	w := []byte(word)
+	w = stemStep1a(w)
+	w = stemStep1b(w)
+	w = stemStep1c(w)
+	w = stemStep2(w)
+	w = stemStep3(w)
+	w = stemStep4(w)
+	w = stemStep5(w)
+	return string(w)
+}
+
+func isConsonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in w, the m of the algorithm.
+func measure(w []byte) int {
+	m, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i == len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether w ends consonant-vowel-consonant with the last
+// consonant not w, x or y, as in "hop" but not "snow".
+func endsCVC(w []byte) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	c := w[n-1]
+	return c != 'w' && c != 'x' && c != 'y'
+}
+
+// replaceSuffix swaps suffix for replacement when the remaining stem has a
+// measure above minMeasure. It reports whether w ended with suffix at all.
+func replaceSuffix(w []byte, suffix, replacement string, minMeasure int) ([]byte, bool) {
+	if !strings.HasSuffix(string(w), suffix) {
+		return w, false
+	}
+	base := w[:len(w)-len(suffix)]
+	if measure(base) > minMeasure {
+		return append(base[:len(base):len(base)], replacement...), true
+	}
+	return w, true
+}
+
+func stemStep1a(w []byte) []byte {
+	s := string(w)
+	switch {
+	case strings.HasSuffix(s, "sses"), strings.HasSuffix(s, "ies"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(s, "ss"):
+		return w
+	case strings.HasSuffix(s, "s"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+func stemStep1b(w []byte) []byte {
+	s := string(w)
+	if strings.HasSuffix(s, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+	var base []byte
+	switch {
+	case strings.HasSuffix(s, "ed") && hasVowel(w[:len(w)-2]):
+		base = w[:len(w)-2]
+	case strings.HasSuffix(s, "ing") && hasVowel(w[:len(w)-3]):
+		base = w[:len(w)-3]
+	default:
+		return w
+	}
+	b := string(base)
+	switch {
+	case strings.HasSuffix(b, "at"), strings.HasSuffix(b, "bl"), strings.HasSuffix(b, "iz"):
+		return append(base[:len(base):len(base)], 'e')
+	case endsDoubleConsonant(base):
+		if c := base[len(base)-1]; c != 'l' && c != 's' && c != 'z' {
+			return base[:len(base)-1]
+		}
+	case measure(base) == 1 && endsCVC(base):
+		return append(base[:len(base):len(base)], 'e')
+	}
+	return base
+}
+
+func stemStep1c(w []byte) []byte {
+	if n := len(w); w[n-1] == 'y' && hasVowel(w[:n-1]) {
+		return append(w[:n-1:n-1], 'i')
+	}
+	return w
+}
+
+var step2Suffixes = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+var step3Suffixes = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func stemStep2(w []byte) []byte {
+	for _, s := range step2Suffixes {
+		if out, ok := replaceSuffix(w, s[0], s[1], 0); ok {
+			return out
+		}
+	}
+	return w
+}
+
+func stemStep3(w []byte) []byte {
+	for _, s := range step3Suffixes {
+		if out, ok := replaceSuffix(w, s[0], s[1], 0); ok {
+			return out
+		}
+	}
+	return w
+}
+
+func stemStep4(w []byte) []byte {
+	// Longer suffixes first so "ement" wins over "ment" and "ent".
+	best := ""
+	for _, suffix := range step4Suffixes {
+		if len(suffix) > len(best) && strings.HasSuffix(string(w), suffix) {
+			best = suffix
+		}
+	}
+	if best == "" {
+		return w
+	}
+	base := w[:len(w)-len(best)]
+	if measure(base) <= 1 {
+		return w
+	}
+	if best == "ion" {
+		if c := base[len(base)-1]; c != 's' && c != 't' {
+			return w
+		}
+	}
+	return base
+}
+
+func stemStep5(w []byte) []byte {
+	n := len(w)
+	if w[n-1] == 'e' {
+		base := w[:n-1]
+		if m := measure(base); m > 1 || (m == 1 && !endsCVC(base)) {
+			w = base
+		}
+	}
+	if n := len(w); n > 1 && w[n-1] == 'l' && endsDoubleConsonant(w) && measure(w) > 1 {
+		w = w[:n-1]
+	}
+	return w
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-bookinfo.local/common/outbox"
+)
+
+// Review statuses assigned by the moderation pipeline.
+const (
+	StatusApproved = "approved"
+	StatusHeld     = "held"
+	StatusRejected = "rejected"
+)
+
+type Review struct {
+	Id         int       `json:"id"`
+	ProductId  int       `json:"productId"`
+	Reviewer   string    `json:"reviewer"`
+	Text       string    `json:"text"`
+	Status     string    `json:"status"`
+	Moderation []string  `json:"moderation,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+// reviewStore keeps reviews in memory. The products of the catalog start out
+// with the two classic bookinfo reviews.
+type reviewStore struct {
+	mu      sync.RWMutex
+	nextId  int
+	reviews map[int]*Review
+
+	// moderating serialises moderating a review with storing it, so that
+	// DuplicateModerator sees every review stored before.
+	moderating sync.Mutex
+
+	listeners []func(r Review, deleted bool)
+}
+
+var store = newReviewStore(seedProductsFromEnv())
+
+// events is the outbox the writes of the store record their events in.
+var events *outbox.Outbox
+
+func init() {
+	events = outbox.NewFromEnv("reviews")
+}
+
+// seedProductsFromEnv returns the products given the default reviews, a comma
+// separated list of ids in SEED_PRODUCTS. It defaults to product 0, the one
+// productpage serves.
+func seedProductsFromEnv() []int {
+	value, ok := os.LookupEnv("SEED_PRODUCTS")
+	if !ok {
+		return []int{0}
+	}
+	var ids []int
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id < 0 {
+			log.Fatalf("SEED_PRODUCTS: invalid product id %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// newReviewStore returns a store holding the default reviews of the given
+// products. Other products start out without reviews.
+func newReviewStore(seedProducts []int) *reviewStore {
+	s := &reviewStore{nextId: 1, reviews: make(map[int]*Review)}
+	for _, productId := range seedProducts {
+		s.seed(productId)
+	}
+	return s
+}
+
+// seed adds the default reviews of a product.
+func (s *reviewStore) seed(productId int) {
+	for _, r := range []Review{
+		{Reviewer: "Reviewer1", Text: "An extremely entertaining play by Shakespeare. The slapstick humour is refreshing!"},
+		{Reviewer: "Reviewer2", Text: "Absolutely fun and entertaining. The play lacks thematic depth when compared to other plays by Shakespeare."},
+	} {
+		r.ProductId = productId
+		r.Status = StatusApproved
+		r.Created = time.Now().UTC()
+		s.insert(r)
+	}
+}
+
+// OnChange registers a function called with every review that is added,
+// changed or deleted, starting with the reviews already stored. It runs with
+// the store locked and must not call back into the store.
+func (s *reviewStore) OnChange(fn func(r Review, deleted bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+	ids := make([]int, 0, len(s.reviews))
+	for id := range s.reviews {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fn(*s.reviews[id], false)
+	}
+}
+
+// Moderate runs the pipeline on a review and calls save with the outcome.
+// Reviews are moderated and saved one at a time: save must store the review,
+// if at all, before Moderate returns.
+func (s *reviewStore) Moderate(p Pipeline, r Review, save func(verdict Verdict, reasons []string)) {
+	s.moderating.Lock()
+	defer s.moderating.Unlock()
+	save(p.Moderate(r))
+}
+
+func (s *reviewStore) notify(r Review, deleted bool) {
+	for _, fn := range s.listeners {
+		fn(r, deleted)
+	}
+}
+
+func (s *reviewStore) insert(r Review) Review {
+	r.Id = s.nextId
+	s.nextId++
+	s.reviews[r.Id] = &r
+	s.notify(r, false)
+	return r
+}
+
+// Add stores a new review and returns it with its id assigned.
+func (s *reviewStore) Add(r Review) Review {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Created.IsZero() {
+		r.Created = time.Now().UTC()
+	}
+	r = s.insert(r)
+	events.Record("review.created", r)
+	return r
+}
+
+func (s *reviewStore) Get(id int) (Review, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.reviews[id]
+	if !ok {
+		return Review{}, false
+	}
+	return *r, true
+}
+
+// SetStatus changes the moderation status of a review.
+func (s *reviewStore) SetStatus(id int, status string, note string) (Review, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reviews[id]
+	if !ok {
+		return Review{}, false
+	}
+	r.Status = status
+	if note != "" {
+		r.Moderation = append(r.Moderation, note)
+	}
+	s.notify(*r, false)
+	events.Record("review.updated", *r)
+	return *r, true
+}
+
+// ForProduct returns the reviews of a product with the given status, oldest
+// first. An empty status returns all of them.
+func (s *reviewStore) ForProduct(productId int, status string) []Review {
+	return s.filter(func(r *Review) bool {
+		return r.ProductId == productId && (status == "" || r.Status == status)
+	})
+}
+
+// WithStatus returns the reviews of all products with the given status. An
+// empty status returns all of them.
+func (s *reviewStore) WithStatus(status string) []Review {
+	return s.filter(func(r *Review) bool { return status == "" || r.Status == status })
+}
+
+func (s *reviewStore) filter(keep func(*Review) bool) []Review {
+	s.mu.RLock()
+	list := []Review{}
+	for _, r := range s.reviews {
+		if keep(r) {
+			list = append(list, *r)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// ByReviewer finds the review a reviewer wrote for a product. When there are
+// several, as there can be after an import, it returns the oldest.
+func (s *reviewStore) ByReviewer(productId int, reviewer string) (Review, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *Review
+	for _, r := range s.reviews {
+		if r.ProductId == productId && r.Reviewer == reviewer && (found == nil || r.Id < found.Id) {
+			found = r
+		}
+	}
+	if found == nil {
+		return Review{}, false
+	}
+	return *found, true
+}
+
+// Replace overwrites the stored review with the same id.
+func (s *reviewStore) Replace(r Review) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.reviews[r.Id]; !ok {
+		return false
+	}
+	s.reviews[r.Id] = &r
+	s.notify(r, false)
+	events.Record("review.updated", r)
+	return true
+}
+
+// Delete removes a review.
+func (s *reviewStore) Delete(id int) (Review, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reviews[id]
+	if !ok {
+		return Review{}, false
+	}
+	delete(s.reviews, id)
+	s.notify(*r, true)
+	events.Record("review.deleted", *r)
+	return *r, true
+}
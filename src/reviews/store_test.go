@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"go-bookinfo.local/common/outbox"
+)
+
+func TestReviewStoreSeedsCatalogOnly(t *testing.T) {
+	s := newReviewStore([]int{0})
+	if got := len(s.ForProduct(0, "")); got != 2 {
+		t.Errorf("product 0 has %d reviews, want the 2 default ones", got)
+	}
+	for id := 1; id < 100; id++ {
+		s.ForProduct(id, "")
+		s.ByReviewer(id, "Reviewer1")
+	}
+	if got := len(s.WithStatus("")); got != 2 {
+		t.Errorf("store holds %d reviews after looking up unknown products, want 2", got)
+	}
+}
+
+func TestReviewStoreModerateRejectsConcurrentDuplicates(t *testing.T) {
+	store = newReviewStore(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			review := Review{ProductId: 3, Reviewer: "alice", Text: "The same review, posted twice."}
+			store.Moderate(moderation, review, func(verdict Verdict, reasons []string) {
+				review.Status, review.Moderation = verdict.Status(), reasons
+				store.Add(review)
+			})
+		}()
+	}
+	wg.Wait()
+	if got := len(store.ForProduct(3, StatusApproved)); got != 1 {
+		t.Errorf("%d copies of the review were approved, want 1", got)
+	}
+}
+
+func TestReviewStoreByReviewerReturnsOldest(t *testing.T) {
+	s := newReviewStore(nil)
+	first := s.Add(Review{ProductId: 1, Reviewer: "alice", Text: "First."})
+	for i := 0; i < 10; i++ {
+		s.Add(Review{ProductId: 1, Reviewer: "alice", Text: "Again."})
+	}
+	for i := 0; i < 10; i++ {
+		if got, ok := s.ByReviewer(1, "alice"); !ok || got.Id != first.Id {
+			t.Fatalf("ByReviewer = %d, %v, want review %d", got.Id, ok, first.Id)
+		}
+	}
+}
+
+func TestReviewStoreRecordsEvents(t *testing.T) {
+	defer func(saved *outbox.Outbox) { events = saved }(events)
+	events = outbox.New("reviews", []string{"http://hooks.example"}, "", 1, time.Minute)
+
+	s := newReviewStore([]int{0})
+	r := s.Add(Review{ProductId: 0, Reviewer: "alice", Text: "Lovely.", Status: StatusHeld})
+	s.SetStatus(r.Id, StatusApproved, "")
+	s.Delete(r.Id)
+	var types []string
+	for _, d := range events.Pending() {
+		var review Review
+		if json.Unmarshal(d.Event.Data, &review); review.Id != r.Id {
+			t.Errorf("event %s for review %d, want %d", d.Event.Type, review.Id, r.Id)
+		}
+		types = append(types, d.Event.Type)
+	}
+	if len(types) != 3 || types[0] != "review.created" || types[1] != "review.updated" || types[2] != "review.deleted" {
+		t.Errorf("recorded %v", types)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// RatingRecord mirrors the records served by the ratings history endpoint.
+// Keep this in sync with ratings.
+type RatingRecord struct {
+	ProductId int       `json:"productId"`
+	Reviewer  string    `json:"reviewer"`
+	Stars     int       `json:"stars"`
+	Time      time.Time `json:"time"`
+}
+
+// The Bayesian average pulls the mean of products with few ratings towards a
+// neutral prior, as if every product had priorWeight extra ratings of
+// priorMean stars.
+const (
+	priorMean   = 3.0
+	priorWeight = 5.0
+)
+
+// trendWindows are the periods the trend compares against the period of the
+// same length right before them.
+var trendWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+type RatingSummary struct {
+	ProductId       int            `json:"productId"`
+	Version         string         `json:"version"`
+	Count           int            `json:"count"`
+	Mean            float64        `json:"mean"`
+	BayesianAverage float64        `json:"bayesianAverage"`
+	Histogram       map[string]int `json:"histogram"`
+	Trend           []TrendWindow  `json:"trend"`
+}
+
+// TrendWindow describes the ratings given within a window and how their mean
+// compares to the window before it.
+type TrendWindow struct {
+	Window       string  `json:"window"`
+	Count        int     `json:"count"`
+	Mean         float64 `json:"mean"`
+	PreviousMean float64 `json:"previousMean"`
+	Change       float64 `json:"change"`
+}
+
+// summarize aggregates the rating history of a product. Count, mean,
+// Bayesian average and histogram use the current rating of every reviewer;
+// the trend looks at all ratings given in each window.
+func summarize(productId int, records []RatingRecord, now time.Time) RatingSummary {
+	summary := RatingSummary{
+		ProductId: productId,
+		Version:   profile.Name,
+		Histogram: map[string]int{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0},
+		Trend:     []TrendWindow{},
+	}
+
+	current := make(map[string]RatingRecord)
+	for _, record := range records {
+		if latest, ok := current[record.Reviewer]; !ok || !record.Time.Before(latest.Time) {
+			current[record.Reviewer] = record
+		}
+	}
+	sum := 0
+	for _, record := range current {
+		summary.Count++
+		sum += record.Stars
+		summary.Histogram[strconv.Itoa(record.Stars)]++
+	}
+	if summary.Count > 0 {
+		summary.Mean = round2(float64(sum) / float64(summary.Count))
+	}
+	summary.BayesianAverage = round2((priorMean*priorWeight + float64(sum)) / (priorWeight + float64(summary.Count)))
+
+	for _, window := range trendWindows {
+		start, previousStart := now.Add(-window.length), now.Add(-2*window.length)
+		var count, previousCount, total, previousTotal int
+		for _, record := range records {
+			switch {
+			case record.Time.After(start) && !record.Time.After(now):
+				count++
+				total += record.Stars
+			case record.Time.After(previousStart) && !record.Time.After(start):
+				previousCount++
+				previousTotal += record.Stars
+			}
+		}
+		trend := TrendWindow{Window: window.name, Count: count}
+		if count > 0 {
+			trend.Mean = round2(float64(total) / float64(count))
+		}
+		if previousCount > 0 {
+			trend.PreviousMean = round2(float64(previousTotal) / float64(previousCount))
+		}
+		if count > 0 && previousCount > 0 {
+			trend.Change = round2(trend.Mean - trend.PreviousMean)
+		}
+		summary.Trend = append(summary.Trend, trend)
+	}
+	return summary
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
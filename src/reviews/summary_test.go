@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	records := []RatingRecord{
+		{Reviewer: "Reviewer1", Stars: 5, Time: now.Add(-10 * 24 * time.Hour)},
+		{Reviewer: "Reviewer2", Stars: 4, Time: now.Add(-9 * 24 * time.Hour)},
+		{Reviewer: "Reviewer1", Stars: 1, Time: now.Add(-time.Hour)},
+	}
+	summary := summarize(0, records, now)
+
+	if summary.Count != 2 || summary.Mean != 2.5 {
+		t.Errorf("count/mean = %d/%v, want 2/2.5", summary.Count, summary.Mean)
+	}
+	// (3*5 + 5) / (5 + 2)
+	if summary.BayesianAverage != 2.86 {
+		t.Errorf("bayesian average = %v, want 2.86", summary.BayesianAverage)
+	}
+	if summary.Histogram["1"] != 1 || summary.Histogram["4"] != 1 || summary.Histogram["5"] != 0 {
+		t.Errorf("unexpected histogram %v", summary.Histogram)
+	}
+
+	week := summary.Trend[1]
+	if week.Window != "7d" || week.Count != 1 || week.Mean != 1 || week.PreviousMean != 4.5 || week.Change != -3.5 {
+		t.Errorf("unexpected 7d trend %+v", week)
+	}
+}
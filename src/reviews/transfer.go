@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-bookinfo.local/common/audit"
+)
+
+// ReviewRecord is a review as exported and imported, together with the star
+// rating its reviewer gave the product.
+type ReviewRecord struct {
+	Id         int       `json:"id"`
+	ProductId  int       `json:"productId"`
+	Reviewer   string    `json:"reviewer"`
+	Text       string    `json:"text"`
+	Status     string    `json:"status,omitempty"`
+	Moderation []string  `json:"moderation,omitempty"`
+	Created    time.Time `json:"created"`
+	Stars      int       `json:"stars,omitempty"`
+}
+
+var csvColumns = []string{"id", "productId", "reviewer", "text", "status", "stars", "created", "moderation"}
+
+// Import conflict policies. A record conflicts with a stored review by the
+// same reviewer for the same product.
+const (
+	PolicySkip      = "skip"
+	PolicyOverwrite = "overwrite"
+	PolicyFail      = "fail"
+)
+
+// recordRow is a single record read from an import source. Row is the line
+// number used in the error report.
+type recordRow struct {
+	Row    int
+	Record ReviewRecord
+	Err    error
+}
+
+// ImportReport describes the outcome of an import. Ids maps the id a record
+// had in the source to the id of the review it was stored as.
+type ImportReport struct {
+	Imported    int            `json:"imported"`
+	Overwritten int            `json:"overwritten"`
+	Skipped     int            `json:"skipped"`
+	Failed      int            `json:"failed"`
+	Aborted     bool           `json:"aborted,omitempty"`
+	Errors      []string       `json:"errors,omitempty"`
+	Ids         map[string]int `json:"ids"`
+}
+
+// mapId records where a source record ended up. Records without an id in
+// the source are not mapped.
+func (r *ImportReport) mapId(from int, to int) {
+	if from > 0 {
+		r.Ids[strconv.Itoa(from)] = to
+	}
+}
+
+// exportReviews writes every review, all statuses, one record at a time.
+// Ratings are looked up once per product; when the ratings service can not
+// be reached the stars are left out.
+func exportReviews(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	var write func(ReviewRecord) error
+	var flush func() error
+	switch format {
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(c.Writer)
+		write = func(r ReviewRecord) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		w := csv.NewWriter(c.Writer)
+		if err := w.Write(csvColumns); err != nil {
+			return
+		}
+		write = func(r ReviewRecord) error { return w.Write(r.csvRow()) }
+		flush = func() error { w.Flush(); return w.Error() }
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=reviews."+format)
+	c.Status(http.StatusOK)
+
+	stars := make(map[int]map[string]int)
+	for _, review := range store.WithStatus("") {
+		if _, ok := stars[review.ProductId]; !ok {
+			stars[review.ProductId] = latestStars(c, review.ProductId)
+		}
+		record := ReviewRecord{
+			Id:         review.Id,
+			ProductId:  review.ProductId,
+			Reviewer:   review.Reviewer,
+			Text:       review.Text,
+			Status:     review.Status,
+			Moderation: review.Moderation,
+			Created:    review.Created,
+			Stars:      stars[review.ProductId][review.Reviewer],
+		}
+		if err := write(record); err != nil {
+			log.Printf("export: %v", err)
+			return
+		}
+	}
+	if err := flush(); err != nil {
+		log.Printf("export: %v", err)
+	}
+}
+
+// latestStars returns the current rating of every reviewer of a product.
+func latestStars(c *gin.Context, productId int) map[string]int {
+	stars := make(map[string]int)
+	records, err := ratingsClient.History(c.Request.Context(), productId, c.Request.Header)
+	if err != nil {
+		log.Printf("export: no ratings for product %d: %v", productId, err)
+		return stars
+	}
+	for _, r := range records {
+		stars[r.Reviewer] = r.Stars
+	}
+	return stars
+}
+
+func (r ReviewRecord) csvRow() []string {
+	stars, created := "", ""
+	if r.Stars > 0 {
+		stars = strconv.Itoa(r.Stars)
+	}
+	if !r.Created.IsZero() {
+		created = r.Created.Format(time.RFC3339Nano)
+	}
+	return []string{
+		strconv.Itoa(r.Id), strconv.Itoa(r.ProductId), r.Reviewer, r.Text, r.Status,
+		stars, created, strings.Join(r.Moderation, "\n"),
+	}
+}
+
+// importReviews checks every record of the request body before it stores
+// any of them. The body is checked as it is spooled to a temporary file and
+// stored from that file in a second pass, so that a large import is never
+// held in memory. Every imported review gets a new id. Records without a
+// status go through moderation like a submitted review; the others keep
+// their status. With policy=fail nothing is imported unless every record is
+// valid and free of conflicts.
+func importReviews(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	policy := c.DefaultQuery("policy", PolicySkip)
+	if policy != PolicySkip && policy != PolicyOverwrite && policy != PolicyFail {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "policy must be skip, overwrite or fail"})
+		return
+	}
+	var read func(io.Reader, func(recordRow)) error
+	switch format {
+	case "jsonl":
+		read = readReviewsJSONL
+	case "csv":
+		read = readReviewsCSV
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+
+	spool, err := os.CreateTemp("", "reviews-import-*")
+	if err != nil {
+		log.Printf("import: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not spool the import"})
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	report := ImportReport{Ids: make(map[string]int)}
+	fail := func(row int, err error) {
+		report.Failed++
+		report.Errors = append(report.Errors, fmt.Sprintf("row %d: %v", row, err))
+	}
+	check := recordChecker(policy)
+	err = read(io.TeeReader(c.Request.Body, spool), func(row recordRow) {
+		if err := check(row); err != nil {
+			fail(row.Row, err)
+		}
+	})
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil || policy == PolicyFail && report.Failed > 0 {
+		report.Aborted = true
+	} else {
+		// The rows were checked and reported above; the invalid ones are
+		// only skipped here.
+		err = read(spool, func(row recordRow) {
+			if row.Err == nil && validateRecord(row.Record) == nil {
+				applyRecord(c, row, policy, &report, fail)
+			}
+		})
+		if err != nil {
+			log.Printf("import: read spooled records: %v", err)
+		}
+	}
+
+	entry := audit.Entry{Actor: actor(c), Action: "review.import", Details: map[string]string{
+		"imported":    strconv.Itoa(report.Imported),
+		"overwritten": strconv.Itoa(report.Overwritten),
+		"skipped":     strconv.Itoa(report.Skipped),
+		"failed":      strconv.Itoa(report.Failed),
+	}}
+	if report.Aborted {
+		entry.Outcome = audit.Failure
+	}
+	auditLog.Record(c, entry)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		c.JSON(http.StatusBadRequest, report)
+		return
+	}
+	log.Printf("import by %s: %d imported, %d overwritten, %d skipped, %d failed",
+		actor(c), report.Imported, report.Overwritten, report.Skipped, report.Failed)
+	if report.Aborted {
+		c.JSON(http.StatusConflict, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// recordChecker returns a check of the rows of an import, in order. With
+// policy=fail a record that conflicts with a stored review, or with an
+// earlier record of the import, is an error too; only the reviewers seen so
+// far are remembered for that, not the records.
+func recordChecker(policy string) func(recordRow) error {
+	type reviewKey struct {
+		productId int
+		reviewer  string
+	}
+	seen := make(map[reviewKey]int)
+	return func(row recordRow) error {
+		if row.Err != nil {
+			return row.Err
+		}
+		record := row.Record
+		if err := validateRecord(record); err != nil {
+			return err
+		}
+		if policy != PolicyFail {
+			return nil
+		}
+		key := reviewKey{record.ProductId, record.Reviewer}
+		if existing, ok := store.ByReviewer(record.ProductId, record.Reviewer); ok {
+			return fmt.Errorf("%s already reviewed product %d as review %d", record.Reviewer, record.ProductId, existing.Id)
+		}
+		if first, ok := seen[key]; ok {
+			return fmt.Errorf("%s already reviewed product %d in row %d", record.Reviewer, record.ProductId, first)
+		}
+		seen[key] = row.Row
+		return nil
+	}
+}
+
+// applyRecord stores a row checked by recordChecker.
+func applyRecord(c *gin.Context, row recordRow, policy string, report *ImportReport, fail func(int, error)) {
+	record := row.Record
+	review := Review{
+		ProductId:  record.ProductId,
+		Reviewer:   record.Reviewer,
+		Text:       record.Text,
+		Status:     record.Status,
+		Moderation: record.Moderation,
+		Created:    record.Created,
+	}
+	if existing, ok := store.ByReviewer(record.ProductId, record.Reviewer); ok {
+		switch policy {
+		case PolicySkip:
+			report.Skipped++
+			report.mapId(record.Id, existing.Id)
+			return
+		case PolicyFail:
+			// Stored by someone else since the records were checked.
+			fail(row.Row, fmt.Errorf("%s already reviewed product %d as review %d", record.Reviewer, record.ProductId, existing.Id))
+			return
+		}
+		review.Id = existing.Id
+		if review.Status == "" {
+			review.Status = existing.Status
+		}
+		if review.Created.IsZero() {
+			review.Created = existing.Created
+		}
+		store.Replace(review)
+		report.Overwritten++
+	} else {
+		if review.Status == "" {
+			store.Moderate(moderation, review, func(verdict Verdict, reasons []string) {
+				review.Status, review.Moderation = verdict.Status(), reasons
+				review = store.Add(review)
+			})
+		} else {
+			review = store.Add(review)
+		}
+		report.Imported++
+	}
+	report.mapId(record.Id, review.Id)
+
+	if record.Stars > 0 {
+		stars := map[string]int{record.Reviewer: record.Stars}
+		if err := ratingsClient.Rate(c.Request.Context(), record.ProductId, stars, c.Request.Header); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("row %d: review imported, rating not: %v", row.Row, err))
+		}
+	}
+}
+
+// validateRecord checks the fields every imported review must have.
+func validateRecord(r ReviewRecord) error {
+	switch {
+	case r.ProductId < 0:
+		return fmt.Errorf("invalid product id %d", r.ProductId)
+	case r.Reviewer == "":
+		return errors.New("missing reviewer")
+	case strings.TrimSpace(r.Text) == "":
+		return errors.New("missing text")
+	case r.Stars < 0 || r.Stars > 5:
+		return fmt.Errorf("invalid stars %d", r.Stars)
+	}
+	switch r.Status {
+	case "", StatusApproved, StatusHeld, StatusRejected:
+		return nil
+	}
+	return fmt.Errorf("invalid status %q", r.Status)
+}
+
+// readReviewsJSONL reads one JSON record per line, skipping blank lines.
+func readReviewsJSONL(r io.Reader, emit func(recordRow)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := recordRow{Row: line}
+		if err := json.Unmarshal([]byte(text), &row.Record); err != nil {
+			row.Err = err
+		}
+		emit(row)
+	}
+	return scanner.Err()
+}
+
+// readReviewsCSV reads records from CSV with a header row naming the columns
+// written by the export; unknown columns are ignored.
+func readReviewsCSV(r io.Reader, emit func(recordRow)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				emit(recordRow{Row: line, Err: parseErr.Err})
+				continue
+			}
+			return err
+		}
+		field := func(name string) string {
+			i, ok := columns[strings.ToLower(name)]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		row := recordRow{Row: line, Record: ReviewRecord{
+			Reviewer: strings.TrimSpace(field("reviewer")),
+			Text:     field("text"),
+			Status:   strings.TrimSpace(field("status")),
+		}}
+		if moderation := field("moderation"); moderation != "" {
+			row.Record.Moderation = strings.Split(moderation, "\n")
+		}
+		for _, f := range []struct {
+			name string
+			dst  *int
+		}{{"id", &row.Record.Id}, {"productId", &row.Record.ProductId}, {"stars", &row.Record.Stars}} {
+			value := strings.TrimSpace(field(f.name))
+			if value == "" || row.Err != nil {
+				continue
+			}
+			if *f.dst, err = strconv.Atoi(value); err != nil {
+				row.Err = fmt.Errorf("invalid %s %q", f.name, value)
+			}
+		}
+		if created := strings.TrimSpace(field("created")); created != "" && row.Err == nil {
+			if row.Record.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+				row.Err = fmt.Errorf("invalid created %q", created)
+			}
+		}
+		emit(row)
+	}
+}
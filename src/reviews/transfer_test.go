@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func transferTestServer(t *testing.T) *gin.Engine {
+	ratings := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`[{"productId":0,"reviewer":"Reviewer1","stars":5},{"productId":0,"reviewer":"Reviewer1","stars":3}]`))
+	}))
+	t.Cleanup(ratings.Close)
+	ratingsClient = NewRatingsClient(ratings.URL+"/ratings", time.Second, 0)
+	adminToken = "secret"
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerTransferRoutes(r)
+	return r
+}
+
+func transfer(r *gin.Engine, method string, url string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	request := httptest.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	r.ServeHTTP(w, request)
+	return w
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	r := transferTestServer(t)
+	for _, format := range []string{"jsonl", "csv"} {
+		store = newReviewStore([]int{0})
+		store.Add(Review{ProductId: 0, Reviewer: "alice", Text: "Quotes, \"commas\"\nand newlines.", Status: StatusHeld})
+
+		exported := transfer(r, http.MethodGet, "/reviews/export?format="+format, "")
+		if exported.Code != http.StatusOK {
+			t.Fatalf("%s export: %d %s", format, exported.Code, exported.Body)
+		}
+		if format == "jsonl" && !strings.Contains(exported.Body.String(), `"stars":3`) {
+			t.Errorf("export lacks the latest rating of Reviewer1:\n%s", exported.Body)
+		}
+
+		store = newReviewStore([]int{0})
+		imported := transfer(r, http.MethodPost, "/reviews/import?format="+format+"&policy=skip", exported.Body.String())
+		var report ImportReport
+		json.Unmarshal(imported.Body.Bytes(), &report)
+		// Reviewer1 and Reviewer2 are seeded in the new store.
+		if imported.Code != http.StatusOK || report.Imported != 1 || report.Skipped != 2 || report.Failed != 0 {
+			t.Fatalf("%s import: %d %s", format, imported.Code, imported.Body)
+		}
+		review, ok := store.ByReviewer(0, "alice")
+		if !ok || review.Text != "Quotes, \"commas\"\nand newlines." || review.Status != StatusHeld {
+			t.Errorf("%s import stored %+v", format, review)
+		}
+		if report.Ids["3"] != review.Id {
+			t.Errorf("%s import mapped ids %v, want 3 -> %d", format, report.Ids, review.Id)
+		}
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	r := transferTestServer(t)
+	input := `{"id":7,"productId":1,"reviewer":"Reviewer1","text":"Replaced text."}
+{"id":8,"productId":1,"reviewer":"bob","text":"A new reviewer appears."}
+`
+	var report ImportReport
+	store = newReviewStore([]int{1})
+	w := transfer(r, http.MethodPost, "/reviews/import?policy=overwrite", input)
+	if review, _ := store.ByReviewer(1, "Reviewer1"); w.Code != http.StatusOK || review.Text != "Replaced text." || review.Status != StatusApproved {
+		t.Errorf("overwrite: %d %s, stored %+v", w.Code, w.Body, review)
+	}
+
+	// The conflict is in the last row: nothing is imported.
+	store = newReviewStore([]int{1})
+	w = transfer(r, http.MethodPost, "/reviews/import?policy=fail", `{"productId":1,"reviewer":"bob","text":"A new reviewer appears."}
+{"productId":1,"reviewer":"Reviewer1","text":"Replaced text."}
+`)
+	if _, ok := store.ByReviewer(1, "bob"); w.Code != http.StatusConflict || ok {
+		t.Errorf("fail: %d %s, import should store nothing when a record conflicts", w.Code, w.Body)
+	}
+	w = transfer(r, http.MethodPost, "/reviews/import?policy=fail", `{"productId":1,"reviewer":"bob","text":"A new reviewer appears."}
+{"productId":1,"reviewer":"bob","text":"And appears again."}
+not json
+`)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if _, ok := store.ByReviewer(1, "bob"); w.Code != http.StatusConflict || ok || report.Failed != 2 {
+		t.Errorf("fail: %d %s, every conflict and invalid record should be reported", w.Code, w.Body)
+	}
+
+	w = transfer(r, http.MethodPost, "/reviews/import", `{"productId":1,"reviewer":"","text":"x"}`+"\nnot json\n")
+	report = ImportReport{}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Failed != 2 || len(report.Errors) != 2 {
+		t.Errorf("invalid records: %s", w.Body)
+	}
+}
+
+type failingReader struct{ io.Reader }
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestImportSpoolsRecords(t *testing.T) {
+	r := transferTestServer(t)
+	spoolDir := t.TempDir()
+	t.Setenv("TMPDIR", spoolDir)
+
+	// Invalid records are reported once, by the check, and the spool is
+	// removed afterwards.
+	store = newReviewStore([]int{1})
+	w := transfer(r, http.MethodPost, "/reviews/import", `{"productId":1,"reviewer":"bob","text":"A new reviewer appears."}
+{"productId":1,"reviewer":"","text":"Nobody wrote this."}
+`)
+	var report ImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if _, ok := store.ByReviewer(1, "bob"); w.Code != http.StatusOK || !ok || report.Imported != 1 || report.Failed != 1 || len(report.Errors) != 1 {
+		t.Errorf("import: %d %s", w.Code, w.Body)
+	}
+	if left, _ := os.ReadDir(spoolDir); len(left) != 0 {
+		t.Errorf("spool files left behind: %v", left)
+	}
+
+	// A body that breaks off is not stored at all.
+	store = newReviewStore([]int{1})
+	request := httptest.NewRequest(http.MethodPost, "/reviews/import", failingReader{strings.NewReader(`{"productId":1,"reviewer":"bob","text":"A new reviewer appears."}` + "\n")})
+	request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	if _, ok := store.ByReviewer(1, "bob"); w.Code != http.StatusBadRequest || ok {
+		t.Errorf("broken body: %d %s", w.Code, w.Body)
+	}
+}
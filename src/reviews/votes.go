@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Vote values, as sent by clients and reported back in myVote.
+const (
+	VoteHelpful   = "helpful"
+	VoteUnhelpful = "unhelpful"
+)
+
+// voteStore records helpfulness votes. Each user has at most one vote per
+// review, voting again replaces it.
+type voteStore struct {
+	mu    sync.RWMutex
+	votes map[int]map[string]bool // review id -> user -> helpful
+}
+
+var votes = newVoteStore()
+
+func newVoteStore() *voteStore {
+	return &voteStore{votes: make(map[int]map[string]bool)}
+}
+
+// Set records the vote of a user on a review.
+func (s *voteStore) Set(reviewId int, user string, helpful bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byUser, ok := s.votes[reviewId]
+	if !ok {
+		byUser = make(map[string]bool)
+		s.votes[reviewId] = byUser
+	}
+	byUser[user] = helpful
+}
+
+// Delete withdraws the vote of a user, reporting whether there was one.
+func (s *voteStore) Delete(reviewId int, user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.votes[reviewId][user]; !ok {
+		return false
+	}
+	delete(s.votes[reviewId], user)
+	return true
+}
+
+// DeleteReview drops all votes on a review.
+func (s *voteStore) DeleteReview(reviewId int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.votes, reviewId)
+}
+
+// VoteCount sums up the votes on a review. Mine is the vote of user, empty
+// if they have not voted.
+type VoteCount struct {
+	Helpful   int    `json:"helpful"`
+	Unhelpful int    `json:"unhelpful"`
+	Mine      string `json:"myVote,omitempty"`
+}
+
+func (s *voteStore) Count(reviewId int, user string) VoteCount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count VoteCount
+	for voter, helpful := range s.votes[reviewId] {
+		vote := VoteUnhelpful
+		if helpful {
+			count.Helpful++
+			vote = VoteHelpful
+		} else {
+			count.Unhelpful++
+		}
+		if user != "" && voter == user {
+			count.Mine = vote
+		}
+	}
+	return count
+}
+
+// helpfulness ranks a review by the lower bound of the 95% Wilson score
+// interval of its helpful ratio, so a review with 40 of 50 helpful votes
+// ranks above one with a single helpful vote.
+func (c VoteCount) helpfulness() float64 {
+	n := float64(c.Helpful + c.Unhelpful)
+	if n == 0 {
+		return 0
+	}
+	const z = 1.96
+	p := float64(c.Helpful) / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// sortByHelpfulness orders reviews most helpful first, keeping the original
+// order between reviews that rank the same.
+func sortByHelpfulness(reviews []Review, counts map[int]VoteCount) {
+	sort.SliceStable(reviews, func(i, j int) bool {
+		return counts[reviews[i].Id].helpfulness() > counts[reviews[j].Id].helpfulness()
+	})
+}
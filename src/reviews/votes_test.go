@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestVotesDeduplicatePerUser(t *testing.T) {
+	v := newVoteStore()
+	v.Set(1, "alice", true)
+	v.Set(1, "alice", false)
+	v.Set(1, "bob", true)
+
+	if got := v.Count(1, "alice"); got.Helpful != 1 || got.Unhelpful != 1 || got.Mine != VoteUnhelpful {
+		t.Errorf("Count = %+v, want one vote each and alice unhelpful", got)
+	}
+	if !v.Delete(1, "alice") || v.Delete(1, "alice") {
+		t.Errorf("a vote can be withdrawn exactly once")
+	}
+	if got := v.Count(1, "carol"); got.Helpful != 1 || got.Unhelpful != 0 || got.Mine != "" {
+		t.Errorf("Count = %+v, want one helpful vote", got)
+	}
+}
+
+func TestSortByHelpfulness(t *testing.T) {
+	reviews := []Review{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}
+	counts := map[int]VoteCount{
+		2: {Helpful: 1},
+		3: {Helpful: 40, Unhelpful: 10},
+		4: {Unhelpful: 3},
+	}
+	sortByHelpfulness(reviews, counts)
+	want := []int{3, 2, 1, 4}
+	for i, r := range reviews {
+		if r.Id != want[i] {
+			t.Fatalf("order = %v, want %v", reviews, want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module go-bookinfo/webhook-receiver
+
+go 1.17
@@ -0,0 +1,165 @@
+// webhook-receiver is a local endpoint for the webhooks sent by reviews and
+// ratings. It checks the signature of every delivery, logs the events and
+// can exit once it has seen a number of them, which makes it usable in
+// scripted checks:
+//
+//	WEBHOOK_SECRET=s3cret webhook-receiver -addr :9090 -expect 2 -timeout 30s
+//
+// With -fail N every event is refused N times first, to watch the senders
+// retry.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSkew is how old, or how far in the future, a signature may be.
+const maxSkew = 5 * time.Minute
+
+type event struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Source string          `json:"source"`
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// receiver counts deliveries per event id, to refuse the first ones when
+// asked to and to report duplicates.
+type receiver struct {
+	secret []byte
+	fail   int
+
+	mu       sync.Mutex
+	attempts map[string]int
+	accepted chan event
+}
+
+func main() {
+	addr := flag.String("addr", ":9090", "address to listen on")
+	secret := flag.String("secret", os.Getenv("WEBHOOK_SECRET"), "shared secret, default $WEBHOOK_SECRET; empty accepts unsigned deliveries")
+	fail := flag.Int("fail", 0, "refuse every event this many times before accepting it")
+	expect := flag.Int("expect", 0, "exit successfully after this many events, 0 runs until stopped")
+	timeout := flag.Duration("timeout", time.Minute, "with -expect, fail if the events have not arrived by then")
+	flag.Parse()
+
+	rcv := &receiver{secret: []byte(*secret), fail: *fail, attempts: make(map[string]int), accepted: make(chan event, 64)}
+	go func() {
+		log.Printf("listening on %s", *addr)
+		log.Fatal(http.ListenAndServe(*addr, rcv))
+	}()
+
+	seen := 0
+	deadline := time.After(*timeout)
+	if *expect == 0 {
+		deadline = nil
+	}
+	for {
+		select {
+		case e := <-rcv.accepted:
+			seen++
+			log.Printf("%s %s from %s: %s", e.Type, e.Id, e.Source, e.Data)
+			if *expect > 0 && seen >= *expect {
+				log.Printf("received %d events", seen)
+				return
+			}
+		case <-deadline:
+			log.Printf("received %d of %d events", seen, *expect)
+			os.Exit(1)
+		}
+	}
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rcv.secret) > 0 {
+		if err := verify(rcv.secret, r.Header.Get("X-Webhook-Signature"), body, time.Now()); err != nil {
+			log.Printf("rejected delivery %s: %v", r.Header.Get("X-Webhook-Id"), err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	var e event
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mu.Lock()
+	rcv.attempts[e.Id]++
+	attempt := rcv.attempts[e.Id]
+	rcv.mu.Unlock()
+	switch {
+	case attempt <= rcv.fail:
+		log.Printf("refusing %s %s, attempt %d", e.Type, e.Id, attempt)
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	case attempt > rcv.fail+1:
+		log.Printf("duplicate delivery of %s %s", e.Type, e.Id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	rcv.accepted <- e
+}
+
+// verify checks a "t=<unix time>,v1=<hex hmac>" signature header against the
+// body, as computed by outbox.Sign in src/common.
+func verify(secret []byte, header string, body []byte, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signature = kv[1]
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return errors.New("missing signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("signature is %v old", skew.Round(time.Second))
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
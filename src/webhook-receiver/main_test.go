@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// sign mirrors outbox.Sign in src/common.
+func sign(secret string, t time.Time, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", t.Unix(), body)
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := `{"id":"1","type":"review.created"}`
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", sign("s3cret", now, body), true},
+		{"wrong secret", sign("other", now, body), false},
+		{"tampered body", sign("s3cret", now, body+" "), false},
+		{"replayed", sign("s3cret", now.Add(-10*time.Minute), body), false},
+		{"missing", "", false},
+		{"garbage", "t=x,v1=zz", false},
+	}
+	for _, tt := range tests {
+		if err := verify([]byte("s3cret"), tt.header, []byte(body), now); (err == nil) != tt.ok {
+			t.Errorf("%s: verify = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}